@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/audit"
+	"github.com/cyverse-de/app-exposer/auth"
 	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/app-exposer/external"
 	"github.com/cyverse-de/app-exposer/instantlaunches"
 	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/leader"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/labstack/echo/v4"
@@ -30,6 +39,7 @@ type ExposerApp struct {
 	router          *echo.Echo
 	db              *sqlx.DB
 	instantlaunches *instantlaunches.App
+	elector         *leader.Elector
 }
 
 // ExposerAppInit contains configuration settings for creating a new ExposerApp.
@@ -53,30 +63,12 @@ type ExposerAppInit struct {
 	NATSCredsFilePath             string
 	NATSMaxReconnects             int
 	NATSReconnectWait             int
+	NATSEncodedConn               *nats.EncodedConn
 }
 
-// NewExposerApp creates and returns a newly instantiated *ExposerApp.
-func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *ExposerApp {
-	jobStatusURL := c.String("vice.job-status.base")
-	if jobStatusURL == "" {
-		jobStatusURL = "http://job-status-listener"
-	}
-
-	metadataBaseURL := c.String("metadata.base")
-	if metadataBaseURL == "" {
-		metadataBaseURL = "http://metadata"
-	}
-
-	appsServiceBaseURL := c.String("apps.base")
-	if appsServiceBaseURL == "" {
-		appsServiceBaseURL = "http://apps"
-	}
-
-	permissionsURL := c.String("permissions.base")
-	if permissionsURL == "" {
-		permissionsURL = "http://permissions"
-	}
-
+// NewNATSEncodedConn connects to the NATS cluster described by the settings in
+// the ExposerAppInit.
+func NewNATSEncodedConn(init *ExposerAppInit) *nats.EncodedConn {
 	nc, err := nats.Connect(
 		init.NATSCluster,
 		nats.UserCredentials(init.NATSCredsFilePath),
@@ -107,11 +99,242 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 		log.Fatal(err)
 	}
 
+	return conn
+}
+
+// newElector creates the *leader.Elector used to make sure that background
+// workers only run on one replica.
+func newElector(init *ExposerAppInit, c *koanf.Koanf) *leader.Elector {
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	leaseName := c.String("leader-election.lease-name")
+	if leaseName == "" {
+		leaseName = "app-exposer-leader"
+	}
+
+	leaseDuration := c.Duration("leader-election.lease-duration")
+	if leaseDuration <= 0 {
+		leaseDuration = 15 * time.Second
+	}
+
+	renewDeadline := c.Duration("leader-election.renew-deadline")
+	if renewDeadline <= 0 {
+		renewDeadline = 10 * time.Second
+	}
+
+	retryPeriod := c.Duration("leader-election.retry-period")
+	if retryPeriod <= 0 {
+		retryPeriod = 2 * time.Second
+	}
+
+	return leader.New(&leader.Init{
+		ClientSet:     init.ClientSet,
+		Namespace:     init.Namespace,
+		LeaseName:     leaseName,
+		Identity:      identity,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Disabled:      c.Bool("leader-election.disabled"),
+	})
+}
+
+// newAuthMiddleware returns the middleware that authenticates requests to the
+// API, which is empty if authentication isn't enabled.
+func newAuthMiddleware(c *koanf.Koanf) []echo.MiddlewareFunc {
+	if !c.Bool("auth.enabled") {
+		return nil
+	}
+
+	trusted, err := auth.ParseNetworks(c.Strings("auth.trusted-networks"))
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "invalid auth.trusted-networks in the config file"))
+	}
+
+	adminRole := c.String("auth.admin-role")
+	if adminRole == "" {
+		adminRole = "vice-admin"
+	}
+
+	authenticator := auth.New(&auth.Init{
+		KeycloakBaseURL:  c.String("keycloak.base"),
+		KeycloakRealm:    c.String("keycloak.realm"),
+		KeycloakClientID: c.String("keycloak.client-id"),
+		AdminRole:        adminRole,
+		AdminPrefixes: []string{
+			"/vice/admin",
+			"/admin",
+			"/debug",
+			// These act on the whole cluster rather than on the user's own
+			// analyses.
+			"/vice/launch",
+			"/vice/listing",
+			"/vice/apply-labels",
+			"/vice/async-data",
+			"/service",
+			"/endpoint",
+			"/ingress",
+		},
+		AdminWritePrefixes: []string{"/instantlaunches/mappings/defaults"},
+		TrustedNetworks:    trusted,
+		KeyRefreshInterval: c.Duration("auth.key-refresh-interval"),
+	})
+
+	return []echo.MiddlewareFunc{authenticator.Middleware()}
+}
+
+// newAuditLog returns the log that administrative and destructive requests are
+// recorded in, or nil if auditing is disabled.
+func newAuditLog(init *ExposerAppInit, c *koanf.Koanf) *audit.Log {
+	if !c.Bool("audit.enabled") {
+		return nil
+	}
+
+	auditInit := &audit.Init{DB: init.db}
+	if c.Bool("audit.publish") {
+		subject := c.String("audit.subject")
+		if subject == "" {
+			subject = "cyverse.de.app-exposer.audit"
+		}
+		auditInit.NATSEncodedConn = init.NATSEncodedConn
+		auditInit.Subject = subject
+	}
+
+	return audit.New(auditInit)
+}
+
+// newDataMappings returns the additional iRODS collections that are mounted
+// into VICE analyses when the CSI driver is enabled.
+func newDataMappings(c *koanf.Koanf) []internal.DataMapping {
+	dataMappings := []internal.DataMapping{}
+	if err := c.Unmarshal("vice.csi.data-mappings", &dataMappings); err != nil {
+		log.Fatal(errors.Wrap(err, "unable to parse vice.csi.data-mappings in the config file"))
+	}
+	if err := internal.ValidateDataMappings(dataMappings); err != nil {
+		log.Fatal(errors.Wrap(err, "invalid vice.csi.data-mappings in the config file"))
+	}
+	return dataMappings
+}
+
+// newCapacityBounds returns the bounds on the capacity of the CSI data volume.
+func newCapacityBounds(c *koanf.Koanf) (minCapacity, maxCapacity *resource.Quantity) {
+	var err error
+	if minCapacity, err = internal.ParseCapacityBound(c.String("vice.csi.min-capacity")); err != nil {
+		log.Fatal(errors.Wrap(err, "invalid vice.csi.min-capacity in the config file"))
+	}
+	if maxCapacity, err = internal.ParseCapacityBound(c.String("vice.csi.max-capacity")); err != nil {
+		log.Fatal(errors.Wrap(err, "invalid vice.csi.max-capacity in the config file"))
+	}
+	if minCapacity != nil && maxCapacity != nil && minCapacity.Cmp(*maxCapacity) > 0 {
+		log.Fatalf("vice.csi.min-capacity %s is larger than vice.csi.max-capacity %s", minCapacity, maxCapacity)
+	}
+	return minCapacity, maxCapacity
+}
+
+// newTransferStatusTimeouts returns the longest time that a file transfer may
+// spend in each status.
+func newTransferStatusTimeouts(c *koanf.Koanf) map[string]time.Duration {
+	timeouts, err := internal.ParseTransferStatusTimeouts(c.StringMap("vice.file-transfers.status-timeouts"))
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "invalid vice.file-transfers.status-timeouts in the config file"))
+	}
+	return timeouts
+}
+
+// NewExposerApp creates and returns a newly instantiated *ExposerApp.
+func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *ExposerApp {
+	jobStatusURL := c.String("vice.job-status.base")
+	if jobStatusURL == "" {
+		jobStatusURL = "http://job-status-listener"
+	}
+
+	metadataBaseURL := c.String("metadata.base")
+	if metadataBaseURL == "" {
+		metadataBaseURL = "http://metadata"
+	}
+
+	appsServiceBaseURL := c.String("apps.base")
+	if appsServiceBaseURL == "" {
+		appsServiceBaseURL = "http://apps"
+	}
+
+	permissionsURL := c.String("permissions.base")
+	if permissionsURL == "" {
+		permissionsURL = "http://permissions"
+	}
+
+	usageSubject := c.String("qms.usage.subject")
+	if usageSubject == "" {
+		usageSubject = "cyverse.qms.user.usages.add"
+	}
+
+	usageReportInterval := c.Duration("qms.usage.interval")
+	if usageReportInterval <= 0 {
+		usageReportInterval = 15 * time.Minute
+	}
+
+	workspaceSize := c.String("vice.workspaces.size")
+	if workspaceSize == "" {
+		workspaceSize = "10Gi"
+	}
+
+	workspaceAccessMode := c.String("vice.workspaces.access-mode")
+	if workspaceAccessMode == "" {
+		workspaceAccessMode = "ReadWriteMany"
+	}
+
+	storageProvider := c.String("vice.storage.provider")
+	if !internal.IsStorageProvider(storageProvider) {
+		log.Fatalf("unknown storage provider %s in vice.storage.provider", storageProvider)
+	}
+
+	minCapacity, maxCapacity := newCapacityBounds(c)
+
+	ingressAuthEnabled := c.Bool("vice.ingress-auth.enabled")
+	if ingressAuthEnabled && (c.String("vice.ingress-auth.url") == "" || c.String("vice.ingress-auth.signing-key") == "") {
+		log.Fatal("vice.ingress-auth.url and vice.ingress-auth.signing-key must be set when vice.ingress-auth.enabled is true")
+	}
+	if ingressAuthEnabled && len(c.String("vice.ingress-auth.signing-key")) < internal.MinIngressAuthSigningKeyLength {
+		log.Fatalf("vice.ingress-auth.signing-key must be at least %d bytes long", internal.MinIngressAuthSigningKeyLength)
+	}
+
+	ingressAuthTokenTTL := c.Duration("vice.ingress-auth.token-ttl")
+	if ingressAuthTokenTTL <= 0 {
+		ingressAuthTokenTTL = 10 * time.Minute
+	}
+
 	internalInit := &internal.Init{
 		ViceNamespace:                 init.ViceNamespace,
 		PorklockImage:                 c.String("vice.file-transfers.image"),
 		PorklockTag:                   c.String("vice.file-transfers.tag"),
+		TransferTimeout:               c.Duration("vice.file-transfers.timeout"),
+		TransferStatusTimeouts:        newTransferStatusTimeouts(c),
+		TransferPollInterval:          c.Duration("vice.file-transfers.poll-interval"),
+		TransferMaxBackoff:            c.Duration("vice.file-transfers.max-backoff"),
+		TransferMaxPollErrors:         c.Int("vice.file-transfers.max-poll-errors"),
+		TransferHistoryRetention:      c.Duration("vice.file-transfers.history-retention"),
 		UseCSIDriver:                  c.Bool("vice.use_csi_driver"),
+		MountSharedCollection:         !c.Exists("vice.csi.mount-shared") || c.Bool("vice.csi.mount-shared"),
+		DataMappings:                  newDataMappings(c),
+		CSIVolumeMinCapacity:          minCapacity,
+		CSIVolumeMaxCapacity:          maxCapacity,
+		StorageProviderName:           storageProvider,
+		NFSServer:                     c.String("vice.storage.nfs.server"),
+		NFSPath:                       c.String("vice.storage.nfs.path"),
+		NFSReadOnly:                   c.Bool("vice.storage.nfs.read-only"),
+		S3Driver:                      c.String("vice.storage.s3.driver"),
+		S3Bucket:                      c.String("vice.storage.s3.bucket"),
+		S3StorageClass:                c.String("vice.storage.s3.storage-class"),
+		S3SecretName:                  c.String("vice.storage.s3.secret-name"),
+		S3SecretNamespace:             c.String("vice.storage.s3.secret-namespace"),
+		S3ReadOnly:                    c.Bool("vice.storage.s3.read-only"),
+		S3VolumeAttributes:            c.StringMap("vice.storage.s3.volume-attributes"),
+		StorageClaimName:              c.String("vice.storage.pvc.claim-name"),
+		StorageClaimReadOnly:          c.Bool("vice.storage.pvc.read-only"),
+		InputCollisionStrategy:        c.String("vice.csi.input-collisions"),
 		InputPathListIdentifier:       c.String("path_list.file_identifier"),
 		TicketInputPathListIdentifier: c.String("tickets_path_list.file_identifier"),
 		ImagePullSecretName:           c.String("vice.image-pull-secret"),
@@ -124,14 +347,50 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 		VICEBackendNamespace:          c.String("vice.backend-namespace"),
 		AppsServiceBaseURL:            appsServiceBaseURL,
 		JobStatusURL:                  jobStatusURL,
+		StatusOutboxEnabled:           c.Bool("vice.job-status.outbox.enabled"),
+		StatusOutboxBaseBackoff:       c.Duration("vice.job-status.outbox.base-backoff"),
+		StatusOutboxMaxBackoff:        c.Duration("vice.job-status.outbox.max-backoff"),
+		StatusOutboxMaxAttempts:       c.Int("vice.job-status.outbox.max-attempts"),
 		UserSuffix:                    init.UserSuffix,
 		PermissionsURL:                permissionsURL,
+		PermissionsCacheTTL:           c.Duration("permissions.cache-ttl"),
 		KeycloakBaseURL:               c.String("keycloak.base"),
 		KeycloakRealm:                 c.String("keycloak.realm"),
 		KeycloakClientID:              c.String("keycloak.client-id"),
 		KeycloakClientSecret:          c.String("keycloak.client-secret"),
 		IRODSZone:                     init.IRODSZone,
-		NATSEncodedConn:               conn,
+		QueueLaunches:                 c.Bool("vice.queue.enabled"),
+		ExtendedJobLimits:             c.Bool("vice.limits.extended"),
+		OverageCacheTTL:               c.Duration("qms.overages.cache-ttl"),
+		OverageRequestTimeout:         c.Duration("qms.overages.timeout"),
+		OverageFailureThreshold:       c.Int("qms.overages.failure-threshold"),
+		OverageBreakerResetTimeout:    c.Duration("qms.overages.reset-timeout"),
+		OverageFailOpen:               c.Bool("qms.overages.fail-open"),
+		ReportUsage:                   c.Bool("qms.usage.enabled"),
+		UsageSubject:                  usageSubject,
+		WorkspacesEnabled:             c.Bool("vice.workspaces.enabled"),
+		WorkspaceStorageClass:         c.String("vice.workspaces.storage-class"),
+		WorkspaceSize:                 workspaceSize,
+		WorkspaceMaxSize:              c.String("vice.workspaces.max-size"),
+		WorkspaceAccessMode:           workspaceAccessMode,
+		WorkspaceInactivityLimit:      c.Duration("vice.workspaces.inactivity-limit"),
+		OperationsEnabled:             c.Bool("vice.operations.enabled"),
+		OperationStaleAfter:           c.Duration("vice.operations.stale-after"),
+		PodMaxRestarts:                c.Int("vice.pod-watcher.max-restarts"),
+		IngressAuthEnabled:            ingressAuthEnabled,
+		IngressAuthURL:                c.String("vice.ingress-auth.url"),
+		IngressAuthSigninURL:          c.String("vice.ingress-auth.signin-url"),
+		IngressAuthLoginURL:           c.String("vice.ingress-auth.login-url"),
+		IngressAuthSigningKey:         c.String("vice.ingress-auth.signing-key"),
+		IngressAuthTokenTTL:           ingressAuthTokenTTL,
+		NATSEncodedConn:               init.NATSEncodedConn,
+	}
+
+	// Catch missing storage settings now rather than when analyses launch.
+	if internalInit.UseCSIDriver {
+		if err := internal.ValidateStorageSettings(internalInit); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid vice.storage settings in the config file"))
+		}
 	}
 
 	app := &ExposerApp{
@@ -145,51 +404,137 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 
 	app.router.Use(otelecho.Middleware("app-exposer"))
 
+	app.elector = newElector(init, c)
+	if internalInit.ReportUsage {
+		app.elector.AddWorker("usage-reporter", leader.Periodic(usageReportInterval, func(ctx context.Context) {
+			for _, err := range app.internal.ReportRunningUsage(ctx) {
+				log.Error(err)
+			}
+		}))
+	}
+	if interval := c.Duration("vice.apply-labels.interval"); c.Bool("vice.apply-labels.enabled") && interval > 0 {
+		app.elector.AddWorker("apply-labels", leader.Periodic(interval, func(ctx context.Context) {
+			for _, err := range app.internal.ApplyAsyncLabels(ctx) {
+				log.Error(err)
+			}
+		}))
+	}
+
+	// Workspaces are kept forever unless an inactivity limit is configured.
+	if internalInit.WorkspacesEnabled && internalInit.WorkspaceInactivityLimit > 0 {
+		interval := c.Duration("vice.workspaces.cleanup-interval")
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		app.elector.AddWorker("workspace-cleanup", leader.Periodic(interval, func(ctx context.Context) {
+			for _, err := range app.internal.CleanUpWorkspaces(ctx) {
+				log.Error(err)
+			}
+		}))
+	}
+
+	// Transfer histories are kept forever unless a retention period is
+	// configured.
+	if internalInit.TransferHistoryRetention > 0 {
+		interval := c.Duration("vice.file-transfers.history-cleanup-interval")
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		app.elector.AddWorker("transfer-history-cleanup", leader.Periodic(interval, func(ctx context.Context) {
+			for _, err := range app.internal.CleanUpTransferHistory(ctx) {
+				log.Error(err)
+			}
+		}))
+	}
+
+	if internalInit.StatusOutboxEnabled {
+		interval := c.Duration("vice.job-status.outbox.interval")
+		if interval <= 0 {
+			interval = 2 * time.Second
+		}
+		app.elector.AddWorker("status-outbox", leader.Periodic(interval, func(ctx context.Context) {
+			for _, err := range app.internal.DeliverStatusUpdates(ctx) {
+				log.Error(err)
+			}
+		}))
+	}
+
+	if c.Bool("vice.pod-watcher.enabled") {
+		app.elector.AddWorker("pod-watcher", app.internal.WatchPods)
+	}
+
+	// Abandoned operations are picked up as soon as this replica becomes the
+	// leader, and then periodically.
+	if internalInit.OperationsEnabled {
+		operationsInterval := c.Duration("vice.operations.resume-interval")
+		if operationsInterval <= 0 {
+			operationsInterval = time.Minute
+		}
+		resumeOperations := func(ctx context.Context) {
+			for _, err := range app.internal.ResumeOperations(ctx) {
+				log.Error(err)
+			}
+		}
+		app.elector.AddWorker("operation-resumer", func(ctx context.Context) {
+			resumeOperations(ctx)
+			leader.Periodic(operationsInterval, resumeOperations)(ctx)
+		})
+	}
+
+	auditLog := newAuditLog(init, c)
+
 	ilInit := &instantlaunches.Init{
 		UserSuffix:      init.UserSuffix,
 		MetadataBaseURL: metadataBaseURL,
 		PermissionsURL:  permissionsURL,
+		AuditLog:        auditLog,
 	}
 
-	app.router.HTTPErrorHandler = func(err error, c echo.Context) {
-		code := http.StatusInternalServerError
-		var body interface{}
-
-		switch err := err.(type) {
-		case common.ErrorResponse:
-			code = http.StatusBadRequest
-			body = err
-		case *common.ErrorResponse:
-			code = http.StatusBadRequest
-			body = err
-		case *echo.HTTPError:
-			echoErr := err
-			code = echoErr.Code
-			body = common.NewErrorResponse(err)
-		default:
-			body = common.NewErrorResponse(err)
-		}
-
-		c.JSON(code, body) // nolint:errcheck
-	}
+	app.router.HTTPErrorHandler = common.HTTPErrorHandler
 
 	app.router.GET("/", app.Greeting).Name = "greeting"
 	app.router.Static("/docs", "./docs")
 
-	vice := app.router.Group("/vice")
+	// The greeting and docs stay open; everything else requires a token when
+	// authentication is enabled. The metrics at /debug/vars are limited to
+	// admins and trusted networks.
+	authMiddleware := newAuthMiddleware(c)
+
+	app.router.GET("/debug/vars", echo.WrapHandler(expvar.Handler()), authMiddleware...)
+
+	// nginx checks requests to analyses here. It can't present a bearer
+	// token, so the endpoint is registered outside of the /vice group and
+	// authenticates requests with the analysis access tokens instead.
+	app.router.GET("/vice/auth", app.internal.IngressAuthHandler)
+	app.router.GET("/vice/auth/signin", app.internal.IngressSigninHandler)
+
+	vice := app.router.Group("/vice", authMiddleware...)
 	vice.POST("/launch", app.internal.LaunchAppHandler)
 	vice.POST("/apply-labels", app.internal.ApplyAsyncLabelsHandler)
 	vice.GET("/async-data", app.internal.AsyncDataHandler)
 	vice.GET("/listing", app.internal.FilterableResourcesHandler)
+	vice.GET("/queue", app.internal.QueuedLaunchesHandler)
+	vice.POST("/queue/order", app.internal.ReorderQueuedLaunchesHandler)
+	vice.DELETE("/queue/:queue-id", app.internal.CancelQueuedLaunchHandler)
+	vice.GET("/workspace", app.internal.GetWorkspaceHandler)
+	vice.DELETE("/workspace", app.internal.DeleteWorkspaceHandler)
+	vice.POST("/workspace/size", app.internal.ResizeWorkspaceHandler)
 	vice.POST("/:id/download-input-files", app.internal.TriggerDownloadsHandler)
 	vice.POST("/:id/save-output-files", app.internal.TriggerUploadsHandler)
-	vice.POST("/:id/exit", app.internal.ExitHandler)
-	vice.POST("/:id/save-and-exit", app.internal.SaveAndExitHandler)
+	vice.POST("/:id/exit", app.internal.ExitHandler, auditLog.Action("analysis.exit"))
+	vice.POST("/:id/save-and-exit", app.internal.SaveAndExitHandler, auditLog.Action("analysis.save-and-exit"))
+	if internalInit.OperationsEnabled {
+		vice.GET("/operations/:operation-id", app.internal.OperationHandler)
+	}
 	vice.GET("/:analysis-id/pods", app.internal.PodsHandler)
 	vice.GET("/:analysis-id/logs", app.internal.LogsHandler)
 	vice.POST("/:analysis-id/time-limit", app.internal.TimeLimitUpdateHandler)
 	vice.GET("/:analysis-id/time-limit", app.internal.GetTimeLimitHandler)
+	vice.GET("/:analysis-id/transfers", app.internal.TransfersHandler)
+	vice.GET("/:analysis-id/transfers/:transfer-id", app.internal.TransfersHandler)
+	vice.POST("/:analysis-id/transfers/:transfer-id/cancel", app.internal.CancelTransferHandler)
 	vice.GET("/:host/url-ready", app.internal.URLReadyHandler)
+	vice.GET("/:host/access-token", app.internal.AccessTokenHandler)
 	vice.GET("/:host/description", app.internal.DescribeAnalysisHandler)
 
 	vicelisting := vice.Group("/listing")
@@ -205,35 +550,47 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 	viceadmin.GET("/:host/description", app.internal.AdminDescribeAnalysisHandler)
 	viceadmin.GET("/:host/url-ready", app.internal.AdminURLReadyHandler)
 
+	if internalInit.OperationsEnabled {
+		viceadmin.GET("/operations/:operation-id", app.internal.AdminOperationHandler)
+	}
+
 	viceanalyses := viceadmin.Group("/analyses")
 	viceanalyses.GET("/", app.internal.AdminFilterableResourcesHandler)
-	viceanalyses.POST("/:analysis-id/download-input-files", app.internal.AdminTriggerDownloadsHandler)
-	viceanalyses.POST("/:analysis-id/save-output-files", app.internal.AdminTriggerUploadsHandler)
-	viceanalyses.POST("/:analysis-id/exit", app.internal.AdminExitHandler)
-	viceanalyses.POST("/:analysis-id/save-and-exit", app.internal.AdminSaveAndExitHandler)
+	viceanalyses.POST("/:analysis-id/download-input-files", app.internal.AdminTriggerDownloadsHandler, auditLog.Action("admin.analysis.download-input-files"))
+	viceanalyses.POST("/:analysis-id/save-output-files", app.internal.AdminTriggerUploadsHandler, auditLog.Action("admin.analysis.save-output-files"))
+	viceanalyses.POST("/:analysis-id/exit", app.internal.AdminExitHandler, auditLog.Action("admin.analysis.exit"))
+	viceanalyses.POST("/:analysis-id/save-and-exit", app.internal.AdminSaveAndExitHandler, auditLog.Action("admin.analysis.save-and-exit"))
 	viceanalyses.GET("/:analysis-id/time-limit", app.internal.AdminGetTimeLimitHandler)
-	viceanalyses.POST("/:analysis-id/time-limit", app.internal.AdminTimeLimitUpdateHandler)
+	viceanalyses.POST("/:analysis-id/time-limit", app.internal.AdminTimeLimitUpdateHandler, auditLog.Action("admin.analysis.time-limit.update"))
 	viceanalyses.GET("/:analysis-id/external-id", app.internal.AdminGetExternalIDHandler)
+	viceanalyses.GET("/:analysis-id/transfers", app.internal.AdminTransfersHandler)
+	viceanalyses.GET("/:analysis-id/transfers/:transfer-id", app.internal.AdminTransfersHandler)
+	viceanalyses.POST("/:analysis-id/transfers/:transfer-id/cancel", app.internal.AdminCancelTransferHandler, auditLog.Action("admin.analysis.transfer.cancel"))
 
-	svc := app.router.Group("/service")
-	svc.POST("/:name", app.external.CreateServiceHandler)
-	svc.PUT("/:name", app.external.UpdateServiceHandler)
+	svc := app.router.Group("/service", authMiddleware...)
+	svc.POST("/:name", app.external.CreateServiceHandler, auditLog.Action("service.create"))
+	svc.PUT("/:name", app.external.UpdateServiceHandler, auditLog.Action("service.update"))
 	svc.GET("/:name", app.external.GetServiceHandler)
-	svc.DELETE("/:name", app.external.DeleteServiceHandler)
+	svc.DELETE("/:name", app.external.DeleteServiceHandler, auditLog.Action("service.delete"))
 
-	endpoint := app.router.Group("/endpoint")
-	endpoint.POST("/:name", app.external.CreateEndpointHandler)
-	endpoint.PUT("/:name", app.external.UpdateEndpointHandler)
+	endpoint := app.router.Group("/endpoint", authMiddleware...)
+	endpoint.POST("/:name", app.external.CreateEndpointHandler, auditLog.Action("endpoint.create"))
+	endpoint.PUT("/:name", app.external.UpdateEndpointHandler, auditLog.Action("endpoint.update"))
 	endpoint.GET("/:name", app.external.GetEndpointHandler)
-	endpoint.DELETE("/:name", app.external.DeleteEndpointHandler)
+	endpoint.DELETE("/:name", app.external.DeleteEndpointHandler, auditLog.Action("endpoint.delete"))
 
-	ingress := app.router.Group("/ingress")
-	ingress.POST("/:name", app.external.CreateIngressHandler)
-	ingress.PUT("/:name", app.external.UpdateIngressHandler)
+	ingress := app.router.Group("/ingress", authMiddleware...)
+	ingress.POST("/:name", app.external.CreateIngressHandler, auditLog.Action("ingress.create"))
+	ingress.PUT("/:name", app.external.UpdateIngressHandler, auditLog.Action("ingress.update"))
 	ingress.GET("/:name", app.external.GetIngressHandler)
-	ingress.DELETE("/:name", app.external.DeleteIngressHandler)
+	ingress.DELETE("/:name", app.external.DeleteIngressHandler, auditLog.Action("ingress.delete"))
 
-	ilgroup := app.router.Group("/instantlaunches")
+	if auditLog != nil {
+		admin := app.router.Group("/admin", authMiddleware...)
+		admin.GET("/audit", auditLog.ListHandler)
+	}
+
+	ilgroup := app.router.Group("/instantlaunches", authMiddleware...)
 	app.instantlaunches = instantlaunches.New(app.db, ilgroup, ilInit)
 
 	return app
@@ -242,5 +599,12 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 // Greeting lets the caller know that the service is up and should be receiving
 // requests.
 func (e *ExposerApp) Greeting(context echo.Context) error {
-	return context.String(http.StatusOK, "Hello from app-exposer.")
+	leader := e.elector.Leader()
+	if leader == "" {
+		leader = "unknown"
+	}
+	return context.String(
+		http.StatusOK,
+		fmt.Sprintf("Hello from app-exposer.\nReplica: %s\nLeader: %s\n", e.elector.Identity, leader),
+	)
 }
@@ -195,6 +195,20 @@ func (a *Apps) GetUserID(ctx context.Context, username string) (string, error) {
 	return id, err
 }
 
+const usernameByID = `
+	SELECT u.username
+	  FROM users u
+	 WHERE u.id = $1
+`
+
+// GetUsername returns the user's full username, including the domain suffix,
+// based on their UUID.
+func (a *Apps) GetUsername(ctx context.Context, userID string) (string, error) {
+	var username string
+	err := a.DB.QueryRowContext(ctx, usernameByID, userID).Scan(&username)
+	return username, err
+}
+
 const setMillicoresStmt = `
 	UPDATE jobs
 	SET millicores_reserved = $2::int
@@ -0,0 +1,369 @@
+// Package audit keeps a record of administrative and destructive requests:
+// who made them, what they did to which analysis or resource, the parameters
+// they passed and whether it worked. Entries are stored in the database and
+// may also be published on NATS for other services to pick up.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/auth"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var log = common.Log.WithFields(logrus.Fields{"package": "audit"})
+
+const (
+	// Success means that the request worked.
+	Success = "success"
+
+	// Failure means that the request returned an error.
+	Failure = "failure"
+
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	// maxBodyBytes limits how much of a request body is recorded.
+	maxBodyBytes = 64 * 1024
+
+	// ServiceNameHeader is the header that services calling app-exposer
+	// without a user can identify themselves with.
+	ServiceNameHeader = "X-Service-Name"
+)
+
+// Entry is a single audited request.
+type Entry struct {
+	ID         string         `json:"id" db:"id"`
+	Actor      string         `json:"actor" db:"actor"`
+	Action     string         `json:"action" db:"action"`
+	AnalysisID string         `json:"analysis_id,omitempty" db:"analysis_id"`
+	Resource   string         `json:"resource,omitempty" db:"resource"`
+	Params     types.JSONText `json:"params" db:"params"`
+	Outcome    string         `json:"outcome" db:"outcome"`
+	Status     int            `json:"status" db:"status"`
+	Error      string         `json:"error,omitempty" db:"error"`
+	RemoteAddr string         `json:"remote_addr" db:"remote_addr"`
+	CreatedOn  time.Time      `json:"created_on" db:"created_on"`
+}
+
+// Init contains the settings for creating a *Log.
+type Init struct {
+	DB *sqlx.DB
+
+	// NATSEncodedConn and Subject are optional. When both are set, entries
+	// are published on the subject as well as being stored.
+	NATSEncodedConn *nats.EncodedConn
+	Subject         string
+}
+
+// Log records audit entries. A nil *Log doesn't record anything, which lets
+// packages accept one without requiring it.
+type Log struct {
+	Init
+}
+
+// New returns a newly created *Log.
+func New(init *Init) *Log {
+	return &Log{Init: *init}
+}
+
+const insertEntrySQL = `
+	INSERT INTO vice_audit_log (actor, action, analysis_id, resource, params, outcome, status, error, remote_addr)
+	VALUES (:actor, :action, NULLIF(:analysis_id, ''), :resource, :params, :outcome, :status, :error, :remote_addr)
+	RETURNING id, created_on
+`
+
+// Record stores the entry and publishes it if publishing is configured. The
+// entry's ID and creation time are filled in.
+func (l *Log) Record(ctx context.Context, entry *Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	if entry.Params == nil {
+		entry.Params = types.JSONText("{}")
+	}
+
+	rows, err := l.DB.NamedQueryContext(ctx, insertEntrySQL, entry)
+	if err != nil {
+		return fmt.Errorf("unable to record %s by %s: %w", entry.Action, entry.Actor, err)
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err = rows.Scan(&entry.ID, &entry.CreatedOn); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if l.NATSEncodedConn != nil && l.Subject != "" {
+		if err = l.publish(ctx, entry); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (l *Log) publish(ctx context.Context, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(l.Subject)
+	msg.Data = data
+
+	_, span := gotelnats.InjectSpan(ctx, propagation.HeaderCarrier(msg.Header), l.Subject, gotelnats.Send)
+	defer span.End()
+
+	if err = l.NATSEncodedConn.Conn.PublishMsg(msg); err != nil {
+		return fmt.Errorf("unable to publish audit entry %s on %s: %w", entry.ID, l.Subject, err)
+	}
+	return nil
+}
+
+// Action returns middleware that records each request to the route as the
+// action. The path and query parameters and the request body are recorded
+// along with the response status. The analysis-id path parameter, if there is
+// one, is recorded as the target analysis and the name or id path parameter
+// as the target resource. Requests that don't name a user are recorded with
+// an actor identifying the caller instead; see actor. Failing to record an
+// entry is logged but doesn't fail the request.
+func (l *Log) Action(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if l == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			body, truncated := peekBody(c.Request())
+
+			handlerErr := next(c)
+
+			entry := &Entry{
+				Actor:      actor(c),
+				Action:     action,
+				AnalysisID: c.Param("analysis-id"),
+				Resource:   c.Param("name"),
+				Params:     requestParams(c, body, truncated),
+				RemoteAddr: remoteAddr(c.Request()),
+			}
+			if entry.Resource == "" {
+				entry.Resource = c.Param("id")
+			}
+
+			entry.Status = c.Response().Status
+			if handlerErr != nil {
+				resp := common.NewErrorResponse(handlerErr)
+				entry.Status = resp.StatusCode()
+				entry.Error = resp.Message
+			}
+
+			entry.Outcome = Success
+			if handlerErr != nil || entry.Status >= http.StatusBadRequest {
+				entry.Outcome = Failure
+			}
+
+			if err := l.Record(c.Request().Context(), entry); err != nil {
+				log.Error(err)
+			}
+
+			return handlerErr
+		}
+	}
+}
+
+// actor returns the user who made the request. Requests without a user, such
+// as ones from services on trusted networks, are recorded as made by
+// "service:" followed by the name in the ServiceNameHeader if there is one, or
+// "unauthenticated:" followed by the remote address otherwise.
+func actor(c echo.Context) string {
+	if user := auth.User(c); user != "" {
+		return user
+	}
+	if service := c.Request().Header.Get(ServiceNameHeader); service != "" {
+		return "service:" + service
+	}
+	return "unauthenticated:" + remoteAddr(c.Request())
+}
+
+// peekBody returns up to maxBodyBytes of the request body, and whether there
+// was more than that. The body is put back so that the handler can still read
+// all of it.
+func peekBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		log.Error(fmt.Errorf("unable to read the request body for the audit log: %w", err))
+		return nil, false
+	}
+
+	if len(body) > maxBodyBytes {
+		return body[:maxBodyBytes], true
+	}
+	return body, false
+}
+
+// requestParams returns the path and query parameters of the request as a
+// JSON object. The body is added as body, as JSON if it's a complete JSON
+// document and otherwise as a string, with body_truncated set if it was cut
+// short.
+func requestParams(c echo.Context, body []byte, truncated bool) types.JSONText {
+	params := make(map[string]interface{})
+	for i, name := range c.ParamNames() {
+		if i < len(c.ParamValues()) {
+			params[name] = c.ParamValues()[i]
+		}
+	}
+	for name, values := range c.QueryParams() {
+		if len(values) == 1 {
+			params[name] = values[0]
+		} else {
+			params[name] = values
+		}
+	}
+	if len(body) > 0 {
+		if !truncated && json.Valid(body) {
+			params["body"] = json.RawMessage(body)
+		} else {
+			params["body"] = string(body)
+		}
+		if truncated {
+			params["body_truncated"] = true
+		}
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		log.Error(err)
+		return types.JSONText("{}")
+	}
+	return types.JSONText(data)
+}
+
+func remoteAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Filter limits the entries returned by List. Empty fields aren't used.
+type Filter struct {
+	Actor      string
+	AnalysisID string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+// List returns the entries matching the filter, newest first.
+func (l *Log) List(ctx context.Context, filter *Filter) ([]Entry, error) {
+	query := `
+	SELECT id, actor, action, COALESCE(analysis_id, '') AS analysis_id, resource, params,
+	       outcome, status, error, remote_addr, created_on
+	  FROM vice_audit_log
+	 WHERE true`
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if filter.Actor != "" {
+		query += " AND actor = " + arg(filter.Actor)
+	}
+	if filter.AnalysisID != "" {
+		query += " AND analysis_id = " + arg(filter.AnalysisID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_on >= " + arg(filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_on < " + arg(filter.Until)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	query += " ORDER BY created_on DESC LIMIT " + arg(limit)
+
+	entries := []Entry{}
+	if err := l.DB.SelectContext(ctx, &entries, query, args...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseTime accepts RFC 3339 timestamps or seconds since the epoch.
+func parseTime(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ListHandler returns audit entries. The actor, analysis-id, since, until and
+// limit query parameters narrow down the entries. The user who made the
+// requests is passed as actor since the user parameter identifies the caller.
+// Times may be RFC 3339 timestamps or seconds since the epoch.
+func (l *Log) ListHandler(c echo.Context) error {
+	filter := &Filter{
+		Actor:      c.QueryParam("actor"),
+		AnalysisID: c.QueryParam("analysis-id"),
+	}
+
+	var err error
+	if v := c.QueryParam("since"); v != "" {
+		if filter.Since, err = parseTime(v); err != nil {
+			return common.BadRequest(fmt.Sprintf("invalid since value %s", v))
+		}
+	}
+	if v := c.QueryParam("until"); v != "" {
+		if filter.Until, err = parseTime(v); err != nil {
+			return common.BadRequest(fmt.Sprintf("invalid until value %s", v))
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return common.BadRequest(fmt.Sprintf("invalid limit value %s", v))
+		}
+	}
+
+	entries, err := l.List(c.Request().Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"entries": entries})
+}
@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupLog(t *testing.T) (*Log, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return New(&Init{DB: sqlx.NewDb(db, "sqlmock")}), mock
+}
+
+// serve sends the request to a route for the path that's wrapped in the log's
+// middleware for the action.
+func serve(l *Log, path, action string, handler echo.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.HTTPErrorHandler = common.HTTPErrorHandler
+	e.POST(path, handler, l.Action(action))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestActionRecordsSuccess(t *testing.T) {
+	l, mock := setupLog(t)
+
+	mock.ExpectQuery("INSERT INTO vice_audit_log").
+		WithArgs(
+			"ipcdev",
+			"admin.analysis.exit",
+			"c0a8d1e2-0000-0000-0000-000000000000",
+			"",
+			sqlmock.AnyArg(),
+			Success,
+			http.StatusOK,
+			"",
+			"192.0.2.1",
+		).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on"}).AddRow("entry-id", time.Now()))
+
+	req := httptest.NewRequest(http.MethodPost, "/analyses/c0a8d1e2-0000-0000-0000-000000000000/exit?user=ipcdev", nil)
+	req.RemoteAddr = "192.0.2.1:4567"
+	rec := serve(l, "/analyses/:analysis-id/exit", "admin.analysis.exit", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestActionRecordsFailure(t *testing.T) {
+	l, mock := setupLog(t)
+
+	mock.ExpectQuery("INSERT INTO vice_audit_log").
+		WithArgs(
+			"unauthenticated:192.0.2.1",
+			"service.delete",
+			"",
+			"my-service",
+			sqlmock.AnyArg(),
+			Failure,
+			http.StatusNotFound,
+			sqlmock.AnyArg(),
+			"192.0.2.1",
+		).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on"}).AddRow("entry-id", time.Now()))
+
+	req := httptest.NewRequest(http.MethodPost, "/service/my-service", nil)
+	req.RemoteAddr = "192.0.2.1:4567"
+	rec := serve(l, "/service/:name", "service.delete", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, "service my-service not found")
+	}, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestActionDoesNotFailRequests(t *testing.T) {
+	l, mock := setupLog(t)
+
+	mock.ExpectQuery("INSERT INTO vice_audit_log").WillReturnError(sqlmock.ErrCancelled)
+
+	req := httptest.NewRequest(http.MethodPost, "/service/my-service", nil)
+	rec := serve(l, "/service/:name", "service.create", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestNilLogRecordsNothing(t *testing.T) {
+	var l *Log
+
+	req := httptest.NewRequest(http.MethodPost, "/service/my-service", nil)
+	rec := serve(l, "/service/:name", "service.create", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestActor(t *testing.T) {
+	actorFor := func(target, service string) string {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.RemoteAddr = "192.0.2.1:4567"
+		if service != "" {
+			req.Header.Set(ServiceNameHeader, service)
+		}
+		return actor(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	assert.Equal(t, "ipcdev", actorFor("/service/my-service?user=ipcdev", "apps"))
+	assert.Equal(t, "service:apps", actorFor("/service/my-service", "apps"))
+	assert.Equal(t, "unauthenticated:192.0.2.1", actorFor("/service/my-service", ""))
+}
+
+func TestRequestParams(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/analyses/a1/time-limit?user=ipcdev&tag=a&tag=b", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("analysis-id")
+	c.SetParamValues("a1")
+
+	var params map[string]interface{}
+	assert.NoError(t, json.Unmarshal(requestParams(c, nil, false), &params))
+	assert.Equal(t, map[string]interface{}{
+		"analysis-id": "a1",
+		"user":        "ipcdev",
+		"tag":         []interface{}{"a", "b"},
+	}, params)
+}
+
+func TestRequestParamsBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/mappings/defaults/latest", strings.NewReader(`{"name":"il"}`))
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	body, truncated := peekBody(req)
+	assert.False(t, truncated)
+
+	var params map[string]interface{}
+	assert.NoError(t, json.Unmarshal(requestParams(c, body, truncated), &params))
+	assert.Equal(t, map[string]interface{}{"body": map[string]interface{}{"name": "il"}}, params)
+
+	// The handler still gets the whole body.
+	rest, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"il"}`, string(rest))
+}
+
+func TestPeekBodyIsCapped(t *testing.T) {
+	large := strings.Repeat("x", maxBodyBytes+100)
+	req := httptest.NewRequest(http.MethodPost, "/service/my-service", strings.NewReader(large))
+
+	body, truncated := peekBody(req)
+	assert.True(t, truncated)
+	assert.Len(t, body, maxBodyBytes)
+
+	rest, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(rest))
+}
+
+func TestListHandler(t *testing.T) {
+	l, mock := setupLog(t)
+
+	since := time.Unix(1700000000, 0)
+	columns := []string{
+		"id", "actor", "action", "analysis_id", "resource", "params",
+		"outcome", "status", "error", "remote_addr", "created_on",
+	}
+	mock.ExpectQuery(`FROM vice_audit_log WHERE true AND actor = \$1 AND analysis_id = \$2 AND created_on >= \$3 ORDER BY created_on DESC LIMIT \$4`).
+		WithArgs("ipcdev", "a1", since, 10).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(
+			"entry-id", "ipcdev", "analysis.exit", "a1", "", []byte(`{}`),
+			Success, http.StatusOK, "", "192.0.2.1", since,
+		))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit?actor=ipcdev&analysis-id=a1&since=1700000000&limit=10", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	assert.NoError(t, l.ListHandler(c))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var body struct {
+		Entries []Entry `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	if assert.Len(t, body.Entries, 1) {
+		assert.Equal(t, "analysis.exit", body.Entries[0].Action)
+	}
+}
+
+func TestListHandlerRejectsBadTimes(t *testing.T) {
+	l, _ := setupLog(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit?until=yesterday", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	err := l.ListHandler(c)
+	if errResp, ok := err.(common.ErrorResponse); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, http.StatusBadRequest, errResp.StatusCode())
+		assert.Equal(t, common.ErrCodeBadRequest, errResp.ErrorCode)
+	}
+}
@@ -0,0 +1,316 @@
+// Package auth authenticates requests to app-exposer with access tokens issued
+// by a Keycloak realm. Tokens are validated against the signing keys the realm
+// publishes and the user named in the token replaces the user query parameter
+// that the handlers read, so callers can't act on behalf of someone else.
+// Requests from trusted networks may still leave out the token, in which case
+// the user query parameter is trusted as it was before tokens were required.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+var log = common.Log.WithFields(logrus.Fields{"package": "auth"})
+
+var httpClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+	Timeout:   30 * time.Second,
+}
+
+// The keys that the authentication results are stored under in the echo
+// context.
+const (
+	claimsKey  = "auth.claims"
+	trustedKey = "auth.trusted"
+)
+
+// Init contains the settings for creating an *Authenticator.
+type Init struct {
+	KeycloakBaseURL  string
+	KeycloakRealm    string
+	KeycloakClientID string
+
+	// AdminRole is the realm or client role required for the paths under
+	// AdminPrefixes, and for requests that change something under
+	// AdminWritePrefixes.
+	AdminRole          string
+	AdminPrefixes      []string
+	AdminWritePrefixes []string
+
+	// TrustedNetworks are the networks that requests without a token are
+	// accepted from.
+	TrustedNetworks []*net.IPNet
+
+	// KeyRefreshInterval is how often the realm's signing keys are fetched
+	// again. Zero means the keys are only fetched when an unknown key is seen.
+	KeyRefreshInterval time.Duration
+}
+
+// Authenticator validates access tokens.
+type Authenticator struct {
+	Init
+	issuer string
+	keys   *keySet
+}
+
+// New returns a newly created *Authenticator.
+func New(init *Init) *Authenticator {
+	realmURL := fmt.Sprintf("%s/realms/%s", strings.TrimSuffix(init.KeycloakBaseURL, "/"), init.KeycloakRealm)
+	return &Authenticator{
+		Init:   *init,
+		issuer: realmURL,
+		keys:   newKeySet(realmURL+"/protocol/openid-connect/certs", init.KeyRefreshInterval, httpClient),
+	}
+}
+
+// ParseNetworks parses a list of CIDR blocks.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+type roles struct {
+	Roles []string `json:"roles"`
+}
+
+// Claims are the parts of a Keycloak access token that app-exposer uses.
+type Claims struct {
+	jwt.RegisteredClaims
+	AuthorizedParty   string           `json:"azp"`
+	PreferredUsername string           `json:"preferred_username"`
+	RealmAccess       roles            `json:"realm_access"`
+	ResourceAccess    map[string]roles `json:"resource_access"`
+}
+
+// HasRole returns true if the token grants the realm role, or the client role
+// for the client ID.
+func (c *Claims) HasRole(clientID, role string) bool {
+	for _, r := range c.RealmAccess.Roles {
+		if r == role {
+			return true
+		}
+	}
+	for _, r := range c.ResourceAccess[clientID].Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// issuedFor returns true if the token was issued to the client or names it in
+// its audience.
+func (c *Claims) issuedFor(clientID string) bool {
+	if c.AuthorizedParty == clientID {
+		return true
+	}
+	for _, aud := range c.Audience {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate parses the token and checks its signature, issuer and lifetime,
+// and that it was meant for the client ID. Tokens for other clients in the
+// realm aren't accepted.
+func (a *Authenticator) Validate(ctx context.Context, token string) (*Claims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithIssuer(a.issuer),
+		jwt.WithExpirationRequired(),
+	)
+
+	claims := &Claims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		keyID, _ := t.Header["kid"].(string)
+		return a.keys.get(ctx, keyID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.issuedFor(a.KeycloakClientID) {
+		return nil, fmt.Errorf("token wasn't issued for %q", a.KeycloakClientID)
+	}
+
+	if claims.PreferredUsername == "" {
+		return nil, fmt.Errorf("token doesn't name a user")
+	}
+
+	return claims, nil
+}
+
+// Middleware returns echo middleware that requires a valid bearer token on
+// every request that doesn't come from a trusted network. The user named in
+// the token is set as the user query parameter, and requests for the admin
+// paths must have the admin role. Requests naming a different user in the
+// username path or query parameter are rejected.
+func (a *Authenticator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			token := bearerToken(req)
+			if token == "" {
+				if a.isTrusted(req) {
+					c.Set(trustedKey, true)
+					return next(c)
+				}
+				return common.Unauthorized("a bearer token is required")
+			}
+
+			claims, err := a.Validate(req.Context(), token)
+			if err != nil {
+				log.Debugf("rejecting token: %s", err)
+				return common.Unauthorized("invalid bearer token")
+			}
+
+			if a.requiresAdmin(c) && !claims.HasRole(a.KeycloakClientID, a.AdminRole) {
+				return common.Forbidden(fmt.Sprintf("user %s does not have the %s role", claims.PreferredUsername, a.AdminRole))
+			}
+
+			c.Set(claimsKey, claims)
+
+			// c.QueryParam isn't used here since echo caches the query
+			// parameters the first time they're read.
+			q := req.URL.Query()
+			for _, username := range []string{c.Param("username"), q.Get("username")} {
+				if err = CheckUser(c, username); err != nil {
+					return err
+				}
+			}
+
+			q.Set("user", claims.PreferredUsername)
+			req.URL.RawQuery = q.Encode()
+
+			return next(c)
+		}
+	}
+}
+
+// ClaimsFromContext returns the claims of the token that authenticated the
+// request, or nil if the request didn't have one.
+func ClaimsFromContext(c echo.Context) *Claims {
+	claims, _ := c.Get(claimsKey).(*Claims)
+	return claims
+}
+
+// Trusted returns true if the request was let through without a token
+// because it came from a trusted network.
+func Trusted(c echo.Context) bool {
+	trusted, _ := c.Get(trustedKey).(bool)
+	return trusted
+}
+
+// CheckUser returns a 403 error if the request was authenticated with a token
+// for someone other than user. The user suffix is ignored. Requests without a
+// token aren't checked, since the caller is trusted to name the user.
+func CheckUser(c echo.Context, user string) error {
+	claims := ClaimsFromContext(c)
+	if claims == nil || user == "" {
+		return nil
+	}
+	if withoutSuffix(user) != withoutSuffix(claims.PreferredUsername) {
+		return common.Forbidden(fmt.Sprintf("user %s cannot act on behalf of %s", claims.PreferredUsername, user))
+	}
+	return nil
+}
+
+// withoutSuffix strips the domain, if any, from a username.
+func withoutSuffix(user string) string {
+	if idx := strings.Index(user, "@"); idx >= 0 {
+		return user[:idx]
+	}
+	return user
+}
+
+// User returns the user that made the request: the user named in the token if
+// there is one, and otherwise the user query parameter.
+func User(c echo.Context) string {
+	if claims := ClaimsFromContext(c); claims != nil {
+		return claims.PreferredUsername
+	}
+	return c.QueryParam("user")
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get(echo.HeaderAuthorization)
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// isTrusted returns true if the request comes straight from one of the trusted
+// networks. Forwarding headers are ignored since anyone can set them.
+func (a *Authenticator) isTrusted(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range a.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresAdmin returns true if the request needs the admin role. Both the
+// request path and the route are checked so that prefixes match either way.
+func (a *Authenticator) requiresAdmin(c echo.Context) bool {
+	paths := []string{c.Request().URL.Path, c.Path()}
+
+	for _, path := range paths {
+		if hasPrefix(a.AdminPrefixes, path) {
+			return true
+		}
+	}
+
+	if c.Request().Method == http.MethodGet || c.Request().Method == http.MethodHead {
+		return false
+	}
+	for _, path := range paths {
+		if hasPrefix(a.AdminWritePrefixes, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefix returns true if the path is one of the prefixes or is under one.
+func hasPrefix(prefixes []string, path string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
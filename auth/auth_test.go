@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRealm struct {
+	t          *testing.T
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	keyID      string
+	keyFetches int32
+}
+
+func newTestRealm(t *testing.T) *testRealm {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realm := &testRealm{t: t, key: key, keyID: "key-1"}
+	realm.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/realms/test/protocol/openid-connect/certs" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&realm.keyFetches, 1)
+		set := jsonWebKeySet{Keys: []jsonWebKey{{
+			KeyID:   realm.keyID,
+			KeyType: "RSA",
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(realm.key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(realm.key.E)).Bytes()),
+		}}}
+		if err := json.NewEncoder(w).Encode(&set); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(realm.server.Close)
+
+	return realm
+}
+
+func (r *testRealm) issuer() string {
+	return r.server.URL + "/realms/test"
+}
+
+func (r *testRealm) authenticator(init *Init) *Authenticator {
+	init.KeycloakBaseURL = r.server.URL
+	init.KeycloakRealm = "test"
+	init.KeycloakClientID = "app-exposer"
+	init.AdminRole = "vice-admin"
+	init.AdminPrefixes = []string{"/vice/admin"}
+	return New(init)
+}
+
+func (r *testRealm) token(claims *Claims) string {
+	r.t.Helper()
+
+	if claims.Issuer == "" {
+		claims.Issuer = r.issuer()
+	}
+	if claims.AuthorizedParty == "" && claims.Audience == nil {
+		claims.AuthorizedParty = "app-exposer"
+	}
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Minute))
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = r.keyID
+	signed, err := token.SignedString(r.key)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return signed
+}
+
+// serve runs the request through the middleware and returns the response
+// code along with the user the handler saw.
+func serve(a *Authenticator, req *http.Request) (int, string) {
+	var user string
+	e := echo.New()
+	e.HTTPErrorHandler = common.HTTPErrorHandler
+	e.Group("/vice", a.Middleware()).GET("/*", func(c echo.Context) error {
+		user = c.QueryParam("user")
+		return c.NoContent(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code, user
+}
+
+func bearerRequest(path, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	return req
+}
+
+func TestMiddlewareUsesTokenUser(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+
+	token := realm.token(&Claims{PreferredUsername: "ipcdev"})
+	code, user := serve(a, bearerRequest("/vice/listing?user=someone-else", token))
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ipcdev", user)
+}
+
+func TestMiddlewareAcceptsAudience(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+
+	// Tokens issued to another client are accepted if app-exposer is in the
+	// audience.
+	token := realm.token(&Claims{
+		RegisteredClaims:  jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"account", "app-exposer"}},
+		AuthorizedParty:   "de-ui",
+		PreferredUsername: "ipcdev",
+	})
+	code, user := serve(a, bearerRequest("/vice/listing", token))
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ipcdev", user)
+}
+
+func TestMiddlewareRejectsBadTokens(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, &Claims{
+		RegisteredClaims:  jwt.RegisteredClaims{Issuer: realm.issuer(), ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+		AuthorizedParty:   "app-exposer",
+		PreferredUsername: "ipcdev",
+	})
+	forged.Header["kid"] = realm.keyID
+	forgedToken, err := forged.SignedString(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"missing":      "",
+		"garbage":      "not-a-token",
+		"forged":       forgedToken,
+		"expired":      realm.token(&Claims{PreferredUsername: "ipcdev", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}),
+		"wrong issuer": realm.token(&Claims{PreferredUsername: "ipcdev", RegisteredClaims: jwt.RegisteredClaims{Issuer: "https://elsewhere/realms/test"}}),
+		"no user":      realm.token(&Claims{}),
+		"other client": realm.token(&Claims{PreferredUsername: "ipcdev", AuthorizedParty: "other-client"}),
+		"other aud":    realm.token(&Claims{PreferredUsername: "ipcdev", RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"other-client"}}}),
+	}
+
+	for name, token := range tests {
+		code, _ := serve(a, bearerRequest("/vice/listing", token))
+		assert.Equal(t, http.StatusUnauthorized, code, name)
+	}
+}
+
+func TestMiddlewareAdminRole(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+
+	user := realm.token(&Claims{PreferredUsername: "ipcdev"})
+	code, _ := serve(a, bearerRequest("/vice/admin/listing", user))
+	assert.Equal(t, http.StatusForbidden, code)
+
+	realmAdmin := realm.token(&Claims{PreferredUsername: "ipcdev", RealmAccess: roles{Roles: []string{"vice-admin"}}})
+	code, _ = serve(a, bearerRequest("/vice/admin/listing", realmAdmin))
+	assert.Equal(t, http.StatusOK, code)
+
+	clientAdmin := realm.token(&Claims{
+		PreferredUsername: "ipcdev",
+		ResourceAccess:    map[string]roles{"app-exposer": {Roles: []string{"vice-admin"}}},
+	})
+	code, _ = serve(a, bearerRequest("/vice/admin/listing", clientAdmin))
+	assert.Equal(t, http.StatusOK, code)
+
+	otherClientAdmin := realm.token(&Claims{
+		PreferredUsername: "ipcdev",
+		ResourceAccess:    map[string]roles{"other-client": {Roles: []string{"vice-admin"}}},
+	})
+	code, _ = serve(a, bearerRequest("/vice/admin/listing", otherClientAdmin))
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+// serveRoute runs the request through the middleware for a handler
+// registered at the route and returns the response code.
+func serveRoute(a *Authenticator, method, route string, req *http.Request) int {
+	e := echo.New()
+	e.HTTPErrorHandler = common.HTTPErrorHandler
+	e.Add(method, route, func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, a.Middleware())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestMiddlewareAdminWritePrefixes(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+	a.AdminWritePrefixes = []string{"/instantlaunches/mappings/defaults"}
+
+	user := realm.token(&Claims{PreferredUsername: "ipcdev"})
+	admin := realm.token(&Claims{PreferredUsername: "ipcdev", RealmAccess: roles{Roles: []string{"vice-admin"}}})
+	route := "/instantlaunches/mappings/defaults/latest"
+
+	// Anyone can read the defaults, but only admins can change them.
+	code := serveRoute(a, http.MethodGet, route, bearerRequest(route, user))
+	assert.Equal(t, http.StatusOK, code)
+
+	req := bearerRequest(route, user)
+	req.Method = http.MethodPost
+	code = serveRoute(a, http.MethodPost, route, req)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	req = bearerRequest(route, admin)
+	req.Method = http.MethodPost
+	code = serveRoute(a, http.MethodPost, route, req)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMiddlewareRejectsOtherUsernames(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+	token := realm.token(&Claims{PreferredUsername: "ipcdev"})
+	route := "/instantlaunches/mappings/:username"
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/instantlaunches/mappings/ipcdev", http.StatusOK},
+		{"/instantlaunches/mappings/ipcdev@iplantcollaborative.org", http.StatusOK},
+		{"/instantlaunches/mappings/someone-else", http.StatusForbidden},
+		{"/instantlaunches/mappings/ipcdev?username=someone-else", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		code := serveRoute(a, http.MethodGet, route, bearerRequest(tt.path, token))
+		assert.Equal(t, tt.code, code, tt.path)
+	}
+}
+
+func TestMiddlewareTrustedNetworks(t *testing.T) {
+	realm := newTestRealm(t)
+	networks, err := ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := realm.authenticator(&Init{TrustedNetworks: networks})
+
+	req := bearerRequest("/vice/admin/listing?user=ipcdev", "")
+	req.RemoteAddr = "10.1.2.3:5555"
+	code, user := serve(a, req)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ipcdev", user)
+
+	// Forwarding headers don't make a request trusted.
+	req = bearerRequest("/vice/listing?user=ipcdev", "")
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	code, _ = serve(a, req)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestKeysAreCachedAndRefreshedForNewKeyIDs(t *testing.T) {
+	realm := newTestRealm(t)
+	a := realm.authenticator(&Init{})
+	now := time.Now()
+	a.keys.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		code, _ := serve(a, bearerRequest("/vice/listing", realm.token(&Claims{PreferredUsername: "ipcdev"})))
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&realm.keyFetches))
+
+	// Keycloak rotates its key.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm.key = key
+	realm.keyID = "key-2"
+
+	// Unknown key IDs don't cause the keys to be fetched more than once every
+	// minKeyRefresh.
+	code, _ := serve(a, bearerRequest("/vice/listing", realm.token(&Claims{PreferredUsername: "ipcdev"})))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&realm.keyFetches))
+
+	now = now.Add(minKeyRefresh)
+	code, _ = serve(a, bearerRequest("/vice/listing", realm.token(&Claims{PreferredUsername: "ipcdev"})))
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&realm.keyFetches))
+}
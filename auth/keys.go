@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minKeyRefresh limits how often an unrecognized key ID can make the key set
+// get fetched again, so that tokens with made-up key IDs can't be used to
+// flood Keycloak with requests.
+const minKeyRefresh = 10 * time.Second
+
+// jsonWebKey is a single key from a JWKS document. Only RSA signing keys are
+// used.
+type jsonWebKey struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKey returns the RSA public key described by the JWK.
+func (k *jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus for key %s: %w", k.KeyID, err)
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent for key %s: %w", k.KeyID, err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// keySet caches the signing keys published by the Keycloak realm. The keys are
+// fetched again once they're older than the refresh interval, or when a token
+// is signed with a key that hasn't been seen yet, which is what happens after
+// Keycloak rotates its keys. Fetches happen outside of the lock, so a slow
+// Keycloak only holds up the requests that need a key that isn't known yet.
+type keySet struct {
+	url             string
+	refreshInterval time.Duration
+	client          *http.Client
+	now             func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	fetching  *keyFetch
+}
+
+// keyFetch is a fetch of the key set that's underway. done is closed once it
+// has finished, after err is set.
+type keyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newKeySet(url string, refreshInterval time.Duration, client *http.Client) *keySet {
+	return &keySet{
+		url:             url,
+		refreshInterval: refreshInterval,
+		client:          client,
+		now:             time.Now,
+	}
+}
+
+// get returns the public key with the key ID. Known keys are returned right
+// away, even while they're being refreshed.
+func (s *keySet) get(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+
+	age := s.now().Sub(s.fetchedAt)
+	key, ok := s.keys[keyID]
+	if ok && (s.refreshInterval <= 0 || age < s.refreshInterval) {
+		s.mu.Unlock()
+		return key, nil
+	}
+
+	if s.keys != nil && age < minKeyRefresh {
+		s.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %s", keyID)
+	}
+
+	fetch := s.startFetch()
+	s.mu.Unlock()
+
+	// Keep using the keys that are already known while they're refreshed, or
+	// if Keycloak is unavailable.
+	if ok {
+		return key, nil
+	}
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+
+	s.mu.Lock()
+	key, ok = s.keys[keyID]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", keyID)
+	}
+	return key, nil
+}
+
+// startFetch starts fetching the keys in the background unless that's already
+// underway, and returns the fetch. The lock must be held.
+func (s *keySet) startFetch() *keyFetch {
+	if s.fetching != nil {
+		return s.fetching
+	}
+
+	fetch := &keyFetch{done: make(chan struct{})}
+	s.fetching = fetch
+
+	// The fetch isn't tied to any one request, since others may be waiting
+	// for it. The HTTP client's timeout bounds it.
+	go func() {
+		keys, err := s.fetch(context.Background())
+
+		s.mu.Lock()
+		if err != nil {
+			log.Error(err)
+		} else {
+			s.keys = keys
+			s.fetchedAt = s.now()
+		}
+		s.fetching = nil
+		fetch.err = err
+		s.mu.Unlock()
+
+		close(fetch.done)
+	}()
+
+	return fetch
+}
+
+// fetch retrieves the realm's signing keys.
+func (s *keySet) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching signing keys from %s: %w", s.url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing keys from %s: %w", s.url, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching signing keys from %s returned status %d", s.url, resp.StatusCode)
+	}
+
+	var set jsonWebKeySet
+	if err = json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("error parsing signing keys from %s: %w", s.url, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	return keys, nil
+}
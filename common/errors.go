@@ -0,0 +1,179 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// The error codes that may appear in the error_code field of error responses.
+// Clients can rely on these not changing.
+const (
+	ErrCodeBadRequest           = "ERR_BAD_REQUEST"
+	ErrCodeUnauthorized         = "ERR_UNAUTHORIZED"
+	ErrCodeForbidden            = "ERR_FORBIDDEN"
+	ErrCodeNotFound             = "ERR_NOT_FOUND"
+	ErrCodeConflict             = "ERR_CONFLICT"
+	ErrCodeInternal             = "ERR_INTERNAL"
+	ErrCodePermissionNeeded     = "ERR_PERMISSION_NEEDED"
+	ErrCodeLimitReached         = "ERR_LIMIT_REACHED"
+	ErrCodeAppLimitReached      = "ERR_APP_LIMIT_REACHED"
+	ErrCodeNodePoolLimitReached = "ERR_NODE_POOL_LIMIT_REACHED"
+	ErrCodeResourceOverage      = "ERR_RESOURCE_OVERAGE"
+)
+
+// codeStatuses maps each error code to the HTTP status it's returned with
+// when the error doesn't set one itself. Launches that are over a limit are
+// rejected as bad requests.
+var codeStatuses = map[string]int{
+	ErrCodeBadRequest:           http.StatusBadRequest,
+	ErrCodeUnauthorized:         http.StatusUnauthorized,
+	ErrCodeForbidden:            http.StatusForbidden,
+	ErrCodeNotFound:             http.StatusNotFound,
+	ErrCodeConflict:             http.StatusConflict,
+	ErrCodeInternal:             http.StatusInternalServerError,
+	ErrCodePermissionNeeded:     http.StatusBadRequest,
+	ErrCodeLimitReached:         http.StatusBadRequest,
+	ErrCodeAppLimitReached:      http.StatusBadRequest,
+	ErrCodeNodePoolLimitReached: http.StatusBadRequest,
+	ErrCodeResourceOverage:      http.StatusBadRequest,
+}
+
+// codeForStatus returns the general error code for the HTTP status.
+func codeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case status == http.StatusForbidden:
+		return ErrCodeForbidden
+	case status == http.StatusNotFound:
+		return ErrCodeNotFound
+	case status == http.StatusConflict:
+		return ErrCodeConflict
+	case status >= 400 && status < 500:
+		return ErrCodeBadRequest
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// StatusCode returns the HTTP status that the error should be returned with.
+func (e ErrorResponse) StatusCode() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	if status, ok := codeStatuses[e.ErrorCode]; ok {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+// StatusError returns an ErrorResponse with the HTTP status and the general
+// error code for it.
+func StatusError(status int, msg string) ErrorResponse {
+	return ErrorResponse{
+		Message:   msg,
+		ErrorCode: codeForStatus(status),
+		Status:    status,
+	}
+}
+
+// BadRequest returns an ErrorResponse for a request that can't be handled as
+// it was made.
+func BadRequest(msg string) ErrorResponse {
+	return StatusError(http.StatusBadRequest, msg)
+}
+
+// Unauthorized returns an ErrorResponse for a request that isn't
+// authenticated.
+func Unauthorized(msg string) ErrorResponse {
+	return StatusError(http.StatusUnauthorized, msg)
+}
+
+// Forbidden returns an ErrorResponse for a request that the caller isn't
+// allowed to make.
+func Forbidden(msg string) ErrorResponse {
+	return StatusError(http.StatusForbidden, msg)
+}
+
+// NotFound returns an ErrorResponse for a request that refers to something
+// that doesn't exist.
+func NotFound(msg string) ErrorResponse {
+	return StatusError(http.StatusNotFound, msg)
+}
+
+// Conflict returns an ErrorResponse for a request that conflicts with the
+// current state of the thing it refers to.
+func Conflict(msg string) ErrorResponse {
+	return StatusError(http.StatusConflict, msg)
+}
+
+// Internal returns an ErrorResponse for a request that failed for reasons
+// that aren't the caller's fault.
+func Internal(msg string) ErrorResponse {
+	return StatusError(http.StatusInternalServerError, msg)
+}
+
+// NewErrorResponse returns the ErrorResponse that describes the error, but
+// does not send it over the wire. Errors that are already ErrorResponses are
+// returned as is. Missing database rows and missing Kubernetes objects become
+// 404s, Kubernetes conflicts become 409s and Kubernetes validation failures
+// become 400s. Anything else is a 500.
+func NewErrorResponse(err error) ErrorResponse {
+	var resp ErrorResponse
+	if errors.As(err, &resp) {
+		return resp
+	}
+
+	var respPtr *ErrorResponse
+	if errors.As(err, &respPtr) && respPtr != nil {
+		return *respPtr
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		msg, ok := httpErr.Message.(string)
+		if !ok {
+			msg = fmt.Sprint(httpErr.Message)
+		}
+		return StatusError(httpErr.Code, msg)
+	}
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows), k8serrors.IsNotFound(err):
+		return NotFound(err.Error())
+	case k8serrors.IsConflict(err), k8serrors.IsAlreadyExists(err):
+		return Conflict(err.Error())
+	case k8serrors.IsInvalid(err), k8serrors.IsBadRequest(err):
+		return BadRequest(err.Error())
+	default:
+		return Internal(err.Error())
+	}
+}
+
+// HTTPErrorHandler is the echo error handler for the API. Every error is
+// returned as a JSON ErrorResponse with an error code from the catalog above.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	resp := NewErrorResponse(err)
+	status := resp.StatusCode()
+	if status >= http.StatusInternalServerError {
+		Log.Error(err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, resp)
+	}
+	if err != nil {
+		Log.Error(err)
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err      ErrorResponse
+		expected int
+	}{
+		{NotFound("missing"), http.StatusNotFound},
+		{Conflict("exists"), http.StatusConflict},
+		{StatusError(http.StatusServiceUnavailable, "down"), http.StatusServiceUnavailable},
+		{ErrorResponse{ErrorCode: ErrCodePermissionNeeded}, http.StatusBadRequest},
+		{ErrorResponse{ErrorCode: ErrCodeForbidden}, http.StatusForbidden},
+		{ErrorResponse{ErrorCode: ErrCodeForbidden, Status: http.StatusBadRequest}, http.StatusBadRequest},
+		{ErrorResponse{ErrorCode: "ERR_BOGOSITY_OVERLOAD"}, http.StatusBadRequest},
+		{ErrorResponse{}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tt.err.StatusCode(), "%+v", tt.err)
+	}
+}
+
+func TestStatusErrorCodes(t *testing.T) {
+	assert.Equal(t, ErrCodeBadRequest, BadRequest("bad").ErrorCode)
+	assert.Equal(t, ErrCodeUnauthorized, Unauthorized("who").ErrorCode)
+	assert.Equal(t, ErrCodeForbidden, Forbidden("no").ErrorCode)
+	assert.Equal(t, ErrCodeNotFound, NotFound("missing").ErrorCode)
+	assert.Equal(t, ErrCodeConflict, Conflict("exists").ErrorCode)
+	assert.Equal(t, ErrCodeInternal, Internal("oops").ErrorCode)
+	assert.Equal(t, ErrCodeBadRequest, StatusError(http.StatusRequestEntityTooLarge, "big").ErrorCode)
+	assert.Equal(t, ErrCodeInternal, StatusError(http.StatusServiceUnavailable, "down").ErrorCode)
+}
+
+func TestNewErrorResponse(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	limitErr := ErrorResponse{Message: "too many", ErrorCode: ErrCodeLimitReached}
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"error response", limitErr, http.StatusBadRequest, ErrCodeLimitReached},
+		{"error response pointer", &limitErr, http.StatusBadRequest, ErrCodeLimitReached},
+		{"wrapped error response", fmt.Errorf("launch: %w", Forbidden("no")), http.StatusForbidden, ErrCodeForbidden},
+		{"echo error", echo.NewHTTPError(http.StatusUnsupportedMediaType, "nope"), http.StatusUnsupportedMediaType, ErrCodeBadRequest},
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, ErrCodeNotFound},
+		{"wrapped no rows", fmt.Errorf("lookup: %w", sql.ErrNoRows), http.StatusNotFound, ErrCodeNotFound},
+		{"k8s not found", k8serrors.NewNotFound(gr, "a1234"), http.StatusNotFound, ErrCodeNotFound},
+		{"k8s already exists", k8serrors.NewAlreadyExists(gr, "a1234"), http.StatusConflict, ErrCodeConflict},
+		{"k8s conflict", k8serrors.NewConflict(gr, "a1234", fmt.Errorf("changed")), http.StatusConflict, ErrCodeConflict},
+		{"k8s bad request", k8serrors.NewBadRequest("bad"), http.StatusBadRequest, ErrCodeBadRequest},
+		{"other", fmt.Errorf("something bad happened"), http.StatusInternalServerError, ErrCodeInternal},
+	}
+
+	for _, tt := range tests {
+		resp := NewErrorResponse(tt.err)
+		assert.Equal(t, tt.status, resp.StatusCode(), tt.name)
+		assert.Equal(t, tt.code, resp.ErrorCode, tt.name)
+	}
+}
+
+func TestHTTPErrorHandler(t *testing.T) {
+	e := echo.New()
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	HTTPErrorHandler(fmt.Errorf("unable to look up analysis: %w", sql.ErrNoRows), c)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, ErrCodeNotFound, body["error_code"])
+	assert.Equal(t, "unable to look up analysis: sql: no rows in result set", body["message"])
+	assert.NotContains(t, body, "Status")
+
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodHead, "/", nil), rec)
+	HTTPErrorHandler(Conflict("already exists"), c)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+}
@@ -22,6 +22,10 @@ type ErrorResponse struct {
 	Message   string                  `json:"message"`
 	ErrorCode string                  `json:"error_code,omitempty"`
 	Details   *map[string]interface{} `json:"details,omitempty"`
+
+	// Status is the HTTP status to respond with. When it's zero the status
+	// for the error code is used instead.
+	Status int `json:"-"`
 }
 
 // ErrorBytes returns a byte-array representation of an ErrorResponse.
@@ -66,16 +70,3 @@ func DetailedError(writer http.ResponseWriter, cause error, code int) {
 func Error(writer http.ResponseWriter, message string, code int) {
 	DetailedError(writer, ErrorResponse{Message: message}, code)
 }
-
-// NewErrorResponse constructs an ErrorResponse based on the message passed in, but does not send
-// it over the wire. This is to aid in converting to labstack/echo.
-func NewErrorResponse(err error) ErrorResponse {
-	var errorResponse ErrorResponse
-	switch val := err.(type) {
-	case ErrorResponse:
-		errorResponse = val
-	case error:
-		errorResponse = ErrorResponse{Message: val.Error()}
-	}
-	return errorResponse
-}
@@ -53,7 +53,7 @@ func (e *External) CreateServiceHandler(c echo.Context) error {
 
 	service = c.Param("name")
 	if service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service name in the URL")
+		return common.BadRequest("missing service name in the URL")
 	}
 
 	log.Printf("CreateService: creating a service named %s", service)
@@ -64,12 +64,12 @@ func (e *External) CreateServiceHandler(c echo.Context) error {
 	}
 
 	if opts.TargetPort == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "TargetPort was either not set or set to 0")
+		return common.BadRequest("TargetPort was either not set or set to 0")
 	}
 	log.Printf("CreateService: target port for service %s will be %d", service, opts.TargetPort)
 
 	if opts.ListenPort == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "ListenPort was either not set or set to 0")
+		return common.BadRequest("ListenPort was either not set or set to 0")
 	}
 	log.Printf("CreateService: listen port for service %s will be %d", service, opts.ListenPort)
 
@@ -115,7 +115,7 @@ func (e *External) UpdateServiceHandler(c echo.Context) error {
 
 	service = c.Param("name")
 	if service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service name in the URL")
+		return common.BadRequest("missing service name in the URL")
 	}
 
 	log.Printf("UpdateService: updating service %s", service)
@@ -126,12 +126,12 @@ func (e *External) UpdateServiceHandler(c echo.Context) error {
 	}
 
 	if opts.TargetPort == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "TargetPort was either not set or set to 0")
+		return common.BadRequest("TargetPort was either not set or set to 0")
 	}
 	log.Printf("UpdateService: target port for %s should be %d", service, opts.TargetPort)
 
 	if opts.ListenPort == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "ListenPort was either not set or set to 0")
+		return common.BadRequest("ListenPort was either not set or set to 0")
 	}
 	log.Printf("UpdateService: listen port for %s should be %d", service, opts.ListenPort)
 
@@ -174,14 +174,14 @@ func (e *External) GetServiceHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	var service string = c.Param("name")
 	if service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service name in the URL")
+		return common.BadRequest("missing service name in the URL")
 	}
 
 	log.Printf("GetService: getting info for service %s", service)
 
 	svc, err := e.ServiceController.Get(ctx, service)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return common.BadRequest(err.Error())
 	}
 
 	log.Printf("GetService: finished getting info for service %s", service)
@@ -204,7 +204,7 @@ func (e *External) DeleteServiceHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	var service string = c.Param("name")
 	if service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service name in the URL")
+		return common.BadRequest("missing service name in the URL")
 	}
 
 	log.Printf("DeleteService: deleting service %s", service)
@@ -236,7 +236,7 @@ func (e *External) CreateEndpointHandler(c echo.Context) error {
 
 	endpoint = c.Param("name")
 	if endpoint == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing endpoint name in the URL")
+		return common.BadRequest("missing endpoint name in the URL")
 	}
 
 	log.Printf("CreateEndpoint: creating an endpoint named %s", endpoint)
@@ -247,12 +247,12 @@ func (e *External) CreateEndpointHandler(c echo.Context) error {
 	}
 
 	if opts.IP == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "IP field is blank")
+		return common.BadRequest("IP field is blank")
 	}
 	log.Printf("CreateEndpoint: ip for endpoint %s will be %s", endpoint, opts.IP)
 
 	if opts.Port == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Port field is blank")
+		return common.BadRequest("Port field is blank")
 	}
 	log.Printf("CreateEndpoint: port for endpoint %s will be %d", endpoint, opts.Port)
 
@@ -295,7 +295,7 @@ func (e *External) UpdateEndpointHandler(c echo.Context) error {
 	endpoint := c.Param("name")
 
 	if endpoint == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing endpoint name in the URL")
+		return common.BadRequest("missing endpoint name in the URL")
 	}
 
 	log.Printf("UpdateEndpoint: updating endpoint %s", endpoint)
@@ -306,12 +306,12 @@ func (e *External) UpdateEndpointHandler(c echo.Context) error {
 	}
 
 	if opts.IP == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "IP field is blank")
+		return common.BadRequest("IP field is blank")
 	}
 	log.Printf("UpdateEndpoint: ip for endpoint %s should be %s", endpoint, opts.IP)
 
 	if opts.Port == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Port field is blank")
+		return common.BadRequest("Port field is blank")
 	}
 	log.Printf("UpdateEndpoint: port for endpoint %s should be %d", endpoint, opts.Port)
 
@@ -359,7 +359,7 @@ func (e *External) GetEndpointHandler(c echo.Context) error {
 
 	endpoint = c.Param("name")
 	if endpoint == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing endpoint name in the URL")
+		return common.BadRequest("missing endpoint name in the URL")
 	}
 
 	log.Printf("GetEndpoint: getting info on endpoint %s", endpoint)
@@ -388,7 +388,7 @@ func (e *External) GetEndpointHandler(c echo.Context) error {
 func (e *External) DeleteEndpointHandler(c echo.Context) error {
 	var endpoint string = c.Param("name")
 	if endpoint == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing endpoint name in the URL")
+		return common.BadRequest("missing endpoint name in the URL")
 	}
 	ctx := c.Request().Context()
 
@@ -419,7 +419,7 @@ func (e *External) CreateIngressHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	ingress = c.Param("name")
 	if ingress == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing ingress name in the URL")
+		return common.BadRequest("missing ingress name in the URL")
 	}
 
 	log.Printf("CreateIngress: create an ingress named %s", ingress)
@@ -430,12 +430,12 @@ func (e *External) CreateIngressHandler(c echo.Context) error {
 	}
 
 	if opts.Service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service from the ingress JSON")
+		return common.BadRequest("missing service from the ingress JSON")
 	}
 	log.Printf("CreateIngress: service name for ingress %s will be %s", ingress, opts.Service)
 
 	if opts.Port == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Port was either not set or set to 0")
+		return common.BadRequest("Port was either not set or set to 0")
 	}
 	log.Printf("CreateIngress: port for ingress %s will be %d", ingress, opts.Port)
 
@@ -481,7 +481,7 @@ func (e *External) UpdateIngressHandler(c echo.Context) error {
 
 	ingress = c.Param("name")
 	if ingress == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing ingress name in the URL")
+		return common.BadRequest("missing ingress name in the URL")
 	}
 
 	log.Printf("UpdateIngress: updating ingress %s", ingress)
@@ -492,12 +492,12 @@ func (e *External) UpdateIngressHandler(c echo.Context) error {
 	}
 
 	if opts.Service == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing service from the ingress JSON")
+		return common.BadRequest("missing service from the ingress JSON")
 	}
 	log.Printf("UpdateIngress: service for ingress %s should be %s", ingress, opts.Service)
 
 	if opts.Port == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Port was either not set or set to 0")
+		return common.BadRequest("Port was either not set or set to 0")
 	}
 	log.Printf("UpdateIngress: port for ingress %s should be %d", ingress, opts.Port)
 
@@ -543,7 +543,7 @@ func (e *External) GetIngressHandler(c echo.Context) error {
 
 	ingress = c.Param("name")
 	if ingress == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing ingress name in the URL")
+		return common.BadRequest("missing ingress name in the URL")
 	}
 
 	log.Printf("GetIngress: getting ingress %s", ingress)
@@ -573,7 +573,7 @@ func (e *External) DeleteIngressHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	var ingress string = c.Param("name")
 	if ingress == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing ingress name in the URL")
+		return common.BadRequest("missing ingress name in the URL")
 	}
 
 	log.Printf("DeleteIngress: deleting ingress %s", ingress)
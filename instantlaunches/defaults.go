@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 )
 
@@ -41,7 +42,7 @@ func (a *App) LatestDefaultsHandler(c echo.Context) error {
 	defaults, err := a.LatestDefaults(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -54,12 +55,12 @@ func (a *App) UpdateLatestDefaultsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	newdefaults, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 	updated, err := a.UpdateLatestDefaults(ctx, newdefaults)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -79,7 +80,7 @@ func (a *App) AddLatestDefaultsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	addedBy := c.QueryParam("username")
 	if addedBy == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "missing username in query parameters")
+		return common.BadRequest("missing username in query parameters")
 	}
 
 	if !strings.HasSuffix(addedBy, a.UserSuffix) {
@@ -88,7 +89,7 @@ func (a *App) AddLatestDefaultsHandler(c echo.Context) error {
 
 	update, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	newentry, err := a.AddLatestDefaults(ctx, update, addedBy)
@@ -105,13 +106,13 @@ func (a *App) DefaultsByVersionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 
 	m, err := a.DefaultsByVersion(ctx, int(version))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -127,18 +128,18 @@ func (a *App) UpdateDefaultsByVersionHandler(c echo.Context) error {
 	// so we handle the unmarshalling without it here.
 	newvalue, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 
 	updated, err := a.UpdateDefaultsByVersion(ctx, newvalue, int(version))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -153,7 +154,7 @@ func (a *App) DeleteDefaultsByVersionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 	return a.DeleteDefaultsByVersion(ctx, int(version))
 }
@@ -175,7 +176,7 @@ func (a *App) ListDefaultsHandler(c echo.Context) error {
 	m, err := a.ListAllDefaults(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/cyverse-de/app-exposer/audit"
 	"github.com/cyverse-de/app-exposer/permissions"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
@@ -187,6 +188,7 @@ type Init struct {
 	UserSuffix      string
 	MetadataBaseURL string
 	PermissionsURL  string
+	AuditLog        *audit.Log
 }
 
 // New returns a newly created *App.
@@ -204,12 +206,12 @@ func New(db *sqlx.DB, group *echo.Group, init *Init) *App {
 	instance.Group.GET("/quicklaunches/public", instance.ListViablePublicQuickLaunchesHandler)
 	instance.Group.GET("/mappings/defaults", instance.ListDefaultsHandler)
 	instance.Group.GET("/mappings/defaults/latest", instance.LatestDefaultsHandler)
-	instance.Group.PUT("/mappings/defaults/latest", instance.AddLatestDefaultsHandler)
-	instance.Group.POST("/mappings/defaults/latest", instance.UpdateLatestDefaultsHandler)
-	instance.Group.DELETE("/mappings/defaults/latest", instance.DeleteLatestDefaultsHandler)
+	instance.Group.PUT("/mappings/defaults/latest", instance.AddLatestDefaultsHandler, init.AuditLog.Action("instantlaunches.defaults.add"))
+	instance.Group.POST("/mappings/defaults/latest", instance.UpdateLatestDefaultsHandler, init.AuditLog.Action("instantlaunches.defaults.update"))
+	instance.Group.DELETE("/mappings/defaults/latest", instance.DeleteLatestDefaultsHandler, init.AuditLog.Action("instantlaunches.defaults.delete"))
 	instance.Group.GET("/mappings/defaults/:version", instance.DefaultsByVersionHandler)
-	instance.Group.POST("/mappings/defaults/:version", instance.UpdateDefaultsByVersionHandler)
-	instance.Group.DELETE("/mappings/defaults/:version", instance.DeleteDefaultsByVersionHandler)
+	instance.Group.POST("/mappings/defaults/:version", instance.UpdateDefaultsByVersionHandler, init.AuditLog.Action("instantlaunches.defaults.update"))
+	instance.Group.DELETE("/mappings/defaults/:version", instance.DeleteDefaultsByVersionHandler, init.AuditLog.Action("instantlaunches.defaults.delete"))
 	instance.Group.GET("/mappings/:username", instance.AllUserMappingsHandler)
 	instance.Group.GET("/mappings/:username/latest", instance.UserMappingHandler)
 	instance.Group.PUT("/mappings/:username", instance.AddUserMappingHandler)
@@ -19,7 +19,7 @@ var log = common.Log
 
 func handleError(err error, statusCode int) error {
 	log.Error(err)
-	return echo.NewHTTPError(statusCode, err.Error())
+	return common.StatusError(statusCode, err.Error())
 }
 
 // InstantLaunchExists returns true if the id passed in exists in the database
@@ -36,7 +36,7 @@ func (a *App) listAVUs(c echo.Context) ([]byte, *http.Response, error) {
 
 	user := c.QueryParam("user")
 	if user == "" {
-		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "user is missing")
+		return nil, nil, common.BadRequest("user is missing")
 	}
 
 	attr := c.QueryParam("attribute")
@@ -119,7 +119,7 @@ func (a *App) FullListMetadataHandler(c echo.Context) error {
 	fullListing, err := a.ListFullInstantLaunchesByIDs(ctx, targetIDs)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, "no instant launches found")
+			return common.NotFound("no instant launches found")
 		}
 		return err
 	}
@@ -146,12 +146,12 @@ func (a *App) GetMetadataHandler(c echo.Context) error {
 
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+		return common.BadRequest("id is missing")
 	}
 
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user is missing")
+		return common.BadRequest("user is missing")
 	}
 
 	exists, err := a.InstantLaunchExists(ctx, id)
@@ -160,7 +160,7 @@ func (a *App) GetMetadataHandler(c echo.Context) error {
 	}
 
 	if !exists {
-		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("instant launch UUID %s not found", id))
+		return common.NotFound(fmt.Sprintf("instant launch UUID %s not found", id))
 	}
 
 	svc, err := url.Parse(a.MetadataBaseURL)
@@ -204,12 +204,12 @@ func (a *App) AddOrUpdateMetadataHandler(c echo.Context) error {
 
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+		return common.BadRequest("id is missing")
 	}
 
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user is missing")
+		return common.BadRequest("user is missing")
 	}
 
 	exists, err := a.InstantLaunchExists(ctx, id)
@@ -218,7 +218,7 @@ func (a *App) AddOrUpdateMetadataHandler(c echo.Context) error {
 	}
 
 	if !exists {
-		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("instant launch UUID %s not found", id))
+		return common.NotFound(fmt.Sprintf("instant launch UUID %s not found", id))
 	}
 
 	inBody, err := ioutil.ReadAll(c.Request().Body)
@@ -269,12 +269,12 @@ func (a *App) SetAllMetadataHandler(c echo.Context) error {
 
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+		return common.BadRequest("id is missing")
 	}
 
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user is missing")
+		return common.BadRequest("user is missing")
 	}
 
 	exists, err := a.InstantLaunchExists(ctx, id)
@@ -283,7 +283,7 @@ func (a *App) SetAllMetadataHandler(c echo.Context) error {
 	}
 
 	if !exists {
-		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("instant launch UUID %s not found", id))
+		return common.NotFound(fmt.Sprintf("instant launch UUID %s not found", id))
 	}
 
 	inBody, err := ioutil.ReadAll(c.Request().Body)
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/cyverse-de/app-exposer/auth"
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 )
 
@@ -14,11 +16,15 @@ func (a *App) AddInstantLaunchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	il, err := NewInstantLaunchFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	if il.AddedBy == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "username was not set")
+		return common.BadRequest("username was not set")
+	}
+
+	if err = auth.CheckUser(c, il.AddedBy); err != nil {
+		return err
 	}
 
 	if !strings.HasSuffix(il.AddedBy, a.UserSuffix) {
@@ -28,7 +34,7 @@ func (a *App) AddInstantLaunchHandler(c echo.Context) error {
 	newil, err := a.AddInstantLaunch(ctx, il.QuickLaunchID, il.AddedBy)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -42,13 +48,13 @@ func (a *App) GetInstantLaunchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+		return common.BadRequest("id is missing")
 	}
 
 	il, err := a.GetInstantLaunch(ctx, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -63,13 +69,13 @@ func (a *App) FullInstantLaunchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+		return common.BadRequest("id is missing")
 	}
 
 	il, err := a.FullInstantLaunch(ctx, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -82,18 +88,18 @@ func (a *App) UpdateInstantLaunchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusNotFound, "id is missing")
+		return common.NotFound("id is missing")
 	}
 
 	updated, err := NewInstantLaunchFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	newvalue, err := a.UpdateInstantLaunch(ctx, id, updated.QuickLaunchID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -107,7 +113,7 @@ func (a *App) DeleteInstantLaunchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.Param("id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusNotFound, "id is missing")
+		return common.NotFound("id is missing")
 	}
 
 	err := a.DeleteInstantLaunch(ctx, id)
@@ -122,7 +128,7 @@ func (a *App) ListInstantLaunchesHandler(c echo.Context) error {
 	list, err := a.ListInstantLaunches(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -137,7 +143,7 @@ func (a *App) FullListInstantLaunchesHandler(c echo.Context) error {
 	list, err := a.FullListInstantLaunches(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -152,7 +158,7 @@ func (a *App) ListViablePublicQuickLaunchesHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user must be set")
+		return common.BadRequest("user must be set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -162,7 +168,7 @@ func (a *App) ListViablePublicQuickLaunchesHandler(c echo.Context) error {
 	list, err := a.ListViablePublicQuickLaunches(ctx, user)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 )
 
@@ -16,7 +17,7 @@ func (a *App) UserMappingHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -26,7 +27,7 @@ func (a *App) UserMappingHandler(c echo.Context) error {
 	m, err := a.UserMapping(ctx, user)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -39,7 +40,7 @@ func (a *App) UpdateUserMappingHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -48,13 +49,13 @@ func (a *App) UpdateUserMappingHandler(c echo.Context) error {
 
 	newdefaults, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	updated, err := a.UpdateUserMapping(ctx, user, newdefaults)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -68,7 +69,7 @@ func (a *App) DeleteUserMappingHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 	if !strings.HasSuffix(user, a.UserSuffix) {
 		user = fmt.Sprintf("%s%s", user, a.UserSuffix)
@@ -81,7 +82,7 @@ func (a *App) AddUserMappingHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -90,7 +91,7 @@ func (a *App) AddUserMappingHandler(c echo.Context) error {
 
 	newvalue, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	retval, err := a.AddUserMapping(ctx, user, newvalue)
@@ -107,7 +108,7 @@ func (a *App) AllUserMappingsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -117,7 +118,7 @@ func (a *App) AllUserMappingsHandler(c echo.Context) error {
 	m, err := a.AllUserMappings(ctx, user)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -131,7 +132,7 @@ func (a *App) UserMappingsByVersionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -140,13 +141,13 @@ func (a *App) UserMappingsByVersionHandler(c echo.Context) error {
 
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 
 	m, err := a.UserMappingsByVersion(ctx, user, int(version))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -160,7 +161,7 @@ func (a *App) UpdateUserMappingsByVersionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -169,20 +170,20 @@ func (a *App) UpdateUserMappingsByVersionHandler(c echo.Context) error {
 
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 
 	// I'm not sure why, but this stuff seems to break echo's c.Bind() function
 	// so we handle the unmarshalling without it here.
 	update, err := InstantLaunchMappingFromJSON(c.Request().Body)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+		return common.BadRequest("cannot parse JSON")
 	}
 
 	newversion, err := a.UpdateUserMappingsByVersion(ctx, user, int(version), update)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return common.NotFound(err.Error())
 		}
 		return err
 	}
@@ -196,7 +197,7 @@ func (a *App) DeleteUserMappingsByVersionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.Param("username")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+		return common.BadRequest("user was not set")
 	}
 
 	if !strings.HasSuffix(user, a.UserSuffix) {
@@ -205,7 +206,7 @@ func (a *App) DeleteUserMappingsByVersionHandler(c echo.Context) error {
 
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
+		return common.BadRequest("cannot process version")
 	}
 
 	return a.DeleteUserMappingsByVersion(ctx, user, int(version))
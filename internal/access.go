@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+)
+
+// analysisAction is something a user can do to an analysis through the
+// user-facing VICE endpoints. The value reads as the verb in error messages.
+type analysisAction string
+
+const (
+	viewAnalysis    analysisAction = "view"
+	downloadInputs  analysisAction = "download input files for"
+	saveOutputs     analysisAction = "save output files for"
+	cancelTransfers analysisAction = "cancel file transfers for"
+	exitAnalysis    analysisAction = "exit"
+	extendTimeLimit analysisAction = "extend the time limit of"
+)
+
+// actionLevels maps each action to the permission level a user needs on the
+// analysis to perform it. Collaborators who can only read an analysis can
+// watch it, but moving files around takes write access and stopping the
+// analysis or keeping it running longer is reserved for its owners.
+var actionLevels = map[analysisAction]string{
+	viewAnalysis:    permissions.ReadLevel,
+	downloadInputs:  permissions.WriteLevel,
+	saveOutputs:     permissions.WriteLevel,
+	cancelTransfers: permissions.WriteLevel,
+	exitAnalysis:    permissions.OwnLevel,
+	extendTimeLimit: permissions.OwnLevel,
+}
+
+// checkAnalysisAccess returns a 403 error if the user doesn't have the
+// permission level on the analysis that the action requires.
+func (i *Internal) checkAnalysisAccess(ctx context.Context, user, analysisID string, action analysisAction) error {
+	required, ok := actionLevels[action]
+	if !ok {
+		return fmt.Errorf("no permission level is defined for the action %q", action)
+	}
+
+	// Subjects in the permissions service don't include the user suffix.
+	subject := strings.TrimSuffix(user, i.UserSuffix)
+
+	allowed, err := i.permissions.IsAllowedLevel(ctx, subject, analysisID, required)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return common.Forbidden(fmt.Sprintf("user %s cannot %s analysis %s", user, action, analysisID))
+	}
+
+	return nil
+}
+
+// checkExternalIDAccess is like checkAnalysisAccess, but is for the endpoints
+// that identify the analysis by its external ID. The user query parameter is
+// required.
+func (i *Internal) checkExternalIDAccess(c echo.Context, externalID string, action analysisAction) error {
+	ctx := c.Request().Context()
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return common.Forbidden("user is not set")
+	}
+
+	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
+	if err == sql.ErrNoRows {
+		return common.NotFound(fmt.Sprintf("no analysis found for external-id %s", externalID))
+	}
+	if err != nil {
+		return err
+	}
+
+	return i.checkAnalysisAccess(ctx, user, analysisID, action)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// usePermissionsLevel points the Internal at a permissions service that grants
+// the level to every lookup and returns the subjects that were looked up.
+func usePermissionsLevel(t *testing.T, internal *Internal, level string) *[]string {
+	t.Helper()
+
+	var subjects []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects = append(subjects, r.URL.Path)
+		list := &permissions.PermissionList{}
+		if level != "" {
+			list.Permissions = append(list.Permissions, permissions.Permission{Level: level})
+		}
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	internal.permissions = permissions.New(srv.URL, 0)
+	return &subjects
+}
+
+func TestCheckAnalysisAccess(t *testing.T) {
+	tests := []struct {
+		level   string
+		action  analysisAction
+		allowed bool
+	}{
+		{permissions.ReadLevel, viewAnalysis, true},
+		{permissions.ReadLevel, saveOutputs, false},
+		{permissions.WriteLevel, saveOutputs, true},
+		{permissions.WriteLevel, cancelTransfers, true},
+		{permissions.WriteLevel, exitAnalysis, false},
+		{permissions.WriteLevel, extendTimeLimit, false},
+		{permissions.OwnLevel, exitAnalysis, true},
+		{permissions.OwnLevel, extendTimeLimit, true},
+		{"", viewAnalysis, false},
+	}
+
+	for _, tt := range tests {
+		internal, _ := setupInternal(t, nil)
+		usePermissionsLevel(t, internal, tt.level)
+
+		err := internal.checkAnalysisAccess(context.Background(), "test-user", "analysis-id", tt.action)
+		if tt.allowed {
+			assert.NoError(t, err, "%q with %q", tt.action, tt.level)
+			continue
+		}
+		if errResp, ok := err.(common.ErrorResponse); assert.True(t, ok, "%q with %q: %v", tt.action, tt.level, err) {
+			assert.Equal(t, http.StatusForbidden, errResp.StatusCode())
+			assert.Equal(t, common.ErrCodeForbidden, errResp.ErrorCode)
+		}
+	}
+}
+
+func TestCheckAnalysisAccessStripsUserSuffix(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+	subjects := usePermissionsLevel(t, internal, permissions.ReadLevel)
+
+	assert.NoError(t, internal.checkAnalysisAccess(context.Background(), "test-user@example.org", "analysis-id", viewAnalysis))
+	assert.Equal(t, []string{"/permissions/subjects/user/test-user/analysis/analysis-id"}, *subjects)
+}
+
+func TestExitHandlerRequiresOwnership(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive"})
+	internal, mock := setupInternal(t, []runtime.Object{deployment})
+	usePermissionsLevel(t, internal, permissions.WriteLevel)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	mock.ExpectQuery("SELECT j.id").
+		WithArgs("external-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("analysis-id"))
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/external-id/exit?user=collaborator", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("external-id")
+
+	err := internal.ExitHandler(c)
+	if errResp, ok := err.(common.ErrorResponse); assert.True(ok, "%v", err) {
+		assert.Equal(http.StatusForbidden, errResp.StatusCode())
+	}
+	assert.Empty(publisher.published)
+
+	// The analysis is still running.
+	deployments, err := internal.getFilteredDeployments(context.Background(), map[string]string{"external-id": "external-id"})
+	assert.NoError(err)
+	assert.Len(deployments, 1)
+}
+
+func TestExitHandlerRequiresUser(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/external-id/exit", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("external-id")
+
+	err := internal.ExitHandler(c)
+	if errResp, ok := err.(common.ErrorResponse); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, http.StatusForbidden, errResp.StatusCode())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 )
 
@@ -13,7 +14,7 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	externalID := c.QueryParam("external-id")
 	if externalID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "external-id not set")
+		return common.BadRequest("external-id not set")
 	}
 
 	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
@@ -32,7 +33,7 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 	}
 
 	if len(deployments.Items) < 1 {
-		return echo.NewHTTPError(http.StatusNotFound, "no deployments found.")
+		return common.NotFound("no deployments found.")
 	}
 
 	labels := deployments.Items[0].GetLabels()
@@ -69,7 +70,7 @@ func (i *Internal) getExternalIDByAnalysisID(ctx context.Context, analysisID str
 	}
 
 	if len(externalIDs) == 0 {
-		return "", fmt.Errorf("no external-id found for analysis-id %s", analysisID)
+		return "", common.NotFound(fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
 	}
 
 	// For now, just use the first external ID
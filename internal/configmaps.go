@@ -38,13 +38,26 @@ func (i *Internal) excludesConfigMap(ctx context.Context, job *model.Job) (*apiv
 		return nil, err
 	}
 
+	contents := excludesFileContents(job)
+
+	// The manifest is copied into the working directory for the user's
+	// reference, but it doesn't belong with the outputs.
+	if i.UseCSIDriver {
+		contents.WriteString(fmt.Sprintf("%s\n", inputManifestFileName))
+	}
+
+	// The workspace outlives the analysis, so there's no need to upload it.
+	if i.WorkspacesEnabled {
+		contents.WriteString(fmt.Sprintf("%s\n", workspaceDirName))
+	}
+
 	return &apiv1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   excludesConfigMapName(job),
 			Labels: labels,
 		},
 		Data: map[string]string{
-			excludesFileName: excludesFileContents(job).String(),
+			excludesFileName: contents.String(),
 		},
 	}, nil
 }
@@ -105,3 +118,35 @@ func (i *Internal) inputPathListConfigMap(ctx context.Context, job *model.Job) (
 		},
 	}, nil
 }
+
+// inputManifestConfigMapName returns the name of the ConfigMap containing the
+// manifest of where the job's inputs are mounted.
+func inputManifestConfigMapName(job *model.Job) string {
+	return fmt.Sprintf("input-manifest-%s", job.InvocationID)
+}
+
+// inputManifestConfigMap returns the ConfigMap object containing the manifest
+// of where the job's inputs are mounted by the CSI driver. This does NOT call
+// the k8s API to actually create the ConfigMap, just returns the object that
+// can be passed to the API.
+func (i *Internal) inputManifestConfigMap(ctx context.Context, job *model.Job) (*apiv1.ConfigMap, error) {
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	fileContents, err := i.inputManifestContents(job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   inputManifestConfigMapName(job),
+			Labels: labels,
+		},
+		Data: map[string]string{
+			inputManifestFileName: string(fileContents),
+		},
+	}, nil
+}
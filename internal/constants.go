@@ -15,6 +15,11 @@ const (
 	csiDriverOutputVolumeMountPath     = "/output"
 	csiDriverLocalMountPath            = "/data-store"
 
+	// Inputs shared with iRODS tickets are mounted through separate volumes.
+	csiDriverTicketVolumeNamePrefix      = "csi-ticket-volume"
+	csiDriverTicketVolumeClaimNamePrefix = "csi-ticket-volume-claim"
+	csiDriverTicketMountPath             = "/ticket-data"
+
 	// The file transfers volume serves as the working directory when IRODS CSI Driver integration is disabled.
 	fileTransfersVolumeName        = "input-files"
 	fileTransfersContainerName     = "input-files"
@@ -39,6 +44,10 @@ const (
 	inputPathListFileName   = "input-path-list"
 	inputPathListVolumeName = "input-path-list"
 
+	inputManifestMountPath  = "/input-manifest"
+	inputManifestFileName   = "input-manifest.json"
+	inputManifestVolumeName = "input-manifest"
+
 	irodsConfigFilePath = "/etc/porklock/irods-config.properties"
 
 	fileTransfersPortName = "tcp-input"
@@ -67,6 +76,9 @@ const (
 	gpuAffinityOperator = "In"
 	gpuAffinityValue    = "true"
 
+	viceNodePool = "vice"
+	gpuNodePool  = "gpu"
+
 	userSuffix = "@iplantcollaborative.org"
 )
 
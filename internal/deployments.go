@@ -33,6 +33,17 @@ func analysisPorts(step *model.Step) []apiv1.ContainerPort {
 	return ports
 }
 
+// workingDirEmptyDir returns the source for the emptyDir volume used as the
+// working directory of the analysis. Its size is limited to the amount of
+// ephemeral storage requested for the analysis so that a single analysis can't
+// fill up the node's disk.
+func workingDirEmptyDir(job *model.Job) *apiv1.EmptyDirVolumeSource {
+	sizeLimit := storageRequest(job)
+	return &apiv1.EmptyDirVolumeSource{
+		SizeLimit: &sizeLimit,
+	}
+}
+
 // deploymentVolumes returns the Volume objects needed for the VICE analyis
 // Deployment. This does NOT call the k8s API to actually create the Volumes,
 // it returns the objects that can be included in the Deployment object that
@@ -59,7 +70,17 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 			apiv1.Volume{
 				Name: workingDirVolumeName,
 				VolumeSource: apiv1.VolumeSource{
-					EmptyDir: &apiv1.EmptyDirVolumeSource{},
+					EmptyDir: workingDirEmptyDir(job),
+				},
+			},
+			apiv1.Volume{
+				Name: inputManifestVolumeName,
+				VolumeSource: apiv1.VolumeSource{
+					ConfigMap: &apiv1.ConfigMapVolumeSource{
+						LocalObjectReference: apiv1.LocalObjectReference{
+							Name: inputManifestConfigMapName(job),
+						},
+					},
 				},
 			},
 		)
@@ -76,7 +97,7 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 			apiv1.Volume{
 				Name: fileTransfersVolumeName,
 				VolumeSource: apiv1.VolumeSource{
-					EmptyDir: &apiv1.EmptyDirVolumeSource{},
+					EmptyDir: workingDirEmptyDir(job),
 				},
 			},
 			apiv1.Volume{
@@ -103,6 +124,10 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 		},
 	)
 
+	if i.WorkspacesEnabled {
+		output = append(output, workspaceVolume(job))
+	}
+
 	return output
 }
 
@@ -277,7 +302,7 @@ func (i *Internal) inputStagingContainer(job *model.Job) apiv1.Container {
 
 // workingDirPrepContainer returns the init container to be used for preparing the working directory volume
 // for use within the VICE analysis. This init container is only used when iRODS CSI driver integration is
-// enabled.
+// enabled. The storage provider decides what gets linked into the working directory.
 //
 // It may seem odd to use the file transfer image to initialize the working directory when no files are actually
 // being transferred, but it works. We use it for a couple of different reasons. First, we need a Unix shell and
@@ -285,13 +310,14 @@ func (i *Internal) inputStagingContainer(job *model.Job) apiv1.Container {
 func (i *Internal) workingDirPrepContainer(job *model.Job) apiv1.Container {
 
 	// Build the command used to initialize the working directory.
+	commands := append(
+		i.storage.WorkingDirCommands(job),
+		fmt.Sprintf("cp \"%s/%s\" .", inputManifestMountPath, inputManifestFileName),
+	)
 	workingDirInitCommand := []string{
 		"bash",
 		"-c",
-		strings.Join([]string{
-			fmt.Sprintf("ln -s \"%s\" \"data\"", csiDriverLocalMountPath),
-			fmt.Sprintf("ln -s \"%s/home\" .", i.getZoneMountPath()),
-		}, " && "),
+		strings.Join(commands, " && "),
 	}
 
 	// Build the init container spec.
@@ -307,6 +333,11 @@ func (i *Internal) workingDirPrepContainer(job *model.Job) apiv1.Container {
 				MountPath: workingDirInitContainerMountPath,
 				ReadOnly:  false,
 			},
+			{
+				Name:      inputManifestVolumeName,
+				MountPath: inputManifestMountPath,
+				ReadOnly:  true,
+			},
 		},
 		SecurityContext: &apiv1.SecurityContext{
 			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
@@ -361,6 +392,16 @@ func gpuEnabled(job *model.Job) bool {
 	return gpuEnabled
 }
 
+// nodePool returns the name of the pool of nodes that the analysis will be
+// scheduled on. The name is used for the node-pool label and for looking up
+// per-node-pool job limits.
+func nodePool(job *model.Job) string {
+	if len(job.Steps) > 0 && gpuEnabled(job) {
+		return gpuNodePool
+	}
+	return viceNodePool
+}
+
 func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 	analysisEnvironment := []apiv1.EnvVar{}
 	for envKey, envVal := range job.Steps[0].Environment {
@@ -435,6 +476,9 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			ReadOnly:  false,
 		})
 	}
+	if i.WorkspacesEnabled {
+		volumeMounts = append(volumeMounts, workspaceVolumeMount(job))
+	}
 
 	analysisContainer := apiv1.Container{
 		Name: analysisContainerName,
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// The analysis ingress can be set up to ask app-exposer whether each request
+// should be let through, using the nginx auth-request annotations. Browsers
+// prove they're allowed in with a short-lived access token that app-exposer
+// signs after checking the user's permissions on the analysis. The token is
+// handed to the ingress once in a query parameter and then kept in a cookie
+// for the analysis's subdomain. nginx only passes 2xx, 401 and 403 responses
+// from the auth check on, so the cookie is set in a 200 response. Browsers
+// that are turned away are sent to the auth-signin target, which removes any
+// token from the URL before passing them on to the login URL, so rejected
+// tokens don't linger. Tokens are reissued as they get old, which is when the
+// user's permissions are checked again, so losing access to an analysis locks
+// the user out within one token lifetime.
+
+// MinIngressAuthSigningKeyLength is the fewest bytes that the key used to
+// sign access tokens may have. HS256 keys shorter than the hash are weak.
+const MinIngressAuthSigningKeyLength = 32
+
+const (
+	ingressTokenIssuer = "app-exposer"
+
+	// ingressTokenParam is the query parameter that tokens are handed to the
+	// ingress in.
+	ingressTokenParam = "vice-token"
+
+	// ingressTokenCookie is the cookie that the ingress keeps tokens in.
+	ingressTokenCookie = "vice-access-token"
+
+	// signinRedirectParam is the query parameter that nginx passes the URL
+	// the browser asked for in when it sends it to the auth-signin target.
+	signinRedirectParam = "rd"
+
+	// The ingress-nginx annotations that turn on auth-request checks.
+	authURLAnnotation    = "nginx.ingress.kubernetes.io/auth-url"
+	authSigninAnnotation = "nginx.ingress.kubernetes.io/auth-signin"
+
+	// originalURLHeader contains the URL of the request that nginx is
+	// checking.
+	originalURLHeader = "X-Original-URL"
+)
+
+// ingressClaims are the contents of an ingress access token. The subject is
+// the user and the audience is the subdomain of the analysis.
+type ingressClaims struct {
+	jwt.RegisteredClaims
+	AnalysisID string `json:"analysis_id"`
+}
+
+// AccessToken is returned to users who are allowed to access an analysis.
+type AccessToken struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// ingressAuthAnnotations returns the annotations that make the analysis
+// ingress check requests with app-exposer, or nil if that's turned off.
+func (i *Internal) ingressAuthAnnotations() map[string]string {
+	if !i.IngressAuthEnabled {
+		return nil
+	}
+
+	annotations := map[string]string{
+		authURLAnnotation: i.IngressAuthURL,
+	}
+	if i.IngressAuthSigninURL != "" {
+		annotations[authSigninAnnotation] = i.IngressAuthSigninURL
+	}
+	return annotations
+}
+
+// issueIngressToken returns a signed access token that lets the user into the
+// analysis at the subdomain.
+func (i *Internal) issueIngressToken(user, subdomain, analysisID string) (*AccessToken, error) {
+	now := time.Now()
+	expiresAt := now.Add(i.IngressAuthTokenTTL)
+
+	claims := &ingressClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ingressTokenIssuer,
+			Subject:   user,
+			Audience:  jwt.ClaimStrings{subdomain},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		AnalysisID: analysisID,
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(i.IngressAuthSigningKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessToken{Token: token, ExpiresAt: expiresAt.Unix()}, nil
+}
+
+// parseIngressToken checks the token's signature and lifetime and that it was
+// issued for the subdomain.
+func (i *Internal) parseIngressToken(token, subdomain string) (*ingressClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(ingressTokenIssuer),
+		jwt.WithAudience(subdomain),
+		jwt.WithExpirationRequired(),
+	)
+
+	claims := &ingressClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(i.IngressAuthSigningKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// AccessTokenHandler returns a short-lived token that lets the user into the
+// analysis at the subdomain passed in as 'host' from the URL. The user needs
+// read access to the analysis.
+func (i *Internal) AccessTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return common.Forbidden("user is not set")
+	}
+
+	host := c.Param("host")
+	analysisID, err := i.apps.GetAnalysisIDBySubdomain(ctx, host)
+	if err == sql.ErrNoRows {
+		return common.NotFound(fmt.Sprintf("no analysis found for host %s", host))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = i.checkAnalysisAccess(ctx, user, analysisID, viewAnalysis); err != nil {
+		return err
+	}
+
+	token, err := i.issueIngressToken(user, host, analysisID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, token)
+}
+
+// IngressAuthHandler is called by nginx for each request to an analysis
+// ingress. It responds with 200 if the request has a valid access token for
+// the analysis, and sets the token cookie when the token was passed in the
+// query parameter or is due to be reissued.
+func (i *Internal) IngressAuthHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	original, err := url.Parse(c.Request().Header.Get(originalURLHeader))
+	if err != nil || original.Host == "" {
+		return common.BadRequest(fmt.Sprintf("the %s header must be set", originalURLHeader))
+	}
+	subdomain := strings.SplitN(original.Hostname(), ".", 2)[0]
+
+	token := original.Query().Get(ingressTokenParam)
+	fromQuery := token != ""
+	if !fromQuery {
+		if cookie, err := c.Cookie(ingressTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return common.Unauthorized("an access token is required")
+	}
+
+	claims, err := i.parseIngressToken(token, subdomain)
+	if err != nil {
+		log.Debugf("rejecting access token for %s: %s", subdomain, err)
+		return common.Unauthorized("invalid access token")
+	}
+
+	remaining := time.Until(claims.ExpiresAt.Time)
+	if fromQuery || remaining < i.IngressAuthTokenTTL/2 {
+		if err = i.checkAnalysisAccess(ctx, claims.Subject, claims.AnalysisID, viewAnalysis); err != nil {
+			return err
+		}
+
+		fresh, err := i.issueIngressToken(claims.Subject, subdomain, claims.AnalysisID)
+		if err != nil {
+			return err
+		}
+
+		c.SetCookie(&http.Cookie{
+			Name:     ingressTokenCookie,
+			Value:    fresh.Token,
+			Path:     "/",
+			Expires:  time.Unix(fresh.ExpiresAt, 0),
+			HttpOnly: true,
+			Secure:   original.Scheme == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// IngressSigninHandler is the auth-signin target for analysis ingresses, which
+// browsers are sent to when IngressAuthHandler turns them away. The URL they
+// asked for is in the rd query parameter. Any access token is removed from it,
+// since it was rejected, and the browser is redirected to the login URL with
+// the cleaned-up URL in rd. Only URLs for analyses are accepted, so the
+// endpoint can't be used to redirect browsers elsewhere.
+func (i *Internal) IngressSigninHandler(c echo.Context) error {
+	rd, err := url.Parse(c.QueryParam(signinRedirectParam))
+	if err != nil || !i.isAnalysisURL(rd) {
+		return common.BadRequest(fmt.Sprintf("the %s parameter must be the URL of an analysis", signinRedirectParam))
+	}
+
+	if i.IngressAuthLoginURL == "" {
+		return common.Unauthorized("an access token is required")
+	}
+
+	login, err := url.Parse(i.IngressAuthLoginURL)
+	if err != nil {
+		return err
+	}
+	q := login.Query()
+	q.Set(signinRedirectParam, withoutIngressToken(rd))
+	login.RawQuery = q.Encode()
+
+	return c.Redirect(http.StatusFound, login.String())
+}
+
+// isAnalysisURL returns true if the URL is for an analysis subdomain of the
+// frontend base URL.
+func (i *Internal) isAnalysisURL(u *url.URL) bool {
+	frontend, err := url.Parse(i.FrontendBaseURL)
+	if err != nil || frontend.Hostname() == "" {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return strings.HasSuffix(u.Hostname(), "."+frontend.Hostname())
+}
+
+// withoutIngressToken returns the URL with the access token query parameter
+// removed.
+func withoutIngressToken(original *url.URL) string {
+	stripped := *original
+	q := stripped.Query()
+	q.Del(ingressTokenParam)
+	stripped.RawQuery = q.Encode()
+	return stripped.String()
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupIngressAuth(t *testing.T, level string) *Internal {
+	t.Helper()
+
+	internal, _ := setupInternal(t, nil)
+	internal.IngressAuthEnabled = true
+	internal.IngressAuthURL = "http://app-exposer/vice/auth"
+	internal.IngressAuthSigningKey = "test-signing-key-that-is-long-enough"
+	internal.IngressAuthTokenTTL = 10 * time.Minute
+	usePermissionsLevel(t, internal, level)
+	return internal
+}
+
+// ingressAuthRequest calls IngressAuthHandler the way nginx would for a request
+// to the URL, with the token cookie if it's not empty.
+func ingressAuthRequest(internal *Internal, originalURL, cookie string) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest(http.MethodGet, "/vice/auth", nil)
+	req.Header.Set(originalURLHeader, originalURL)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: ingressTokenCookie, Value: cookie})
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	return rec, internal.IngressAuthHandler(c)
+}
+
+func assertHTTPError(t *testing.T, err error, code int) {
+	t.Helper()
+	if errResp, ok := err.(common.ErrorResponse); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, code, errResp.StatusCode())
+	}
+}
+
+func TestIngressTokens(t *testing.T) {
+	internal := setupIngressAuth(t, permissions.ReadLevel)
+
+	token, err := internal.issueIngressToken("ipcdev", "a1234", "analysis-id")
+	assert.NoError(t, err)
+
+	claims, err := internal.parseIngressToken(token.Token, "a1234")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ipcdev", claims.Subject)
+		assert.Equal(t, "analysis-id", claims.AnalysisID)
+	}
+
+	// Tokens only work for the analysis they were issued for.
+	_, err = internal.parseIngressToken(token.Token, "a5678")
+	assert.Error(t, err)
+
+	// Tokens signed with another key are rejected.
+	other := setupIngressAuth(t, permissions.ReadLevel)
+	other.IngressAuthSigningKey = "another-signing-key-that-is-long-enough"
+	_, err = other.parseIngressToken(token.Token, "a1234")
+	assert.Error(t, err)
+
+	// So are expired tokens.
+	internal.IngressAuthTokenTTL = -time.Minute
+	expired, err := internal.issueIngressToken("ipcdev", "a1234", "analysis-id")
+	assert.NoError(t, err)
+	_, err = internal.parseIngressToken(expired.Token, "a1234")
+	assert.Error(t, err)
+}
+
+func TestIngressAuthHandler(t *testing.T) {
+	internal := setupIngressAuth(t, permissions.ReadLevel)
+
+	token, err := internal.issueIngressToken("ipcdev", "a1234", "analysis-id")
+	assert.NoError(t, err)
+
+	// The token is moved from the query parameter into a cookie. nginx only
+	// lets the request through on a 2xx.
+	rec, err := ingressAuthRequest(internal, "https://a1234.cyverse.run/notebook?vice-token="+token.Token+"&page=2", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	cookies := rec.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, ingressTokenCookie, cookies[0].Name)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.True(t, cookies[0].Secure)
+	}
+
+	// A fresh cookie is accepted as is.
+	rec, err = ingressAuthRequest(internal, "https://a1234.cyverse.run/index.html", cookies[0].Value)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Result().Cookies())
+
+	// The cookie doesn't work for other analyses.
+	_, err = ingressAuthRequest(internal, "https://a5678.cyverse.run/", cookies[0].Value)
+	assertHTTPError(t, err, http.StatusUnauthorized)
+
+	_, err = ingressAuthRequest(internal, "https://a1234.cyverse.run/", "")
+	assertHTTPError(t, err, http.StatusUnauthorized)
+}
+
+func TestIngressAuthHandlerRechecksPermissions(t *testing.T) {
+	internal := setupIngressAuth(t, permissions.ReadLevel)
+
+	// The token is old enough to be reissued.
+	internal.IngressAuthTokenTTL = 4 * time.Minute
+	token, err := internal.issueIngressToken("ipcdev", "a1234", "analysis-id")
+	assert.NoError(t, err)
+	internal.IngressAuthTokenTTL = 10 * time.Minute
+
+	rec, err := ingressAuthRequest(internal, "https://a1234.cyverse.run/", token.Token)
+	assert.NoError(t, err)
+	assert.Len(t, rec.Result().Cookies(), 1)
+
+	// Once the analysis is no longer shared with the user they're locked out.
+	usePermissionsLevel(t, internal, "")
+	_, err = ingressAuthRequest(internal, "https://a1234.cyverse.run/", token.Token)
+	assertHTTPError(t, err, http.StatusForbidden)
+}
+
+func TestIngressSigninHandler(t *testing.T) {
+	internal := setupIngressAuth(t, permissions.ReadLevel)
+	internal.FrontendBaseURL = "https://cyverse.run"
+
+	signin := func(rd string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/vice/auth/signin?rd="+url.QueryEscape(rd), nil)
+		rec := httptest.NewRecorder()
+		return rec, internal.IngressSigninHandler(echo.New().NewContext(req, rec))
+	}
+
+	// Without a login URL there's nowhere to send the browser.
+	_, err := signin("https://a1234.cyverse.run/notebook?vice-token=expired&page=2")
+	assertHTTPError(t, err, http.StatusUnauthorized)
+
+	// The rejected token is removed before the browser is sent on.
+	internal.IngressAuthLoginURL = "https://de.cyverse.org/login"
+	rec, err := signin("https://a1234.cyverse.run/notebook?vice-token=expired&page=2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+		location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "de.cyverse.org", location.Host)
+			assert.Equal(t, "https://a1234.cyverse.run/notebook?page=2", location.Query().Get("rd"))
+		}
+	}
+
+	// Only analysis URLs are accepted.
+	for _, rd := range []string{"", "https://evil.example.org/", "https://cyverse.run.example.org/", "javascript:alert(1)"} {
+		_, err = signin(rd)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	}
+}
+
+func TestAccessTokenHandler(t *testing.T) {
+	internal, mock := setupInternal(t, nil)
+	internal.IngressAuthSigningKey = "test-signing-key-that-is-long-enough"
+	internal.IngressAuthTokenTTL = 10 * time.Minute
+	usePermissionsLevel(t, internal, permissions.ReadLevel)
+
+	mock.ExpectQuery("SELECT j.id").
+		WithArgs("a1234").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("analysis-id"))
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/a1234/access-token?user=ipcdev", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("host")
+	c.SetParamValues("a1234")
+
+	assert.NoError(t, internal.AccessTokenHandler(c))
+
+	var token AccessToken
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &token))
+	claims, err := internal.parseIngressToken(token.Token, "a1234")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ipcdev", claims.Subject)
+		assert.Equal(t, "analysis-id", claims.AnalysisID)
+	}
+}
+
+func TestIngressAuthAnnotations(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+	assert.Nil(t, internal.ingressAuthAnnotations())
+
+	internal.IngressAuthEnabled = true
+	internal.IngressAuthURL = "http://app-exposer/vice/auth"
+	assert.Equal(t, map[string]string{authURLAnnotation: "http://app-exposer/vice/auth"}, internal.ingressAuthAnnotations())
+
+	internal.IngressAuthSigninURL = "https://de.cyverse.org/vice-signin"
+	assert.Equal(t, "https://de.cyverse.org/vice-signin", internal.ingressAuthAnnotations()[authSigninAnnotation])
+}
@@ -80,13 +80,18 @@ func (i *Internal) getIngress(ctx context.Context, job *model.Job, svc *apiv1.Se
 		},
 	})
 
+	annotations := map[string]string{
+		"kubernetes.io/ingress.class": "nginx",
+	}
+	for k, v := range i.ingressAuthAnnotations() {
+		annotations[k] = v
+	}
+
 	return &netv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: job.InvocationID,
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class": "nginx",
-			},
-			Labels: labels,
+			Name:        job.InvocationID,
+			Annotations: annotations,
+			Labels:      labels,
 		},
 		Spec: netv1.IngressSpec{
 			DefaultBackend: defaultBackend, // default backend, not the service backend
@@ -19,12 +19,12 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/trace"
 
 	"github.com/cyverse-de/model/v6"
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
@@ -75,7 +75,31 @@ func labelValueString(str string) string {
 type Init struct {
 	PorklockImage                 string
 	PorklockTag                   string
+	TransferTimeout               time.Duration
+	TransferStatusTimeouts        map[string]time.Duration
+	TransferPollInterval          time.Duration
+	TransferMaxBackoff            time.Duration
+	TransferMaxPollErrors         int
+	TransferHistoryRetention      time.Duration
 	UseCSIDriver                  bool
+	MountSharedCollection         bool
+	CSIVolumeMinCapacity          *resourcev1.Quantity
+	CSIVolumeMaxCapacity          *resourcev1.Quantity
+	StorageProviderName           string
+	NFSServer                     string
+	NFSPath                       string
+	NFSReadOnly                   bool
+	S3Driver                      string
+	S3Bucket                      string
+	S3StorageClass                string
+	S3SecretName                  string
+	S3SecretNamespace             string
+	S3ReadOnly                    bool
+	S3VolumeAttributes            map[string]string
+	StorageClaimName              string
+	StorageClaimReadOnly          bool
+	DataMappings                  []DataMapping
+	InputCollisionStrategy        string
 	InputPathListIdentifier       string
 	TicketInputPathListIdentifier string
 	ImagePullSecretName           string
@@ -89,13 +113,42 @@ type Init struct {
 	AppsServiceBaseURL            string
 	ViceNamespace                 string
 	JobStatusURL                  string
+	StatusOutboxEnabled           bool
+	StatusOutboxBaseBackoff       time.Duration
+	StatusOutboxMaxBackoff        time.Duration
+	StatusOutboxMaxAttempts       int
 	UserSuffix                    string
 	PermissionsURL                string
+	PermissionsCacheTTL           time.Duration
 	KeycloakBaseURL               string
 	KeycloakRealm                 string
 	KeycloakClientID              string
 	KeycloakClientSecret          string
 	IRODSZone                     string
+	QueueLaunches                 bool
+	ExtendedJobLimits             bool
+	OverageCacheTTL               time.Duration
+	OverageRequestTimeout         time.Duration
+	OverageFailureThreshold       int
+	OverageBreakerResetTimeout    time.Duration
+	OverageFailOpen               bool
+	ReportUsage                   bool
+	UsageSubject                  string
+	WorkspacesEnabled             bool
+	WorkspaceStorageClass         string
+	WorkspaceSize                 string
+	WorkspaceMaxSize              string
+	WorkspaceAccessMode           string
+	WorkspaceInactivityLimit      time.Duration
+	OperationsEnabled             bool
+	OperationStaleAfter           time.Duration
+	PodMaxRestarts                int
+	IngressAuthEnabled            bool
+	IngressAuthURL                string
+	IngressAuthSigninURL          string
+	IngressAuthLoginURL           string
+	IngressAuthSigningKey         string
+	IngressAuthTokenTTL           time.Duration
 	NATSEncodedConn               *nats.EncodedConn
 }
 
@@ -107,19 +160,56 @@ type Internal struct {
 	db              *sqlx.DB
 	statusPublisher AnalysisStatusPublisher
 	apps            *apps.Apps
+	overages        *overageChecker
+	permissions     *permissions.Permissions
+	storage         StorageProvider
+	transfers       *activeTransfers
 }
 
 // New creates a new *Internal.
 func New(init *Init, db *sqlx.DB, clientset kubernetes.Interface, apps *apps.Apps) *Internal {
-	return &Internal{
-		Init:      *init,
-		db:        db,
-		clientset: clientset,
-		statusPublisher: &JSLPublisher{
-			statusURL: init.JobStatusURL,
-		},
-		apps: apps,
+	jsl := &JSLPublisher{
+		statusURL: init.JobStatusURL,
 	}
+
+	i := &Internal{
+		Init:            *init,
+		db:              db,
+		clientset:       clientset,
+		statusPublisher: jsl,
+		apps:            apps,
+	}
+
+	// With the outbox, updates survive job-status-listener outages.
+	if init.StatusOutboxEnabled {
+		i.statusPublisher = newOutboxPublisher(init, db, jsl.sendStatus)
+	}
+
+	i.overages = newOverageChecker(init, i.requestResourceOverages)
+	i.permissions = permissions.New(init.PermissionsURL, init.PermissionsCacheTTL)
+	i.storage = newStorageProvider(i)
+	i.transfers = newActiveTransfers()
+	return i
+}
+
+// userIDFromRequest returns the ID of the user named in the user query
+// parameter of the request.
+func (i *Internal) userIDFromRequest(c echo.Context) (string, error) {
+	user := c.QueryParam("user")
+	if user == "" {
+		return "", common.BadRequest("user query parameter must be set")
+	}
+
+	fixedUser := i.fixUsername(user)
+	userID, err := i.apps.GetUserID(c.Request().Context(), fixedUser)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", common.NotFound(fmt.Sprintf("user %s not found", fixedUser))
+		}
+		return "", err
+	}
+
+	return userID, nil
 }
 
 // labelsFromJob returns a map[string]string that can be used as labels for K8s resources.
@@ -148,6 +238,7 @@ func (i *Internal) labelsFromJob(ctx context.Context, job *model.Job) (map[strin
 		"app-type":      "interactive",
 		"subdomain":     IngressName(job.UserID, job.InvocationID),
 		"login-ip":      ipAddr,
+		"node-pool":     nodePool(job),
 	}, nil
 }
 
@@ -207,6 +298,34 @@ func (i *Internal) UpsertInputPathListConfigMap(ctx context.Context, job *model.
 	return nil
 }
 
+// UpsertInputManifestConfigMap uses the Job passed in to assemble the ConfigMap
+// containing the manifest of where the inputs are mounted by the CSI driver. It
+// then uses the k8s API to create the ConfigMap if it does not already exist or
+// to update it if it does.
+func (i *Internal) UpsertInputManifestConfigMap(ctx context.Context, job *model.Job) error {
+	manifestCM, err := i.inputManifestConfigMap(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	_, err = cmclient.Get(ctx, inputManifestConfigMapName(job), metav1.GetOptions{})
+	if err != nil {
+		_, err = cmclient.Create(ctx, manifestCM, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = cmclient.Update(ctx, manifestCM, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // UpsertDeployment uses the Job passed in to assemble a Deployment for the
 // VICE analysis. If then uses the k8s API to create the Deployment if it does
 // not already exist or to update it if it does.
@@ -369,11 +488,41 @@ func (i *Internal) LaunchAppHandler(c echo.Context) error {
 
 	if status, err := i.validateJob(ctx, job); err != nil {
 		if validationErr, ok := err.(common.ErrorResponse); ok {
+			// Users at their concurrent job limit get their launch queued instead
+			// of rejected when queueing is enabled.
+			if i.QueueLaunches && isLimitReached(validationErr) {
+				queued, err := i.enqueueLaunch(ctx, job)
+				if err != nil {
+					return err
+				}
+				return c.JSON(http.StatusAccepted, queued)
+			}
 			return validationErr
 		}
-		return echo.NewHTTPError(status, err.Error())
+		return common.StatusError(status, err.Error())
 	}
 
+	return i.launch(ctx, job)
+}
+
+// launch creates the k8s resources for a VICE analysis. The job must have
+// already been validated. The analysis is marked as failed if any of the
+// resources can't be created.
+func (i *Internal) launch(ctx context.Context, job *model.Job) error {
+	err := i.createAnalysisResources(ctx, job)
+	if err != nil {
+		msg := fmt.Sprintf("unable to launch analysis %s: %s", job.InvocationID, err)
+		if failErr := i.statusPublisher.Fail(ctx, job.InvocationID, msg); failErr != nil {
+			log.Error(failErr)
+		}
+	}
+	return err
+}
+
+// createAnalysisResources creates the k8s resources for a VICE analysis.
+func (i *Internal) createAnalysisResources(ctx context.Context, job *model.Job) error {
+	var err error
+
 	// Create the excludes file ConfigMap for the job.
 	if err = i.UpsertExcludesConfigMap(ctx, job); err != nil {
 		return err
@@ -384,6 +533,19 @@ func (i *Internal) LaunchAppHandler(c echo.Context) error {
 		return err
 	}
 
+	// Create the input manifest config map
+	if i.UseCSIDriver {
+		if err = i.UpsertInputManifestConfigMap(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	if i.WorkspacesEnabled {
+		if err = i.UpsertWorkspace(ctx, job); err != nil {
+			return err
+		}
+	}
+
 	deployment, err := i.getDeployment(ctx, job)
 	if err != nil {
 		return err
@@ -398,17 +560,28 @@ func (i *Internal) LaunchAppHandler(c echo.Context) error {
 		return err
 	}
 
+	if i.ReportUsage {
+		setUsageReportedAt(deployment, time.Now())
+	}
+
 	// Create the deployment for the job.
 	if err = i.UpsertDeployment(ctx, deployment, job); err != nil {
 		return err
 	}
 
+	i.reportUsageStarted(ctx, job.Submitter, deployment)
+
 	return nil
 }
 
-// TriggerDownloadsHandler handles requests to trigger file downloads.
+// TriggerDownloadsHandler handles requests to trigger file downloads. The user
+// query parameter is required and the user needs write access to the analysis.
 func (i *Internal) TriggerDownloadsHandler(c echo.Context) error {
-	return i.doFileTransfer(c.Request().Context(), c.Param("id"), downloadBasePath, downloadKind, true)
+	externalID := c.Param("id")
+	if err := i.checkExternalIDAccess(c, externalID, downloadInputs); err != nil {
+		return err
+	}
+	return i.doFileTransfer(c.Request().Context(), externalID, downloadBasePath, downloadKind, nil, true)
 }
 
 // AdminTriggerDownloadsHandler handles requests to trigger file downloads
@@ -423,15 +596,21 @@ func (i *Internal) AdminTriggerDownloadsHandler(c echo.Context) error {
 
 	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return common.BadRequest(err.Error())
 	}
 
-	return i.doFileTransfer(ctx, externalID, downloadBasePath, downloadKind, true)
+	return i.doFileTransfer(ctx, externalID, downloadBasePath, downloadKind, nil, true)
 }
 
-// TriggerUploadsHandler handles requests to trigger file uploads.
+// TriggerUploadsHandler handles requests to trigger file uploads. The optional
+// request body limits which files are uploaded; see UploadRequest. The user
+// query parameter is required and the user needs write access to the analysis.
 func (i *Internal) TriggerUploadsHandler(c echo.Context) error {
-	return i.doFileTransfer(c.Request().Context(), c.Param("id"), uploadBasePath, uploadKind, true)
+	externalID := c.Param("id")
+	if err := i.checkExternalIDAccess(c, externalID, saveOutputs); err != nil {
+		return err
+	}
+	return i.triggerUploads(c, externalID)
 }
 
 // AdminTriggerUploadsHandler handles requests to trigger file uploads without
@@ -446,10 +625,10 @@ func (i *Internal) AdminTriggerUploadsHandler(c echo.Context) error {
 
 	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return common.BadRequest(err.Error())
 	}
 
-	return i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, true)
+	return i.triggerUploads(c, externalID)
 }
 
 func (i *Internal) doExit(ctx context.Context, externalID string) error {
@@ -494,7 +673,14 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 		return err
 	}
 
+	// Remember who owned the analysis so that their queued launches can be
+	// started once everything is cleaned up.
+	var userID string
 	for _, dep := range deplist.Items {
+		if userID == "" {
+			userID = dep.Labels["user-id"]
+		}
+		i.reportUsageStopped(ctx, &dep)
 		if err = depclient.Delete(ctx, dep.Name, metav1.DeleteOptions{}); err != nil {
 			log.Error(err)
 		}
@@ -545,6 +731,17 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 		}
 	}
 
+	// The workspace isn't deleted, but its inactivity period starts now.
+	if i.WorkspacesEnabled && userID != "" {
+		if err = i.touchWorkspace(ctx, userID); err != nil && !k8serrors.IsNotFound(err) {
+			log.Error(err)
+		}
+	}
+
+	if i.QueueLaunches && userID != "" {
+		go i.drainLaunchQueue(ctx, userID)
+	}
+
 	return nil
 }
 
@@ -552,9 +749,14 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 // resources asscociated with it. Does not save outputs first. Uses
 // the external-id label to find all of the objects in the configured
 // namespace associated with the job. Deletes the following objects:
-// ingresses, services, deployments, and configmaps.
+// ingresses, services, deployments, and configmaps. The user query parameter
+// is required and only users who own the analysis may exit it.
 func (i *Internal) ExitHandler(c echo.Context) error {
-	return i.doExit(c.Request().Context(), c.Param("id"))
+	externalID := c.Param("id")
+	if err := i.checkExternalIDAccess(c, externalID, exitAnalysis); err != nil {
+		return err
+	}
+	return i.exitWithoutSaving(c.Request().Context(), externalID)
 }
 
 // AdminExitHandler terminates the VICE analysis based on the analysisID and
@@ -568,10 +770,26 @@ func (i *Internal) AdminExitHandler(c echo.Context) error {
 
 	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return common.BadRequest(err.Error())
 	}
 
-	return i.doExit(ctx, externalID)
+	return i.exitWithoutSaving(ctx, externalID)
+}
+
+// exitWithoutSaving removes the analysis's resources and marks it as
+// completed. Stopping an analysis without saving is the user's choice, so it
+// isn't treated as a failure.
+func (i *Internal) exitWithoutSaving(ctx context.Context, externalID string) error {
+	if err := i.doExit(ctx, externalID); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("analysis %s exited without saving its outputs", externalID)
+	if err := i.statusPublisher.Success(ctx, externalID, msg); err != nil {
+		log.Error(err)
+	}
+
+	return nil
 }
 
 // getIDFromHost returns the external ID for the running VICE app, which
@@ -591,7 +809,7 @@ func (i *Internal) getIDFromHost(ctx context.Context, host string) (string, erro
 		}
 	}
 
-	return "", fmt.Errorf("no ingress found for host %s", host)
+	return "", common.NotFound(fmt.Sprintf("no ingress found for host %s", host))
 }
 
 // URLReadyHandler returns whether or not a VICE app is ready
@@ -608,7 +826,7 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+		return common.BadRequest("user query parameter must be set")
 	}
 
 	// Since some usernames don't come through the labelling process unscathed, we have to use
@@ -617,7 +835,7 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 	_, err := i.apps.GetUserID(ctx, fixedUser)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", fixedUser))
+			return common.NotFound(fmt.Sprintf("user %s not found", fixedUser))
 		}
 		return err
 	}
@@ -674,19 +892,10 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 	}
 
 	// Make sure the user has permissions to look up info about this analysis.
-	p := &permissions.Permissions{
-		BaseURL: i.PermissionsURL,
-	}
-
-	allowed, err := p.IsAllowed(ctx, user, analysisID)
-	if err != nil {
+	if err = i.checkAnalysisAccess(ctx, user, analysisID, viewAnalysis); err != nil {
 		return err
 	}
 
-	if !allowed {
-		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
-	}
-
 	return c.JSON(http.StatusOK, data)
 }
 
@@ -707,7 +916,7 @@ func (i *Internal) AdminURLReadyHandler(c echo.Context) error {
 	// Use the name of the ingress to retrieve the externalID
 	id, err := i.getIDFromHost(ctx, host)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		return common.NotFound(err.Error())
 	}
 
 	// If getIDFromHost returns without an error, then the ingress exists
@@ -751,42 +960,35 @@ func (i *Internal) AdminURLReadyHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, data)
 }
 
+// saveOutputsBeforeExit uploads the output files for an analysis that's about
+// to exit. Errors are logged as well as returned, since the analysis exits
+// either way. An analysis without a reachable file transfer sidecar, such as
+// one whose pod never started, has nothing to upload, so that isn't an error.
+func (i *Internal) saveOutputsBeforeExit(ctx context.Context, externalID string) error {
+	err := i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, nil, false)
+	if isSidecarUnreachable(err) {
+		log.Warnf("not saving the outputs of %s: %s", externalID, err)
+		return nil
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "error doing file transfer"))
+	}
+	return err
+}
+
 // SaveAndExitHandler handles requests to save the output files in iRODS and then exit.
-// The exit portion will only occur if the save operation succeeds. The operation is
-// performed inside of a goroutine so that the caller isn't waiting for hours/days for
-// output file transfers to complete.
+// The analysis exits even if the upload fails or times out. The work is recorded as
+// an operation and performed in the background so that the caller isn't waiting for
+// hours/days for output file transfers to complete. The response contains the
+// operation, which can be looked up to see how far along it is. The user query
+// parameter is required and only users who own the analysis may exit it.
 func (i *Internal) SaveAndExitHandler(c echo.Context) error {
 	log.Info("save and exit called")
-
-	// Since file transfers can take a while, we should do this asynchronously by default.
-	go func(ctx context.Context, c echo.Context) {
-		var err error
-		separatedSpanContext := trace.SpanContextFromContext(ctx)
-		outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
-		ctx, span := otel.Tracer(otelName).Start(outerCtx, "SaveAndExitHandler goroutine")
-		defer span.End()
-
-		externalID := c.Param("id")
-
-		log.Infof("calling doFileTransfer for %s", externalID)
-
-		// Trigger a blocking output file transfer request.
-		if err = i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, false); err != nil {
-			log.Error(errors.Wrap(err, "error doing file transfer")) // Log but don't exit. Possible to cancel a job that hasn't started yet
-		}
-
-		log.Infof("calling VICEExit for %s", externalID)
-
-		if err = i.doExit(ctx, externalID); err != nil {
-			log.Error(errors.Wrapf(err, "error triggering analysis exit for %s", externalID))
-		}
-
-		log.Infof("after VICEExit for %s", externalID)
-	}(c.Request().Context(), c)
-
-	log.Info("leaving save and exit")
-
-	return nil
+	externalID := c.Param("id")
+	if err := i.checkExternalIDAccess(c, externalID, exitAnalysis); err != nil {
+		return err
+	}
+	return i.startSaveAndExit(c, externalID)
 }
 
 // AdminSaveAndExitHandler handles requests to save the output files in iRODS and
@@ -796,43 +998,12 @@ func (i *Internal) SaveAndExitHandler(c echo.Context) error {
 func (i *Internal) AdminSaveAndExitHandler(c echo.Context) error {
 	log.Info("admin save and exit called")
 
-	// Since file transfers can take a while, we should do this asynchronously by default.
-	go func(ctx context.Context, c echo.Context) {
-		var (
-			err        error
-			externalID string
-		)
-
-		separatedSpanContext := trace.SpanContextFromContext(ctx)
-		outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
-		ctx, span := otel.Tracer(otelName).Start(outerCtx, "AdminSaveAndExitHandler goroutine")
-		defer span.End()
-
-		log.Debug("calling doFileTransfer")
-
-		analysisID := c.Param("analysis-id")
-
-		if externalID, err = i.getExternalIDByAnalysisID(ctx, analysisID); err != nil {
-			log.Error(err)
-			return
-		}
-
-		// Trigger a blocking output file transfer request.
-		if err = i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, false); err != nil {
-			log.Error(errors.Wrap(err, "error doing file transfer")) // Log but don't exit. Possible to cancel a job that hasn't started yet
-		}
-
-		log.Debug("calling VICEExit")
-
-		if err = i.doExit(ctx, externalID); err != nil {
-			log.Error(err)
-		}
-
-		log.Debug("after VICEExit")
-	}(c.Request().Context(), c)
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), c.Param("analysis-id"))
+	if err != nil {
+		return common.BadRequest(err.Error())
+	}
 
-	log.Info("admin leaving save and exit")
-	return nil
+	return i.startSaveAndExit(c, externalID)
 }
 
 const updateTimeLimitSQL = `
@@ -858,6 +1029,8 @@ const getUserIDSQL = `
 `
 
 // TimeLimitUpdateHandler handles requests to update the time limit on an already running VICE app.
+// Only users who own the analysis may extend it. The time limit is updated on behalf of the user
+// who launched the analysis, so shared owners can extend it too.
 func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	log.Info("update time limit called")
@@ -871,18 +1044,27 @@ func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 	// user is required
 	user = c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+		return common.Forbidden("user is not set")
 	}
 
 	// id is required
 	id = c.Param("analysis-id")
 	if id == "" {
-		idErr := echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		idErr := common.BadRequest("id parameter is empty")
 		log.Error(idErr)
 		return idErr
 	}
 
-	outputMap, err := i.updateTimeLimit(ctx, user, id)
+	if err = i.checkAnalysisAccess(ctx, user, id, extendTimeLimit); err != nil {
+		return err
+	}
+
+	owner, _, err := i.apps.GetUserByAnalysisID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	outputMap, err := i.updateTimeLimit(ctx, owner, id)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -904,7 +1086,7 @@ func (i *Internal) AdminTimeLimitUpdateHandler(c echo.Context) error {
 	// id is required
 	id = c.Param("analysis-id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		return common.BadRequest("id parameter is empty")
 	}
 
 	user, _, err = i.apps.GetUserByAnalysisID(ctx, id)
@@ -935,13 +1117,17 @@ func (i *Internal) GetTimeLimitHandler(c echo.Context) error {
 	// user is required
 	user = c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+		return common.Forbidden("user is not set")
 	}
 
 	// analysisID is required
 	analysisID = c.Param("analysis-id")
 	if analysisID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		return common.BadRequest("id parameter is empty")
+	}
+
+	if err = i.checkAnalysisAccess(ctx, user, analysisID, viewAnalysis); err != nil {
+		return err
 	}
 
 	// Could use this to get the username, but we need to not break other services.
@@ -973,7 +1159,7 @@ func (i *Internal) AdminGetTimeLimitHandler(c echo.Context) error {
 	// analysisID is required
 	analysisID = c.Param("analysis-id")
 	if analysisID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		return common.BadRequest("id parameter is empty")
 	}
 
 	// Could use this to get the username, but we need to not break other services.
@@ -1059,7 +1245,7 @@ func (i *Internal) AdminGetExternalIDHandler(c echo.Context) error {
 	// analysisID is required
 	analysisID = c.Param("analysis-id")
 	if analysisID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		return common.BadRequest("id parameter is empty")
 	}
 
 	externalID, err = i.getExternalIDByAnalysisID(ctx, analysisID)
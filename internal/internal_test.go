@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestExitWithoutSaving(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive"})
+	internal, _ := setupInternal(t, []runtime.Object{deployment})
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	assert.NoError(internal.exitWithoutSaving(context.Background(), "external-id"))
+	if assert.Len(publisher.published, 1) {
+		assert.Equal("Completed", publisher.published[0].state)
+		assert.Equal("external-id", publisher.published[0].jobID)
+	}
+}
+
+func TestLaunchFailurePublishesStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// The resources can't be labeled without the user's IP address.
+	mock.ExpectQuery("SELECT l.ip_address").
+		WithArgs("user-id").
+		WillReturnError(errors.New("the database is unavailable"))
+
+	job := &model.Job{InvocationID: "external-id", Name: "analysis", UserID: "user-id"}
+	assert.Error(internal.launch(context.Background(), job))
+	if assert.Len(publisher.published, 1) {
+		assert.Equal("Failed", publisher.published[0].state)
+		assert.Equal("external-id", publisher.published[0].jobID)
+	}
+}
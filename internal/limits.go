@@ -12,6 +12,8 @@ import (
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/model/v6"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -36,11 +38,9 @@ func shouldCountStatus(status string) bool {
 	return countIt
 }
 
-func (i *Internal) countJobsForUser(ctx context.Context, username string) (int, error) {
-	set := labels.Set(map[string]string{
-		"username": username,
-	})
-
+// countJobs counts the running VICE analyses with labels matching the given
+// set. Analyses that are shutting down aren't counted.
+func (i *Internal) countJobs(ctx context.Context, set labels.Set) (int, error) {
 	listoptions := metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
 	}
@@ -96,6 +96,20 @@ func (i *Internal) countJobsForUser(ctx context.Context, username string) (int,
 	return len(countedDeployments), nil
 }
 
+func (i *Internal) countJobsForUser(ctx context.Context, username string) (int, error) {
+	return i.countJobs(ctx, labels.Set{"username": username})
+}
+
+func (i *Internal) countJobsForApp(ctx context.Context, appID string) (int, error) {
+	return i.countJobs(ctx, labels.Set{"app-id": appID})
+}
+
+// countJobsInNodePool counts the analyses running in a node pool. Analyses
+// launched before the node-pool label was added aren't counted.
+func (i *Internal) countJobsInNodePool(ctx context.Context, pool string) (int, error) {
+	return i.countJobs(ctx, labels.Set{"node-pool": pool})
+}
+
 const getJobLimitForUserSQL = `
 	SELECT concurrent_jobs FROM job_limits
 	WHERE launcher = regexp_replace($1, '-', '_')
@@ -113,6 +127,64 @@ func (i *Internal) getJobLimitForUser(username string) (*int, error) {
 	return &jobLimit, nil
 }
 
+const getGroupJobLimitSQL = `
+	SELECT max(concurrent_jobs) FROM group_job_limits
+	WHERE group_name = ANY($1)
+`
+
+// getGroupJobLimit returns the concurrent job limit granted to a user through
+// their group memberships. If the user belongs to more than one group with a
+// limit then the most permissive one is used.
+func (i *Internal) getGroupJobLimit(groups []string) (*int, error) {
+	var jobLimit sql.NullInt64
+	if err := i.db.QueryRow(getGroupJobLimitSQL, pq.Array(groups)).Scan(&jobLimit); err != nil {
+		return nil, err
+	}
+	if !jobLimit.Valid {
+		return nil, nil
+	}
+	limit := int(jobLimit.Int64)
+	return &limit, nil
+}
+
+const getAppJobLimitSQL = `
+	SELECT concurrent_jobs FROM app_job_limits
+	WHERE app_id = $1
+`
+
+// getAppJobLimit returns the number of copies of an app that may run at the
+// same time across all users, or nil if the app isn't limited.
+func (i *Internal) getAppJobLimit(appID string) (*int, error) {
+	var jobLimit int
+	err := i.db.QueryRow(getAppJobLimitSQL, appID).Scan(&jobLimit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &jobLimit, nil
+}
+
+const getNodePoolJobLimitSQL = `
+	SELECT concurrent_jobs FROM node_pool_job_limits
+	WHERE node_pool = $1
+`
+
+// getNodePoolJobLimit returns the number of analyses that may run at the same
+// time in a node pool, or nil if the node pool isn't limited.
+func (i *Internal) getNodePoolJobLimit(pool string) (*int, error) {
+	var jobLimit int
+	err := i.db.QueryRow(getNodePoolJobLimitSQL, pool).Scan(&jobLimit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &jobLimit, nil
+}
+
 const getDefaultJobLimitSQL = `
 	SELECT concurrent_jobs FROM job_limits
 	WHERE launcher IS NULL
@@ -126,7 +198,15 @@ func (i *Internal) getDefaultJobLimit() (int, error) {
 	return defaultJobLimit, nil
 }
 
+// getResourceOveragesForUser returns the resource overages for a user. The
+// lookup is cached and goes through a circuit breaker, so the result may be nil
+// if QMS is unavailable and the service is configured to fail open.
 func (i *Internal) getResourceOveragesForUser(ctx context.Context, username string) (*qms.OverageList, error) {
+	return i.overages.get(ctx, username)
+}
+
+// requestResourceOverages asks QMS for the resource overages for a user.
+func (i *Internal) requestResourceOverages(ctx context.Context, username string) (*qms.OverageList, error) {
 	var err error
 
 	subject := "cyverse.qms.user.overages.get"
@@ -140,16 +220,23 @@ func (i *Internal) getResourceOveragesForUser(ctx context.Context, username stri
 
 	resp := pbinit.NewOverageList()
 
-	if err = gotelnats.Request(
-		ctx,
-		i.NATSEncodedConn,
-		subject,
-		req,
-		resp,
-	); err != nil {
+	// gotelnats.Request waits up to 30 seconds regardless of the context, so
+	// the request is made here in a way that stops when the context is done.
+	carrier := gotelnats.PBTextMapCarrier{Header: req.GetHeader()}
+	_, reqSpan := gotelnats.InjectSpan(ctx, &carrier, subject, gotelnats.Send)
+	defer reqSpan.End()
+
+	if err = i.NATSEncodedConn.RequestWithContext(ctx, subject, req, resp); err != nil {
 		return nil, err
 	}
 
+	if respErr := resp.GetError(); respErr != nil && respErr.ErrorCode != svcerror.ErrorCode_UNSET {
+		if respErr.StatusCode != 0 {
+			return nil, gotelnats.NewDEServiceError(respErr.ErrorCode, respErr.Message, respErr.StatusCode)
+		}
+		return nil, gotelnats.NewDEServiceError(respErr.ErrorCode, respErr.Message)
+	}
+
 	return resp, nil
 }
 
@@ -157,6 +244,7 @@ func buildLimitError(code, msg string, defaultJobLimit, jobCount int, jobLimit *
 	return common.ErrorResponse{
 		ErrorCode: code,
 		Message:   msg,
+		Status:    http.StatusBadRequest,
 		Details: &map[string]interface{}{
 			"defaultJobLimit": defaultJobLimit,
 			"jobCount":        jobCount,
@@ -165,36 +253,45 @@ func buildLimitError(code, msg string, defaultJobLimit, jobCount int, jobLimit *
 	}
 }
 
+// isLimitReached returns true if the error indicates that the job can't be
+// launched because the user's concurrent job limit has been reached. Other
+// validation errors, including app and node pool limits, won't necessarily go
+// away when one of the user's own analyses exits.
+func isLimitReached(err error) bool {
+	var limitErr common.ErrorResponse
+	return errors.As(err, &limitErr) && limitErr.ErrorCode == common.ErrCodeLimitReached
+}
+
 func validateJobLimits(user string, defaultJobLimit, jobCount int, jobLimit *int, overages *qms.OverageList) (int, error) {
 	switch {
 
 	// Jobs are disabled by default and the user has not been granted permission yet.
 	case jobLimit == nil && defaultJobLimit <= 0:
-		code := "ERR_PERMISSION_NEEDED"
+		code := common.ErrCodePermissionNeeded
 		msg := fmt.Sprintf("%s has not been granted permission to run jobs yet", user)
 		return http.StatusBadRequest, buildLimitError(code, msg, defaultJobLimit, jobCount, jobLimit)
 
 	// Jobs have been explicitly disabled for the user.
 	case jobLimit != nil && *jobLimit <= 0:
-		code := "ERR_FORBIDDEN"
+		code := common.ErrCodeForbidden
 		msg := fmt.Sprintf("%s is not permitted to run jobs", user)
 		return http.StatusBadRequest, buildLimitError(code, msg, defaultJobLimit, jobCount, jobLimit)
 
 	// The user is using and has reached the default job limit.
 	case jobLimit == nil && jobCount >= defaultJobLimit:
-		code := "ERR_LIMIT_REACHED"
+		code := common.ErrCodeLimitReached
 		msg := fmt.Sprintf("%s is already running %d or more concurrent jobs", user, defaultJobLimit)
 		return http.StatusBadRequest, buildLimitError(code, msg, defaultJobLimit, jobCount, jobLimit)
 
 	// The user has explicitly been granted the ability to run jobs and has reached the limit.
 	case jobLimit != nil && jobCount >= *jobLimit:
-		code := "ERR_LIMIT_REACHED"
+		code := common.ErrCodeLimitReached
 		msg := fmt.Sprintf("%s is already running %d or more concurrent jobs", user, *jobLimit)
 		return http.StatusBadRequest, buildLimitError(code, msg, defaultJobLimit, jobCount, jobLimit)
 
 	case overages != nil && len(overages.Overages) != 0:
 		var inOverage bool
-		code := "ERR_RESOURCE_OVERAGE"
+		code := common.ErrCodeResourceOverage
 		details := make(map[string]interface{})
 
 		for _, ov := range overages.Overages {
@@ -209,6 +306,7 @@ func validateJobLimits(user string, defaultJobLimit, jobCount int, jobLimit *int
 			return http.StatusBadRequest, common.ErrorResponse{
 				ErrorCode: code,
 				Message:   msg,
+				Status:    http.StatusBadRequest,
 				Details:   &details,
 			}
 		}
@@ -221,6 +319,58 @@ func validateJobLimits(user string, defaultJobLimit, jobCount int, jobLimit *int
 	}
 }
 
+// sharedLimit describes a concurrent job limit that applies to all users, such
+// as the number of copies of an app that may run at once.
+type sharedLimit struct {
+	code     string
+	name     string
+	jobCount int
+	jobLimit *int
+}
+
+// validateSharedLimits verifies that none of the limits shared by all users have
+// been reached.
+func validateSharedLimits(limits ...sharedLimit) (int, error) {
+	for _, limit := range limits {
+		if limit.jobLimit != nil && limit.jobCount >= *limit.jobLimit {
+			return http.StatusBadRequest, common.ErrorResponse{
+				ErrorCode: limit.code,
+				Status:    http.StatusBadRequest,
+				Message:   fmt.Sprintf("%d or more concurrent jobs are already running for %s", *limit.jobLimit, limit.name),
+				Details: &map[string]interface{}{
+					"jobCount": limit.jobCount,
+					"jobLimit": limit.jobLimit,
+				},
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// getSharedLimit looks up a shared limit and, if one is set, counts the jobs
+// that it applies to. Jobs aren't counted for limits that aren't set, since
+// that can require quite a few database queries.
+func (i *Internal) getSharedLimit(
+	ctx context.Context,
+	code, name, key string,
+	getLimit func(string) (*int, error),
+	count func(context.Context, string) (int, error),
+) (*sharedLimit, error) {
+	jobLimit, err := getLimit(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to determine the concurrent job limit for %s", name)
+	}
+
+	limit := &sharedLimit{code: code, name: name, jobLimit: jobLimit}
+	if jobLimit != nil {
+		if limit.jobCount, err = count(ctx, key); err != nil {
+			return nil, errors.Wrapf(err, "unable to determine the number of jobs running for %s", name)
+		}
+	}
+
+	return limit, nil
+}
+
 func (i *Internal) validateJob(ctx context.Context, job *model.Job) (int, error) {
 
 	// Verify that the job type is supported by this service
@@ -241,14 +391,55 @@ func (i *Internal) validateJob(ctx context.Context, job *model.Job) (int, error)
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the concurrent job limit for %s", user)
 	}
+
+	// Limits for individual users take precedence over group limits.
+	if i.ExtendedJobLimits && jobLimit == nil && len(job.UserGroups) > 0 {
+		jobLimit, err = i.getGroupJobLimit(job.UserGroups)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the group concurrent job limit for %s", user)
+		}
+	}
+
 	defaultJobLimit, err := i.getDefaultJobLimit()
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the default concurrent job limit")
 	}
+
+	// Look up the limits that apply to all users.
+	sharedLimits := []sharedLimit{}
+	if i.ExtendedJobLimits && job.AppID != "" {
+		appLimit, err := i.getSharedLimit(
+			ctx, common.ErrCodeAppLimitReached, fmt.Sprintf("app %s", job.AppID), job.AppID, i.getAppJobLimit, i.countJobsForApp,
+		)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		sharedLimits = append(sharedLimits, *appLimit)
+	}
+
+	if i.ExtendedJobLimits {
+		pool := nodePool(job)
+		poolLimit, err := i.getSharedLimit(
+			ctx, common.ErrCodeNodePoolLimitReached, fmt.Sprintf("node pool %s", pool), pool, i.getNodePoolJobLimit, i.countJobsInNodePool,
+		)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		sharedLimits = append(sharedLimits, *poolLimit)
+	}
+
 	overages, err := i.getResourceOveragesForUser(ctx, user)
 	if err != nil {
-		return http.StatusInternalServerError, errors.Wrapf(err, "unable to get list of resource overages for user %s", user)
+		status := http.StatusInternalServerError
+		if err == errOverageBreakerOpen {
+			status = http.StatusServiceUnavailable
+		}
+		return status, errors.Wrapf(err, "unable to get list of resource overages for user %s", user)
+	}
+
+	if status, err := validateJobLimits(user, defaultJobLimit, jobCount, jobLimit, overages); err != nil {
+		return status, err
 	}
 
-	return validateJobLimits(user, defaultJobLimit, jobCount, jobLimit, overages)
+	return validateSharedLimits(sharedLimits...)
 }
@@ -8,7 +8,9 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/model/v6"
+	"github.com/cyverse-de/p/go/qms"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/apps/v1"
@@ -65,6 +67,12 @@ func setupInternal(t *testing.T, objs []runtime.Object) (*Internal, sqlmock.Sqlm
 	apps := apps.NewApps(sqlxMockDB, "@iplantcollaborative.org")
 
 	internal := New(testConfig, sqlxMockDB, client, apps)
+
+	// Don't try to contact QMS during the tests.
+	internal.overages.fetch = func(_ context.Context, _ string) (*qms.OverageList, error) {
+		return &qms.OverageList{}, nil
+	}
+
 	return internal, mock
 }
 
@@ -96,6 +104,40 @@ func registerDefaultLimitQuery(mock sqlmock.Sqlmock, limit int) {
 		WillReturnRows(rows)
 }
 
+// registerGroupLimitQuery registers the group job limit query for a set of groups.
+func registerGroupLimitQuery(mock sqlmock.Sqlmock, limit *int) {
+	rows := mock.NewRows([]string{"max"})
+	if limit != nil {
+		rows.AddRow(fmt.Sprintf("%d", *limit))
+	} else {
+		rows.AddRow(nil)
+	}
+	mock.ExpectQuery("SELECT max\\(concurrent_jobs\\) FROM group_job_limits").
+		WillReturnRows(rows)
+}
+
+// registerAppLimitQuery registers the job limit query for an app.
+func registerAppLimitQuery(mock sqlmock.Sqlmock, appID string, limit *int) {
+	rows := mock.NewRows([]string{"concurrent_jobs"})
+	if limit != nil {
+		rows.AddRow(fmt.Sprintf("%d", *limit))
+	}
+	mock.ExpectQuery("SELECT concurrent_jobs FROM app_job_limits WHERE app_id =").
+		WithArgs(appID).
+		WillReturnRows(rows)
+}
+
+// registerNodePoolLimitQuery registers the job limit query for a node pool.
+func registerNodePoolLimitQuery(mock sqlmock.Sqlmock, pool string, limit *int) {
+	rows := mock.NewRows([]string{"concurrent_jobs"})
+	if limit != nil {
+		rows.AddRow(fmt.Sprintf("%d", *limit))
+	}
+	mock.ExpectQuery("SELECT concurrent_jobs FROM node_pool_job_limits WHERE node_pool =").
+		WithArgs(pool).
+		WillReturnRows(rows)
+}
+
 // registerAnalysisIDQuery registers the query to get the analysis ID for an external ID
 // if that an external ID is provided. If no external ID is provided then we assume that
 // no query should be performed.
@@ -312,6 +354,133 @@ func TestLimitChecks(t *testing.T) {
 	}
 }
 
+// labeledViceDeployment creates a fake VICE deployment with the given labels to use for testing.
+func labeledViceDeployment(n int, externalID string, labels map[string]string) *v1.Deployment {
+	deployment := viceDeployment(n, "vice-apps", "someone", &externalID)
+	for k, v := range labels {
+		deployment.Labels[k] = v
+	}
+	return deployment
+}
+
+func TestGroupLimitChecks(t *testing.T) {
+	tests := []struct {
+		description string
+		userLimit   *int
+		groupLimit  *int
+		expected    string
+	}{
+		{"group limit not reached", nil, intPointer(3), ""},
+		{"group limit reached", nil, intPointer(2), "ERR_LIMIT_REACHED"},
+		{"group limit overridden by user limit", intPointer(3), nil, ""},
+		{"no group limit", nil, nil, "ERR_LIMIT_REACHED"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			objs := make([]runtime.Object, len(testAnalyses))
+			for i, analysis := range testAnalyses {
+				objs[i] = viceDeployment(i, "vice-apps", "foo", analysis.externalID)
+			}
+
+			internal, mock := setupInternal(t, objs)
+			defer internal.db.Close()
+			internal.ExtendedJobLimits = true
+
+			for _, analysis := range testAnalyses {
+				registerAnalysisIDQuery(mock, analysis.externalID, analysis.analysisID)
+				registerAnalysisStatusQuery(mock, analysis.analysisID, analysis.status)
+			}
+			registerLimitQuery(mock, "foo", test.userLimit)
+			if test.userLimit == nil {
+				registerGroupLimitQuery(mock, test.groupLimit)
+			}
+			registerDefaultLimitQuery(mock, 2)
+			registerNodePoolLimitQuery(mock, viceNodePool, nil)
+
+			job := createTestSubmission("foo")
+			job.UserGroups = []string{"workshop"}
+
+			status, err := internal.validateJob(context.Background(), job)
+			if test.expected == "" {
+				assert.Equal(http.StatusOK, status)
+				assert.NoError(err)
+			} else {
+				assert.Equal(http.StatusBadRequest, status)
+				assert.Equal(test.expected, err.(common.ErrorResponse).ErrorCode)
+			}
+			assert.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSharedLimitChecks(t *testing.T) {
+	appID := "a1ca7b10-4d8d-4d8e-9b60-0c2cbbd1a1e2"
+	otherAppID := "a9b6b25c-4d4d-4b71-8a34-17e4ab8c23f7"
+
+	tests := []struct {
+		description string
+		appLimit    *int
+		poolLimit   *int
+		expected    string
+	}{
+		{"no shared limits", nil, nil, ""},
+		{"app limit not reached", intPointer(2), nil, ""},
+		{"app limit reached", intPointer(1), nil, "ERR_APP_LIMIT_REACHED"},
+		{"node pool limit not reached", nil, intPointer(3), ""},
+		{"node pool limit reached", nil, intPointer(2), "ERR_NODE_POOL_LIMIT_REACHED"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// One analysis of the limited app and one of another app are running
+			// in the default node pool, each launched by another user.
+			analyses := testAnalyses
+			objs := []runtime.Object{
+				labeledViceDeployment(0, *analyses[0].externalID, map[string]string{"app-id": appID, "node-pool": viceNodePool}),
+				labeledViceDeployment(1, *analyses[1].externalID, map[string]string{"app-id": otherAppID, "node-pool": viceNodePool}),
+			}
+
+			internal, mock := setupInternal(t, objs)
+			defer internal.db.Close()
+			internal.ExtendedJobLimits = true
+
+			registerLimitQuery(mock, "foo", nil)
+			registerDefaultLimitQuery(mock, 2)
+			registerAppLimitQuery(mock, appID, test.appLimit)
+			if test.appLimit != nil {
+				registerAnalysisIDQuery(mock, analyses[0].externalID, analyses[0].analysisID)
+				registerAnalysisStatusQuery(mock, analyses[0].analysisID, analyses[0].status)
+			}
+			registerNodePoolLimitQuery(mock, viceNodePool, test.poolLimit)
+			if test.poolLimit != nil {
+				for _, analysis := range analyses {
+					registerAnalysisIDQuery(mock, analysis.externalID, analysis.analysisID)
+					registerAnalysisStatusQuery(mock, analysis.analysisID, analysis.status)
+				}
+			}
+
+			job := createTestSubmission("foo")
+			job.AppID = appID
+
+			status, err := internal.validateJob(context.Background(), job)
+			if test.expected == "" {
+				assert.Equal(http.StatusOK, status)
+				assert.NoError(err)
+			} else {
+				assert.Equal(http.StatusBadRequest, status)
+				assert.Equal(test.expected, err.(common.ErrorResponse).ErrorCode)
+				assert.False(isLimitReached(err), "shared limits should not cause launches to be queued")
+			}
+			assert.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
 func TestLabelValueReplacement(t *testing.T) {
 	assert := assert.New(t)
 
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	apiv1 "k8s.io/api/core/v1"
@@ -128,22 +129,22 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	// id is required
 	id = c.Param("analysis-id")
 	if id == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+		return common.BadRequest("id parameter is empty")
 	}
 
 	// user is required
 	user = c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+		return common.Forbidden("user is not set")
 	}
 
 	externalIDs, err := i.getExternalIDs(ctx, user, id)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return common.Internal(err.Error())
 	}
 
 	if len(externalIDs) < 1 {
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("no external-ids found for analysis-id %s", id))
+		return common.Internal(fmt.Sprintf("no external-ids found for analysis-id %s", id))
 	}
 
 	//Just use the first external-id for now.
@@ -154,7 +155,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	// previous is optional
 	if c.QueryParam("previous") != "" {
 		if previous, err = strconv.ParseBool(c.QueryParam("previous")); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return common.BadRequest(err.Error())
 		}
 
 		logOpts.Previous = previous
@@ -163,7 +164,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	// since is optional
 	if c.QueryParam("since") != "" {
 		if since, err = strconv.ParseInt(c.QueryParam("since"), 10, 64); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return common.BadRequest(err.Error())
 		}
 
 		logOpts.SinceSeconds = &since
@@ -171,7 +172,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 
 	if c.QueryParam("since-time") != "" {
 		if sinceTime, err = strconv.ParseInt(c.QueryParam("since-time"), 10, 64); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return common.BadRequest(err.Error())
 		}
 
 		convertedSinceTime := metav1.Unix(sinceTime, 0)
@@ -181,7 +182,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	// tail-lines is optional
 	if c.QueryParam("tail-lines") != "" {
 		if tailLines, err = strconv.ParseInt(c.QueryParam("tail-lines"), 10, 64); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return common.BadRequest(err.Error())
 		}
 
 		logOpts.TailLines = &tailLines
@@ -194,7 +195,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	// timestamps is optional
 	if c.QueryParam("timestamps") != "" {
 		if timestamps, err = strconv.ParseBool(c.QueryParam("timestamps")); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return common.BadRequest(err.Error())
 		}
 
 		logOpts.Timestamps = timestamps
@@ -217,7 +218,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	}
 
 	if len(podList) < 1 {
-		return fmt.Errorf("no pods found for analysis %s with external ID %s", id, externalID)
+		return common.NotFound(fmt.Sprintf("no pods found for analysis %s with external ID %s", id, externalID))
 	}
 
 	podName = podList[0].Name
@@ -286,7 +287,7 @@ func (i *Internal) PodsHandler(c echo.Context) error {
 	user := c.QueryParam("user")
 
 	if user == "" {
-		return echo.NewHTTPError(http.StatusForbidden, "user not set")
+		return common.Forbidden("user not set")
 	}
 
 	externalIDs, err := i.getExternalIDs(ctx, user, analysisID)
@@ -295,7 +296,7 @@ func (i *Internal) PodsHandler(c echo.Context) error {
 	}
 
 	if len(externalIDs) == 0 {
-		return fmt.Errorf("no external-id found for analysis-id %s", analysisID)
+		return common.NotFound(fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
 	}
 
 	// For now, just use the first external ID
@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	saveAndExitOperation = "save-and-exit"
+
+	// OperationRequested means that the operation has been recorded but no
+	// work has been done yet.
+	OperationRequested = "requested"
+
+	// OperationUploading means that the outputs are being uploaded.
+	OperationUploading = "uploading"
+
+	// OperationExiting means that the analysis's resources are being removed.
+	OperationExiting = "exiting"
+
+	// OperationDone means that the operation finished.
+	OperationDone = "done"
+
+	// OperationFailed means that the operation couldn't be finished.
+	OperationFailed = "failed"
+
+	defaultOperationStaleAfter = 5 * time.Minute
+)
+
+// Operation is a long-running request, such as saving the outputs of an
+// analysis and then exiting it. When OperationsEnabled is set, operations are
+// stored in the vice_operations table (see schema/vice_operations.sql) so that
+// they can be resumed by another replica if the one running them goes away.
+// Running operations are touched periodically; one that hasn't been updated
+// in a while is assumed to have been abandoned.
+type Operation struct {
+	ID         string    `json:"id" db:"id"`
+	Kind       string    `json:"kind" db:"kind"`
+	ExternalID string    `json:"external_id" db:"external_id"`
+	State      string    `json:"state" db:"state"`
+	Error      string    `json:"error,omitempty" db:"error"`
+	CreatedOn  time.Time `json:"created_on" db:"created_on"`
+	UpdatedOn  time.Time `json:"updated_on" db:"updated_on"`
+}
+
+// isFinishedOperation returns true if the operation is in a terminal state.
+func isFinishedOperation(state string) bool {
+	return state == OperationDone || state == OperationFailed
+}
+
+// operationStaleAfter returns how long an operation can go without being
+// updated before it's resumed elsewhere.
+func (i *Internal) operationStaleAfter() time.Duration {
+	if i.OperationStaleAfter > 0 {
+		return i.OperationStaleAfter
+	}
+	return defaultOperationStaleAfter
+}
+
+const operationColumns = `id, kind, external_id, state, COALESCE(error, '') AS error, created_on, updated_on`
+
+// createOperationSQL relies on the unique index on active operations, so two
+// requests racing to start the same operation can't both create one.
+var createOperationSQL = fmt.Sprintf(`
+	INSERT INTO vice_operations (kind, external_id, state)
+	VALUES ($1, $2, 'requested')
+	    ON CONFLICT (kind, external_id) WHERE state NOT IN ('done', 'failed') DO NOTHING
+ RETURNING %s
+`, operationColumns)
+
+var activeOperationSQL = fmt.Sprintf(`
+	SELECT %s
+	  FROM vice_operations
+	 WHERE kind = $1
+	   AND external_id = $2
+	   AND state NOT IN ('done', 'failed')
+`, operationColumns)
+
+// maxStartOperationAttempts limits how many times startOperation tries again
+// when the operation it conflicted with finishes before it can be looked up.
+const maxStartOperationAttempts = 3
+
+// startOperation records a new operation for the analysis. If the same kind of
+// operation is already underway for the analysis then that one is returned
+// instead, and the returned boolean is false.
+func (i *Internal) startOperation(ctx context.Context, kind, externalID string) (*Operation, bool, error) {
+	for attempt := 0; attempt < maxStartOperationAttempts; attempt++ {
+		op := &Operation{}
+
+		err := i.db.QueryRowxContext(ctx, createOperationSQL, kind, externalID).StructScan(op)
+		if err == nil {
+			return op, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, errors.Wrapf(err, "unable to record the %s operation for %s", kind, externalID)
+		}
+
+		// Another operation is underway.
+		err = i.db.QueryRowxContext(ctx, activeOperationSQL, kind, externalID).StructScan(op)
+		if err == nil {
+			return op, false, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, err
+		}
+	}
+
+	return nil, false, fmt.Errorf("unable to start the %s operation for %s", kind, externalID)
+}
+
+var getOperationSQL = fmt.Sprintf(`
+	SELECT %s
+	  FROM vice_operations
+	 WHERE id = $1
+`, operationColumns)
+
+// getOperation returns the operation with the given ID.
+func (i *Internal) getOperation(ctx context.Context, id string) (*Operation, error) {
+	op := &Operation{}
+	if err := i.db.QueryRowxContext(ctx, getOperationSQL, id).StructScan(op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+const setOperationStateSQL = `
+	UPDATE vice_operations
+	   SET state = $2,
+	       error = NULLIF($3, ''),
+	       updated_on = now()
+	 WHERE id = $1
+`
+
+// setOperationState moves the operation to a new state.
+func (i *Internal) setOperationState(ctx context.Context, op *Operation, state, errMsg string) error {
+	if _, err := i.db.ExecContext(ctx, setOperationStateSQL, op.ID, state, errMsg); err != nil {
+		return errors.Wrapf(err, "unable to move operation %s to %s", op.ID, state)
+	}
+	op.State = state
+	op.Error = errMsg
+	return nil
+}
+
+const touchOperationSQL = `
+	UPDATE vice_operations
+	   SET updated_on = now()
+	 WHERE id = $1
+	   AND state NOT IN ('done', 'failed')
+`
+
+// keepOperationAlive touches the operation periodically so that it isn't
+// mistaken for an abandoned one. The returned function stops the updates.
+func (i *Internal) keepOperationAlive(ctx context.Context, id string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(i.operationStaleAfter() / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := i.db.ExecContext(ctx, touchOperationSQL, id); err != nil {
+					log.Error(errors.Wrapf(err, "unable to update operation %s", id))
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+var claimStaleOperationsSQL = fmt.Sprintf(`
+	UPDATE vice_operations
+	   SET updated_on = now()
+	 WHERE id IN (
+		SELECT id
+		  FROM vice_operations
+		 WHERE state NOT IN ('done', 'failed')
+		   AND updated_on < now() - make_interval(secs => $1)
+		   FOR UPDATE SKIP LOCKED
+	 )
+ RETURNING %s
+`, operationColumns)
+
+// claimStaleOperations returns the unfinished operations that haven't been
+// updated recently, marking them as updated so that they aren't claimed again
+// while they're resumed.
+func (i *Internal) claimStaleOperations(ctx context.Context) ([]Operation, error) {
+	ops := []Operation{}
+	err := i.db.SelectContext(ctx, &ops, claimStaleOperationsSQL, i.operationStaleAfter().Seconds())
+	return ops, err
+}
+
+// runSaveAndExit takes a save-and-exit operation from its current state to the
+// end. Operations interrupted during the upload start the upload over again.
+// The analysis exits even if the upload fails.
+func (i *Internal) runSaveAndExit(ctx context.Context, op *Operation) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "runSaveAndExit")
+	defer span.End()
+
+	stop := i.keepOperationAlive(ctx, op.ID)
+	defer stop()
+
+	for !isFinishedOperation(op.State) {
+		var err error
+
+		switch op.State {
+		case OperationRequested, OperationUploading:
+			if err = i.setOperationState(ctx, op, OperationUploading, ""); err != nil {
+				break
+			}
+
+			log.Infof("calling doFileTransfer for %s", op.ExternalID)
+
+			// An upload failure is remembered so that the analysis can be
+			// marked as failed once it has exited.
+			uploadMsg := ""
+			if uploadErr := i.saveOutputsBeforeExit(ctx, op.ExternalID); uploadErr != nil {
+				uploadMsg = fmt.Sprintf("output files were not saved: %s", uploadErr)
+			}
+
+			err = i.setOperationState(ctx, op, OperationExiting, uploadMsg)
+
+		case OperationExiting:
+			log.Infof("calling VICEExit for %s", op.ExternalID)
+
+			if exitErr := i.doExit(ctx, op.ExternalID); exitErr != nil {
+				log.Error(errors.Wrapf(exitErr, "error triggering analysis exit for %s", op.ExternalID))
+				err = i.setOperationState(ctx, op, OperationFailed, exitErr.Error())
+				break
+			}
+
+			i.publishExitStatus(ctx, op)
+			err = i.setOperationState(ctx, op, OperationDone, op.Error)
+
+		default:
+			err = i.setOperationState(ctx, op, OperationFailed, fmt.Sprintf("unknown state %s", op.State))
+		}
+
+		// The operation will be picked up again once it's considered stale.
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
+
+// publishExitStatus marks the analysis as completed once it has exited, or as
+// failed if an upload of its outputs ran and failed or timed out.
+func (i *Internal) publishExitStatus(ctx context.Context, op *Operation) {
+	var err error
+	if op.Error != "" {
+		err = i.statusPublisher.Fail(ctx, op.ExternalID, fmt.Sprintf("analysis %s exited, but %s", op.ExternalID, op.Error))
+	} else {
+		err = i.statusPublisher.Success(ctx, op.ExternalID, fmt.Sprintf("analysis %s exited", op.ExternalID))
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// ResumeOperations picks up operations that were abandoned, usually because
+// the replica running them was restarted. Each operation is resumed in its own
+// goroutine.
+func (i *Internal) ResumeOperations(ctx context.Context) []error {
+	ops, err := i.claimStaleOperations(ctx)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+	for idx := range ops {
+		op := ops[idx]
+
+		switch op.Kind {
+		case saveAndExitOperation:
+			log.Infof("resuming %s operation %s for %s from the %s state", op.Kind, op.ID, op.ExternalID, op.State)
+			go i.runSaveAndExit(context.Background(), &op)
+		default:
+			err = fmt.Errorf("unable to resume operation %s: unknown kind %s", op.ID, op.Kind)
+			errs = append(errs, err)
+			if setErr := i.setOperationState(ctx, &op, OperationFailed, err.Error()); setErr != nil {
+				errs = append(errs, setErr)
+			}
+		}
+	}
+
+	return errs
+}
+
+// saveAndExit saves the analysis's outputs and exits it without recording an
+// operation, for when operations aren't enabled.
+func (i *Internal) saveAndExit(ctx context.Context, externalID string) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "saveAndExit")
+	defer span.End()
+
+	op := &Operation{Kind: saveAndExitOperation, ExternalID: externalID}
+
+	log.Infof("calling doFileTransfer for %s", externalID)
+	if uploadErr := i.saveOutputsBeforeExit(ctx, externalID); uploadErr != nil {
+		op.Error = fmt.Sprintf("output files were not saved: %s", uploadErr)
+	}
+
+	log.Infof("calling VICEExit for %s", externalID)
+	if err := i.doExit(ctx, externalID); err != nil {
+		log.Error(errors.Wrapf(err, "error triggering analysis exit for %s", externalID))
+		return
+	}
+
+	i.publishExitStatus(ctx, op)
+}
+
+// startSaveAndExit records a save-and-exit operation for the analysis and runs
+// it in the background. The response contains the operation, which can be
+// used to follow its progress. Without operations, the work is still done in
+// the background but there's nothing to return.
+func (i *Internal) startSaveAndExit(c echo.Context, externalID string) error {
+	ctx := c.Request().Context()
+
+	// Since file transfers can take a while, this happens asynchronously.
+	separatedSpanContext := trace.SpanContextFromContext(ctx)
+	outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
+
+	if !i.OperationsEnabled {
+		go i.saveAndExit(outerCtx, externalID)
+		return c.NoContent(http.StatusOK)
+	}
+
+	op, created, err := i.startOperation(ctx, saveAndExitOperation, externalID)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		running := *op
+		go i.runSaveAndExit(outerCtx, &running)
+	}
+
+	return c.JSON(http.StatusOK, op)
+}
+
+// lookupOperation returns the operation named by the operation-id parameter.
+func (i *Internal) lookupOperation(c echo.Context) (*Operation, error) {
+	id := c.Param("operation-id")
+	if id == "" {
+		return nil, common.BadRequest("operation-id parameter is empty")
+	}
+
+	op, err := i.getOperation(c.Request().Context(), id)
+	if err == sql.ErrNoRows {
+		return nil, common.NotFound(fmt.Sprintf("operation %s not found", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// OperationHandler returns the current state of an operation. The user needs
+// read access to the analysis that the operation is for.
+func (i *Internal) OperationHandler(c echo.Context) error {
+	op, err := i.lookupOperation(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.checkExternalIDAccess(c, op.ExternalID, viewAnalysis); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, op)
+}
+
+// AdminOperationHandler returns the current state of any operation.
+func (i *Internal) AdminOperationHandler(c echo.Context) error {
+	op, err := i.lookupOperation(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, op)
+}
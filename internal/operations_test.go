@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// operationRows returns rows containing an operation in the given state.
+func operationRows(mock sqlmock.Sqlmock, id, state string) *sqlmock.Rows {
+	now := time.Now()
+	return mock.NewRows([]string{"id", "kind", "external_id", "state", "error", "created_on", "updated_on"}).
+		AddRow(id, saveAndExitOperation, "external-id", state, "", now, now)
+}
+
+func TestStartOperation(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("INSERT INTO vice_operations (.+) ON CONFLICT").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnRows(operationRows(mock, "op-1", OperationRequested))
+
+	op, created, err := internal.startOperation(context.Background(), saveAndExitOperation, "external-id")
+	if assert.NoError(err) {
+		assert.True(created)
+		assert.Equal("op-1", op.ID)
+		assert.Equal(OperationRequested, op.State)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestStartOperationAlreadyRunning(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("INSERT INTO vice_operations").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT (.+) FROM vice_operations").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnRows(operationRows(mock, "op-1", OperationUploading))
+
+	op, created, err := internal.startOperation(context.Background(), saveAndExitOperation, "external-id")
+	if assert.NoError(err) {
+		assert.False(created)
+		assert.Equal("op-1", op.ID)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestStartOperationConflictFinished(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	// The conflicting operation finishes before it can be looked up, so the
+	// insert is tried again.
+	mock.ExpectQuery("INSERT INTO vice_operations").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT (.+) FROM vice_operations").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO vice_operations").
+		WithArgs(saveAndExitOperation, "external-id").
+		WillReturnRows(operationRows(mock, "op-2", OperationRequested))
+
+	op, created, err := internal.startOperation(context.Background(), saveAndExitOperation, "external-id")
+	if assert.NoError(err) {
+		assert.True(created)
+		assert.Equal("op-2", op.ID)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRunSaveAndExit(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// There's nothing running for the analysis, so there's nothing to upload,
+	// but the analysis should still exit.
+	mock.ExpectExec("UPDATE vice_operations").
+		WithArgs("op-1", OperationUploading, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, state := range []string{OperationExiting, OperationDone} {
+		mock.ExpectExec("UPDATE vice_operations").
+			WithArgs("op-1", state, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	op := &Operation{ID: "op-1", Kind: saveAndExitOperation, ExternalID: "external-id", State: OperationRequested}
+	internal.runSaveAndExit(context.Background(), op)
+
+	assert.Equal(OperationDone, op.State)
+	assert.Empty(op.Error)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// No upload ran, so there's nothing that failed.
+	if assert.Len(publisher.published, 1) {
+		assert.Equal("Completed", publisher.published[0].state)
+		assert.Equal("external-id", publisher.published[0].jobID)
+	}
+}
+
+func TestRunSaveAndExitResumesExiting(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// The outputs were already uploaded, so the upload isn't repeated.
+	mock.ExpectExec("UPDATE vice_operations").
+		WithArgs("op-1", OperationDone, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	op := &Operation{ID: "op-1", Kind: saveAndExitOperation, ExternalID: "external-id", State: OperationExiting}
+	internal.runSaveAndExit(context.Background(), op)
+
+	assert.Equal(OperationDone, op.State)
+	assert.NoError(mock.ExpectationsWereMet())
+	if assert.Len(publisher.published, 1) {
+		assert.Equal("Completed", publisher.published[0].state)
+	}
+}
+
+func TestResumeOperations(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	rows := mock.NewRows([]string{"id", "kind", "external_id", "state", "error", "created_on", "updated_on"}).
+		AddRow("op-1", "reticulate-splines", "external-id", OperationRequested, "", time.Now(), time.Now())
+	mock.ExpectQuery("UPDATE vice_operations").
+		WithArgs(defaultOperationStaleAfter.Seconds()).
+		WillReturnRows(rows)
+	mock.ExpectExec("UPDATE vice_operations").
+		WithArgs("op-1", OperationFailed, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	errs := internal.ResumeOperations(context.Background())
+	assert.Len(errs, 1)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestOperationHandlerRequiresAccess(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+	usePermissionsLevel(t, internal, "")
+
+	mock.ExpectQuery("SELECT (.+) FROM vice_operations").
+		WithArgs("op-1").
+		WillReturnRows(operationRows(mock, "op-1", OperationUploading))
+	mock.ExpectQuery("SELECT j.id").
+		WithArgs("external-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("analysis-id"))
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/operations/op-1?user=someone-else", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("operation-id")
+	c.SetParamValues("op-1")
+
+	err := internal.OperationHandler(c)
+	if errResp, ok := err.(common.ErrorResponse); assert.True(ok, "%v", err) {
+		assert.Equal(http.StatusForbidden, errResp.StatusCode())
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPublishExitStatus(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupInternal(t, nil)
+
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// An upload that ran and failed fails the analysis.
+	internal.publishExitStatus(context.Background(), &Operation{ExternalID: "external-id", Error: "output files were not saved: timed out"})
+	internal.publishExitStatus(context.Background(), &Operation{ExternalID: "external-id"})
+
+	if assert.Len(publisher.published, 2) {
+		assert.Equal("Failed", publisher.published[0].state)
+		assert.Contains(publisher.published[0].msg, "timed out")
+		assert.Equal("Completed", publisher.published[1].state)
+	}
+}
+
+func TestIsSidecarUnreachable(t *testing.T) {
+	unreachable := sidecarUnreachableError{errors.New("connection refused")}
+
+	assert.True(t, isSidecarUnreachable(unreachable))
+	assert.True(t, isSidecarUnreachable(errors.Wrap(unreachable, "error doing file transfer")))
+	assert.False(t, isSidecarUnreachable(errors.New("upload failed")))
+	assert.False(t, isSidecarUnreachable(nil))
+}
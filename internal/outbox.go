@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// outboxMetrics tracks the status updates waiting to be delivered to
+// job-status-listener. The values are published at /debug/vars.
+var outboxMetrics = expvar.NewMap("status_outbox")
+
+const (
+	defaultOutboxBatchSize   = 100
+	defaultOutboxBaseBackoff = 5 * time.Second
+	defaultOutboxMaxBackoff  = 5 * time.Minute
+)
+
+// statusSender delivers a single status update.
+type statusSender func(ctx context.Context, jobID string, status *AnalysisStatus) error
+
+// outboxEntry is a status update waiting to be delivered.
+type outboxEntry struct {
+	ID       int64  `db:"id"`
+	JobID    string `db:"job_id"`
+	Host     string `db:"host"`
+	State    string `db:"state"`
+	Message  string `db:"message"`
+	Attempts int    `db:"attempts"`
+}
+
+// OutboxPublisher is an AnalysisStatusPublisher that stores status updates in
+// the database and delivers them in the background, retrying failures with
+// exponential backoff. Updates for a job are delivered in the order in which
+// they were published; an update that can't be delivered holds back the later
+// updates for the same job, but not for other jobs.
+type OutboxPublisher struct {
+	db          *sqlx.DB
+	send        statusSender
+	batchSize   int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+// newOutboxPublisher returns an *OutboxPublisher that uses the settings in the
+// Init. A maximum number of attempts of zero retries updates forever.
+func newOutboxPublisher(init *Init, db *sqlx.DB, send statusSender) *OutboxPublisher {
+	o := &OutboxPublisher{
+		db:          db,
+		send:        send,
+		batchSize:   defaultOutboxBatchSize,
+		baseBackoff: init.StatusOutboxBaseBackoff,
+		maxBackoff:  init.StatusOutboxMaxBackoff,
+		maxAttempts: init.StatusOutboxMaxAttempts,
+	}
+	if o.baseBackoff <= 0 {
+		o.baseBackoff = defaultOutboxBaseBackoff
+	}
+	if o.maxBackoff <= 0 {
+		o.maxBackoff = defaultOutboxMaxBackoff
+	}
+	return o
+}
+
+const enqueueStatusSQL = `
+	INSERT INTO vice_status_outbox (job_id, host, state, message)
+	VALUES ($1, $2, $3, $4)
+`
+
+func (o *OutboxPublisher) enqueue(ctx context.Context, jobID, msg string, state messaging.JobState) error {
+	if _, err := o.db.ExecContext(ctx, enqueueStatusSQL, jobID, hostname(), string(state), msg); err != nil {
+		return errors.Wrapf(err, "unable to store the %s status for job %s", state, jobID)
+	}
+	outboxMetrics.Add("enqueued", 1)
+	return nil
+}
+
+// Fail records an analysis failure update for delivery. Should be sent once.
+func (o *OutboxPublisher) Fail(ctx context.Context, jobID, msg string) error {
+	log.Warnf("Storing failure job status update for external-id %s", jobID)
+	return o.enqueue(ctx, jobID, msg, messaging.FailedState)
+}
+
+// Success records a success update for delivery. Should be sent once.
+func (o *OutboxPublisher) Success(ctx context.Context, jobID, msg string) error {
+	log.Warnf("Storing success job status update for external-id %s", jobID)
+	return o.enqueue(ctx, jobID, msg, messaging.SucceededState)
+}
+
+// Running records an analysis running update for delivery.
+func (o *OutboxPublisher) Running(ctx context.Context, jobID, msg string) error {
+	log.Warnf("Storing running job status update for external-id %s", jobID)
+	return o.enqueue(ctx, jobID, msg, messaging.RunningState)
+}
+
+// Queued records an analysis queued update for delivery.
+func (o *OutboxPublisher) Queued(ctx context.Context, jobID, msg string) error {
+	log.Warnf("Storing queued job status update for external-id %s", jobID)
+	return o.enqueue(ctx, jobID, msg, messaging.QueuedState)
+}
+
+// pendingStatusesSQL selects the oldest undelivered update for each job, as
+// long as it's due to be retried. Later updates for a job wait until the ones
+// before them are delivered.
+const pendingStatusesSQL = `
+	SELECT id, job_id, host, state, message, attempts
+	  FROM (
+		SELECT DISTINCT ON (job_id) id, job_id, host, state, message, attempts, next_attempt
+		  FROM vice_status_outbox
+	  ORDER BY job_id, id
+	  ) AS heads
+	 WHERE next_attempt <= now()
+  ORDER BY id
+	 LIMIT $1
+`
+
+const deleteStatusSQL = `
+	DELETE FROM vice_status_outbox WHERE id = $1
+`
+
+const retryStatusSQL = `
+	UPDATE vice_status_outbox
+	   SET attempts = attempts + 1,
+	       next_attempt = now() + make_interval(secs => $2),
+	       last_error = $3
+	 WHERE id = $1
+`
+
+const countStatusesSQL = `
+	SELECT count(*) FROM vice_status_outbox
+`
+
+// backoff returns how long to wait before the next attempt to deliver an
+// update that has failed the given number of times.
+func (o *OutboxPublisher) backoff(attempts int) time.Duration {
+	wait := o.baseBackoff
+	for n := 0; n < attempts && wait < o.maxBackoff; n++ {
+		wait *= 2
+	}
+	if wait > o.maxBackoff {
+		return o.maxBackoff
+	}
+	return wait
+}
+
+// Deliver sends the updates that are due and records the failures for a later
+// retry. It's meant to be run periodically by a single replica at a time.
+func (o *OutboxPublisher) Deliver(ctx context.Context) []error {
+	errs := []error{}
+
+	entries := []outboxEntry{}
+	if err := o.db.SelectContext(ctx, &entries, pendingStatusesSQL, o.batchSize); err != nil {
+		return append(errs, errors.Wrap(err, "unable to list the pending status updates"))
+	}
+
+	for _, entry := range entries {
+		status := &AnalysisStatus{
+			Host:    entry.Host,
+			State:   messaging.JobState(entry.State),
+			Message: entry.Message,
+		}
+
+		sendErr := o.send(ctx, entry.JobID, status)
+		if sendErr == nil {
+			outboxMetrics.Add("delivered", 1)
+			if _, err := o.db.ExecContext(ctx, deleteStatusSQL, entry.ID); err != nil {
+				errs = append(errs, errors.Wrapf(err, "unable to remove delivered status update %d", entry.ID))
+			}
+			continue
+		}
+
+		outboxMetrics.Add("failed_attempts", 1)
+
+		// Give up on updates that will apparently never be accepted so that
+		// the later updates for the job aren't stuck behind them forever.
+		if o.maxAttempts > 0 && entry.Attempts+1 >= o.maxAttempts {
+			outboxMetrics.Add("dropped", 1)
+			errs = append(errs, errors.Wrapf(sendErr, "dropping the %s status for job %s after %d attempts", entry.State, entry.JobID, entry.Attempts+1))
+			if _, err := o.db.ExecContext(ctx, deleteStatusSQL, entry.ID); err != nil {
+				errs = append(errs, errors.Wrapf(err, "unable to remove status update %d", entry.ID))
+			}
+			continue
+		}
+
+		wait := o.backoff(entry.Attempts)
+		if _, err := o.db.ExecContext(ctx, retryStatusSQL, entry.ID, wait.Seconds(), sendErr.Error()); err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to schedule a retry of status update %d", entry.ID))
+		}
+		log.Warn(errors.Wrapf(sendErr, "will retry the %s status for job %s in %s", entry.State, entry.JobID, wait))
+	}
+
+	var backlog int64
+	if err := o.db.GetContext(ctx, &backlog, countStatusesSQL); err != nil {
+		errs = append(errs, errors.Wrap(err, "unable to count the pending status updates"))
+	} else {
+		backlogVar := new(expvar.Int)
+		backlogVar.Set(backlog)
+		outboxMetrics.Set("backlog", backlogVar)
+	}
+
+	return errs
+}
+
+// DeliverStatusUpdates sends the status updates waiting in the outbox. It does
+// nothing unless the outbox is enabled.
+func (i *Internal) DeliverStatusUpdates(ctx context.Context) []error {
+	outbox, ok := i.statusPublisher.(*OutboxPublisher)
+	if !ok {
+		return nil
+	}
+	return outbox.Deliver(ctx)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// sentStatus is a status update passed to the sender by the outbox.
+type sentStatus struct {
+	jobID string
+	state messaging.JobState
+}
+
+// setupOutbox returns an *OutboxPublisher backed by a mock database. The
+// sender fails for the jobs listed in failing.
+func setupOutbox(t *testing.T, maxAttempts int, failing ...string) (*OutboxPublisher, sqlmock.Sqlmock, *[]sentStatus) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("unable to create the mock database")
+	}
+
+	sent := &[]sentStatus{}
+	send := func(ctx context.Context, jobID string, status *AnalysisStatus) error {
+		for _, f := range failing {
+			if f == jobID {
+				return errors.New("job-status-listener is unavailable")
+			}
+		}
+		*sent = append(*sent, sentStatus{jobID: jobID, state: status.State})
+		return nil
+	}
+
+	init := &Init{StatusOutboxMaxAttempts: maxAttempts}
+	return newOutboxPublisher(init, sqlx.NewDb(mockdb, "sqlmock"), send), mock, sent
+}
+
+func outboxRows(mock sqlmock.Sqlmock) *sqlmock.Rows {
+	return mock.NewRows([]string{"id", "job_id", "host", "state", "message", "attempts"})
+}
+
+func TestOutboxEnqueue(t *testing.T) {
+	outbox, mock, _ := setupOutbox(t, 0)
+
+	mock.ExpectExec("INSERT INTO vice_status_outbox").
+		WithArgs("job-1", sqlmock.AnyArg(), "Running", "uploading").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, outbox.Running(context.Background(), "job-1", "uploading"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	assert := assert.New(t)
+	outbox, mock, sent := setupOutbox(t, 0, "job-2")
+
+	mock.ExpectQuery("SELECT (.+) FROM vice_status_outbox").
+		WithArgs(defaultOutboxBatchSize).
+		WillReturnRows(outboxRows(mock).
+			AddRow(1, "job-1", "host", "Running", "uploading", 0).
+			AddRow(2, "job-2", "host", "Failed", "oops", 2))
+	mock.ExpectExec("DELETE FROM vice_status_outbox").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_status_outbox").
+		WithArgs(2, (20 * time.Second).Seconds(), "job-status-listener is unavailable").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT count").
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+	errs := outbox.Deliver(context.Background())
+	assert.Empty(errs)
+	assert.Equal([]sentStatus{{jobID: "job-1", state: messaging.RunningState}}, *sent)
+	assert.Equal("1", outboxMetrics.Get("backlog").String())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestOutboxDropsAfterMaxAttempts(t *testing.T) {
+	assert := assert.New(t)
+	outbox, mock, _ := setupOutbox(t, 3, "job-1")
+
+	mock.ExpectQuery("SELECT (.+) FROM vice_status_outbox").
+		WithArgs(defaultOutboxBatchSize).
+		WillReturnRows(outboxRows(mock).AddRow(1, "job-1", "host", "Running", "uploading", 2))
+	mock.ExpectExec("DELETE FROM vice_status_outbox").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT count").
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+
+	errs := outbox.Deliver(context.Background())
+	assert.Len(errs, 1)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	outbox, _, _ := setupOutbox(t, 0)
+
+	assert.Equal(t, 5*time.Second, outbox.backoff(0))
+	assert.Equal(t, 40*time.Second, outbox.backoff(3))
+	assert.Equal(t, 5*time.Minute, outbox.backoff(100))
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/pkg/errors"
+)
+
+// overageMetrics tracks how the QMS overage lookups are behaving. The counters
+// are published at /debug/vars.
+var overageMetrics = expvar.NewMap("qms_overage_lookups")
+
+// errOverageBreakerOpen is returned when QMS overage lookups are being skipped
+// because too many of them have failed recently.
+var errOverageBreakerOpen = errors.New("QMS overage lookups are suspended after repeated failures")
+
+// overageFetcher retrieves the resource overages for a user from QMS.
+type overageFetcher func(ctx context.Context, username string) (*qms.OverageList, error)
+
+// cachedOverages is a cache entry for the overages of a single user.
+type cachedOverages struct {
+	overages  *qms.OverageList
+	fetchedAt time.Time
+}
+
+// overageChecker wraps QMS overage lookups with a short-lived cache and a
+// circuit breaker so that a slow or unavailable QMS doesn't stop every VICE
+// launch.
+type overageChecker struct {
+	fetch            overageFetcher
+	cacheTTL         time.Duration
+	requestTimeout   time.Duration
+	failureThreshold int
+	resetTimeout     time.Duration
+	failOpen         bool
+	now              func() time.Time
+
+	mu       sync.Mutex
+	cache    map[string]cachedOverages
+	failures int
+	openedAt time.Time
+}
+
+// newOverageChecker returns an *overageChecker that uses the settings in the
+// Init. A zero cache TTL disables caching, a zero failure threshold disables the
+// circuit breaker and a zero request timeout leaves the request timeout up to
+// the NATS client.
+func newOverageChecker(init *Init, fetch overageFetcher) *overageChecker {
+	return &overageChecker{
+		fetch:            fetch,
+		cacheTTL:         init.OverageCacheTTL,
+		requestTimeout:   init.OverageRequestTimeout,
+		failureThreshold: init.OverageFailureThreshold,
+		resetTimeout:     init.OverageBreakerResetTimeout,
+		failOpen:         init.OverageFailOpen,
+		now:              time.Now,
+		cache:            make(map[string]cachedOverages),
+	}
+}
+
+// get returns the overages for the user, from the cache if possible. If QMS
+// can't be reached then the configured fallback policy determines whether the
+// lookup fails or the user is treated as having no overages.
+func (o *overageChecker) get(ctx context.Context, username string) (*qms.OverageList, error) {
+	if overages, ok := o.cached(username); ok {
+		overageMetrics.Add("cache_hits", 1)
+		return overages, nil
+	}
+	overageMetrics.Add("cache_misses", 1)
+
+	if !o.allowRequest() {
+		overageMetrics.Add("breaker_rejections", 1)
+		return o.fallback(username, errOverageBreakerOpen)
+	}
+
+	overageMetrics.Add("requests", 1)
+	overages, err := o.fetchWithTimeout(ctx, username)
+	if err != nil {
+		overageMetrics.Add("failures", 1)
+		o.recordFailure()
+		return o.fallback(username, err)
+	}
+
+	o.recordSuccess(username, overages)
+	return overages, nil
+}
+
+// cached returns the cached overages for the user if they haven't expired.
+func (o *overageChecker) cached(username string) (*qms.OverageList, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, ok := o.cache[username]
+	if !ok || o.now().Sub(entry.fetchedAt) >= o.cacheTTL {
+		return nil, false
+	}
+	return entry.overages, true
+}
+
+// allowRequest returns false if the circuit breaker is open. Once the reset
+// timeout has passed a single trial request is let through; if it fails then
+// the breaker stays open for another reset timeout.
+func (o *overageChecker) allowRequest() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.failureThreshold <= 0 || o.failures < o.failureThreshold {
+		return true
+	}
+
+	if o.now().Sub(o.openedAt) >= o.resetTimeout {
+		o.openedAt = o.now()
+		return true
+	}
+
+	return false
+}
+
+func (o *overageChecker) recordFailure() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.failures++
+	if o.failureThreshold <= 0 || o.failures < o.failureThreshold {
+		return
+	}
+
+	if o.failures == o.failureThreshold {
+		log.Warnf("suspending QMS overage lookups for %s after %d failures", o.resetTimeout, o.failures)
+		overageMetrics.Add("breaker_trips", 1)
+	}
+	o.openedAt = o.now()
+}
+
+func (o *overageChecker) recordSuccess(username string, overages *qms.OverageList) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.failureThreshold > 0 && o.failures >= o.failureThreshold {
+		log.Info("resuming QMS overage lookups")
+	}
+	o.failures = 0
+
+	if o.cacheTTL <= 0 {
+		return
+	}
+
+	// Drop expired entries so that the cache doesn't grow without bound.
+	now := o.now()
+	for user, entry := range o.cache {
+		if now.Sub(entry.fetchedAt) >= o.cacheTTL {
+			delete(o.cache, user)
+		}
+	}
+	o.cache[username] = cachedOverages{overages: overages, fetchedAt: now}
+}
+
+// fetchWithTimeout calls the fetcher with a context that's cancelled after the
+// request timeout, so that the request is abandoned rather than left running.
+func (o *overageChecker) fetchWithTimeout(ctx context.Context, username string) (*qms.OverageList, error) {
+	if o.requestTimeout <= 0 {
+		return o.fetch(ctx, username)
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, o.requestTimeout)
+	defer cancel()
+
+	overages, err := o.fetch(fetchCtx, username)
+	if err != nil && ctx.Err() == nil && fetchCtx.Err() == context.DeadlineExceeded {
+		overageMetrics.Add("timeouts", 1)
+		return nil, errors.Errorf("timed out after %s waiting for the QMS overages for %s", o.requestTimeout, username)
+	}
+	return overages, err
+}
+
+// fallback applies the fail-open or fail-closed policy after a failed lookup.
+func (o *overageChecker) fallback(username string, err error) (*qms.OverageList, error) {
+	if o.failOpen {
+		overageMetrics.Add("fallback_open", 1)
+		log.Warnf("ignoring resource overages for %s: %s", username, err)
+		return nil, nil
+	}
+
+	overageMetrics.Add("fallback_closed", 1)
+	return nil, err
+}
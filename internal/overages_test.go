@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOverages is an overage fetcher that counts the number of requests made
+// and fails while its err field is set.
+type fakeOverages struct {
+	mu       sync.Mutex
+	requests int
+	err      error
+	delay    time.Duration
+}
+
+func (f *fakeOverages) fetch(ctx context.Context, _ string) (*qms.OverageList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &qms.OverageList{
+		Overages: []*qms.Overage{{ResourceName: "cpu.hours", Quota: 10, Usage: 20}},
+	}, nil
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func newTestOverageChecker(fake *fakeOverages, clock *fakeClock, failOpen bool) *overageChecker {
+	checker := newOverageChecker(&Init{
+		OverageCacheTTL:            time.Minute,
+		OverageFailureThreshold:    2,
+		OverageBreakerResetTimeout: time.Minute,
+		OverageFailOpen:            failOpen,
+	}, fake.fetch)
+	checker.now = clock.now
+	return checker
+}
+
+func TestOverageCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	fake := &fakeOverages{}
+	clock := &fakeClock{current: time.Now()}
+	checker := newTestOverageChecker(fake, clock, false)
+
+	overages, err := checker.get(ctx, "ipcdev")
+	assert.NoError(err)
+	assert.Len(overages.Overages, 1)
+
+	// The second lookup should come from the cache.
+	_, err = checker.get(ctx, "ipcdev")
+	assert.NoError(err)
+	assert.Equal(1, fake.requests)
+
+	// Other users aren't cached yet.
+	_, err = checker.get(ctx, "other")
+	assert.NoError(err)
+	assert.Equal(2, fake.requests)
+
+	// Expired entries are looked up again.
+	clock.advance(time.Minute)
+	_, err = checker.get(ctx, "ipcdev")
+	assert.NoError(err)
+	assert.Equal(3, fake.requests)
+}
+
+func TestOverageCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	fake := &fakeOverages{err: errors.New("qms is down")}
+	clock := &fakeClock{current: time.Now()}
+	checker := newTestOverageChecker(fake, clock, false)
+
+	// Failures are returned until the breaker trips.
+	for i := 0; i < 2; i++ {
+		_, err := checker.get(ctx, "ipcdev")
+		assert.Equal(fake.err, err)
+	}
+	assert.Equal(2, fake.requests)
+
+	// QMS isn't contacted while the breaker is open.
+	_, err := checker.get(ctx, "ipcdev")
+	assert.Equal(errOverageBreakerOpen, err)
+	assert.Equal(2, fake.requests)
+
+	// A failed trial request keeps the breaker open.
+	clock.advance(time.Minute)
+	_, err = checker.get(ctx, "ipcdev")
+	assert.Equal(fake.err, err)
+	assert.Equal(3, fake.requests)
+	_, err = checker.get(ctx, "ipcdev")
+	assert.Equal(errOverageBreakerOpen, err)
+	assert.Equal(3, fake.requests)
+
+	// A successful trial request closes the breaker again.
+	clock.advance(time.Minute)
+	fake.err = nil
+	_, err = checker.get(ctx, "ipcdev")
+	assert.NoError(err)
+	assert.Equal(4, fake.requests)
+	_, err = checker.get(ctx, "other")
+	assert.NoError(err)
+	assert.Equal(5, fake.requests)
+}
+
+func TestOverageFailOpen(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	fake := &fakeOverages{err: errors.New("qms is down")}
+	clock := &fakeClock{current: time.Now()}
+	checker := newTestOverageChecker(fake, clock, true)
+
+	for i := 0; i < 3; i++ {
+		overages, err := checker.get(ctx, "ipcdev")
+		assert.NoError(err)
+		assert.Nil(overages)
+	}
+	assert.Equal(2, fake.requests)
+}
+
+func TestOverageTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := &fakeOverages{delay: 100 * time.Millisecond}
+	checker := newOverageChecker(&Init{OverageRequestTimeout: 10 * time.Millisecond}, fake.fetch)
+
+	_, err := checker.get(context.Background(), "ipcdev")
+	assert.Error(err)
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Reasons used by the kubelet and scheduler for the problems that the pod
+// watcher reports.
+const (
+	crashLoopBackOffReason = "CrashLoopBackOff"
+	oomKilledReason        = "OOMKilled"
+	imagePullBackOffReason = "ImagePullBackOff"
+	errImagePullReason     = "ErrImagePull"
+	unschedulableReason    = "Unschedulable"
+	evictedReason          = "Evicted"
+)
+
+// podProblem describes something wrong with a VICE pod that the user should
+// know about.
+type podProblem struct {
+	Reason    string
+	Container string
+	Restarts  int32
+	Message   string
+}
+
+// key identifies the problem so that it's only reported once. The restart
+// count is included so that each new crash is reported.
+func (p *podProblem) key() string {
+	return fmt.Sprintf("%s/%s/%d", p.Reason, p.Container, p.Restarts)
+}
+
+// restartsExhausted returns true if the problem is a container that keeps
+// crashing and it has restarted at least limit times. A zero limit means the
+// analysis is never failed because of restarts.
+func (p *podProblem) restartsExhausted(limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	if p.Reason != crashLoopBackOffReason && p.Reason != oomKilledReason {
+		return false
+	}
+	return int(p.Restarts) >= limit
+}
+
+// classifyContainer returns the problem with a single container, if any.
+func classifyContainer(status *apiv1.ContainerStatus) *podProblem {
+	problem := &podProblem{
+		Container: status.Name,
+		Restarts:  status.RestartCount,
+	}
+
+	// Running out of memory is the most useful thing to tell the user about,
+	// even while the container is waiting to be restarted.
+	oomKilled := (status.State.Terminated != nil && status.State.Terminated.Reason == oomKilledReason) ||
+		(status.LastTerminationState.Terminated != nil && status.LastTerminationState.Terminated.Reason == oomKilledReason)
+	if oomKilled {
+		problem.Reason = oomKilledReason
+		problem.Message = fmt.Sprintf("the %s container ran out of memory and was stopped (%d restarts)", status.Name, status.RestartCount)
+		return problem
+	}
+
+	if status.State.Waiting == nil {
+		return nil
+	}
+
+	switch status.State.Waiting.Reason {
+	case crashLoopBackOffReason:
+		problem.Reason = crashLoopBackOffReason
+		problem.Message = fmt.Sprintf("the %s container keeps crashing (%d restarts)", status.Name, status.RestartCount)
+		if last := status.LastTerminationState.Terminated; last != nil {
+			problem.Message = fmt.Sprintf("%s; it last exited with code %d", problem.Message, last.ExitCode)
+		}
+	case imagePullBackOffReason, errImagePullReason:
+		problem.Reason = imagePullBackOffReason
+		problem.Message = fmt.Sprintf("the image for the %s container could not be pulled: %s", status.Name, status.State.Waiting.Message)
+	default:
+		return nil
+	}
+
+	return problem
+}
+
+// classifyPod returns the most important problem with the pod, or nil if
+// nothing appears to be wrong.
+func classifyPod(pod *apiv1.Pod) *podProblem {
+	if pod.Status.Phase == apiv1.PodFailed && pod.Status.Reason == evictedReason {
+		return &podProblem{
+			Reason:  evictedReason,
+			Message: fmt.Sprintf("the analysis was evicted from its node: %s", pod.Status.Message),
+		}
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionFalse && condition.Reason == unschedulableReason {
+			return &podProblem{
+				Reason:  unschedulableReason,
+				Message: fmt.Sprintf("the analysis can't be scheduled yet: %s", condition.Message),
+			}
+		}
+	}
+
+	statuses := append(append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for idx := range statuses {
+		if problem := classifyContainer(&statuses[idx]); problem != nil {
+			return problem
+		}
+	}
+
+	return nil
+}
+
+// problemReportedAnnotation records the key of the last problem reported for a
+// pod, so that a replica that takes over as the leader doesn't report it again.
+const problemReportedAnnotation = "problem-reported"
+
+// podWatcher reports problems with VICE pods through the status publisher.
+// Each problem is only reported once per pod. The problems that have been
+// reported are remembered in memory and in an annotation on the pod, which is
+// all that survives a change of leader. Analyses that were being failed when
+// the leader changed may have their failure reported again.
+type podWatcher struct {
+	internal    *Internal
+	maxRestarts int
+
+	mu       sync.Mutex
+	reported map[types.UID]string
+	failed   map[string]bool
+}
+
+func newPodWatcher(i *Internal) *podWatcher {
+	return &podWatcher{
+		internal:    i,
+		maxRestarts: i.PodMaxRestarts,
+		reported:    make(map[types.UID]string),
+		failed:      make(map[string]bool),
+	}
+}
+
+// shouldReport records the problem for the pod and returns true if it hasn't
+// been reported already, either by this replica or by the previous leader.
+func (w *podWatcher) shouldReport(pod *apiv1.Pod, problem *podProblem) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := problem.key()
+	if w.reported[pod.UID] == key || pod.Annotations[problemReportedAnnotation] == key {
+		return false
+	}
+	w.reported[pod.UID] = key
+	return true
+}
+
+// recordReported stores the key of the problem in the pod's annotations.
+func (w *podWatcher) recordReported(ctx context.Context, pod *apiv1.Pod, problem *podProblem) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				problemReportedAnnotation: problem.key(),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.internal.clientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "unable to record the problem reported for pod %s", pod.Name)
+}
+
+// shouldFail returns true the first time it's called for an analysis.
+func (w *podWatcher) shouldFail(externalID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed[externalID] {
+		return false
+	}
+	w.failed[externalID] = true
+	return true
+}
+
+// forget drops everything remembered about a pod once it has been deleted.
+func (w *podWatcher) forget(pod *apiv1.Pod) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.reported, pod.UID)
+	if externalID := pod.Labels["external-id"]; externalID != "" {
+		delete(w.failed, externalID)
+	}
+}
+
+// deletedPod returns the pod passed to an informer's DeleteFunc, which is
+// wrapped in a tombstone if the deletion was only noticed after relisting.
+func deletedPod(obj interface{}) (*apiv1.Pod, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*apiv1.Pod)
+	return pod, ok
+}
+
+// handle checks the pod for problems and reports any new ones. Analyses with
+// containers that have restarted too many times are failed and exited.
+func (w *podWatcher) handle(ctx context.Context, pod *apiv1.Pod) {
+	externalID := pod.Labels["external-id"]
+	if externalID == "" {
+		return
+	}
+
+	problem := classifyPod(pod)
+	if problem == nil || !w.shouldReport(pod, problem) {
+		return
+	}
+
+	log.Warnf("pod %s for analysis %s: %s", pod.Name, externalID, problem.Message)
+
+	if err := w.recordReported(ctx, pod, problem); err != nil {
+		log.Error(err)
+	}
+
+	if problem.restartsExhausted(w.maxRestarts) {
+		if !w.shouldFail(externalID) {
+			return
+		}
+
+		msg := fmt.Sprintf("%s; giving up after %d restarts", problem.Message, problem.Restarts)
+		if err := w.internal.statusPublisher.Fail(ctx, externalID, msg); err != nil {
+			log.Error(err)
+		}
+		if err := w.internal.doExit(ctx, externalID); err != nil {
+			log.Error(errors.Wrapf(err, "unable to exit analysis %s after repeated restarts", externalID))
+		}
+		return
+	}
+
+	if err := w.internal.statusPublisher.Running(ctx, externalID, problem.Message); err != nil {
+		log.Error(err)
+	}
+}
+
+// WatchPods reports crashes, OOM kills, image pull failures, scheduling
+// problems and evictions for VICE pods until the context is canceled. It's
+// meant to be run by a single replica at a time.
+func (i *Internal) WatchPods(ctx context.Context) {
+	watcher := newPodWatcher(i)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		i.clientset,
+		0,
+		informers.WithNamespace(i.ViceNamespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = "app-type=interactive"
+		}),
+	)
+
+	informer := factory.Core().V1().Pods().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*apiv1.Pod); ok {
+				watcher.handle(ctx, pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*apiv1.Pod); ok {
+				watcher.handle(ctx, pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if pod, ok := deletedPod(obj); ok {
+				watcher.forget(pod)
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+}
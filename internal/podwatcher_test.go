@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchedPod returns a VICE pod with the given status.
+func watchedPod(status apiv1.PodStatus) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "pod",
+			Namespace: "vice-apps",
+			UID:       "pod-uid",
+			Labels: map[string]string{
+				"app-type":    "interactive",
+				"external-id": "external-id",
+			},
+		},
+		Status: status,
+	}
+}
+
+// crashingStatus returns the status of a pod whose analysis container keeps
+// crashing for the given reason.
+func crashingStatus(reason string, restarts int32) apiv1.PodStatus {
+	return apiv1.PodStatus{
+		Phase: apiv1.PodRunning,
+		ContainerStatuses: []apiv1.ContainerStatus{
+			{
+				Name:         analysisContainerName,
+				RestartCount: restarts,
+				State: apiv1.ContainerState{
+					Waiting: &apiv1.ContainerStateWaiting{Reason: crashLoopBackOffReason},
+				},
+				LastTerminationState: apiv1.ContainerState{
+					Terminated: &apiv1.ContainerStateTerminated{Reason: reason, ExitCode: 137},
+				},
+			},
+		},
+	}
+}
+
+func TestClassifyPod(t *testing.T) {
+	tests := []struct {
+		description string
+		status      apiv1.PodStatus
+		reason      string
+	}{
+		{
+			description: "healthy",
+			status: apiv1.PodStatus{
+				Phase: apiv1.PodRunning,
+				ContainerStatuses: []apiv1.ContainerStatus{
+					{Name: analysisContainerName, State: apiv1.ContainerState{Running: &apiv1.ContainerStateRunning{}}},
+				},
+			},
+			reason: "",
+		},
+		{
+			description: "crash loop",
+			status:      crashingStatus("Error", 3),
+			reason:      crashLoopBackOffReason,
+		},
+		{
+			description: "out of memory",
+			status:      crashingStatus(oomKilledReason, 3),
+			reason:      oomKilledReason,
+		},
+		{
+			description: "image pull failure",
+			status: apiv1.PodStatus{
+				Phase: apiv1.PodPending,
+				InitContainerStatuses: []apiv1.ContainerStatus{
+					{
+						Name: fileTransfersInitContainerName,
+						State: apiv1.ContainerState{
+							Waiting: &apiv1.ContainerStateWaiting{Reason: errImagePullReason, Message: "not found"},
+						},
+					},
+				},
+			},
+			reason: imagePullBackOffReason,
+		},
+		{
+			description: "unschedulable",
+			status: apiv1.PodStatus{
+				Phase: apiv1.PodPending,
+				Conditions: []apiv1.PodCondition{
+					{
+						Type:    apiv1.PodScheduled,
+						Status:  apiv1.ConditionFalse,
+						Reason:  unschedulableReason,
+						Message: "0/3 nodes are available: 3 Insufficient nvidia.com/gpu.",
+					},
+				},
+			},
+			reason: unschedulableReason,
+		},
+		{
+			description: "evicted",
+			status: apiv1.PodStatus{
+				Phase:   apiv1.PodFailed,
+				Reason:  evictedReason,
+				Message: "The node was low on resource: ephemeral-storage.",
+			},
+			reason: evictedReason,
+		},
+	}
+
+	for _, test := range tests {
+		problem := classifyPod(watchedPod(test.status))
+		if test.reason == "" {
+			assert.Nil(t, problem, test.description)
+			continue
+		}
+		if assert.NotNil(t, problem, test.description) {
+			assert.Equal(t, test.reason, problem.Reason, test.description)
+			assert.NotEmpty(t, problem.Message, test.description)
+		}
+	}
+}
+
+func TestPodWatcherReportsOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+	watcher := newPodWatcher(internal)
+	ctx := context.Background()
+
+	watcher.handle(ctx, watchedPod(crashingStatus(oomKilledReason, 1)))
+	watcher.handle(ctx, watchedPod(crashingStatus(oomKilledReason, 1)))
+	watcher.handle(ctx, watchedPod(crashingStatus(oomKilledReason, 2)))
+
+	if assert.Len(publisher.published, 2) {
+		assert.Equal("Running", publisher.published[0].state)
+		assert.Equal("external-id", publisher.published[0].jobID)
+		assert.Contains(publisher.published[0].msg, "ran out of memory")
+	}
+}
+
+func TestPodWatcherRemembersReportsAcrossLeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := watchedPod(crashingStatus(oomKilledReason, 1))
+	internal, _ := setupInternal(t, []runtime.Object{pod})
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+	ctx := context.Background()
+
+	newPodWatcher(internal).handle(ctx, pod)
+
+	updated, err := internal.clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, meta_v1.GetOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(classifyPod(pod).key(), updated.Annotations[problemReportedAnnotation])
+
+	// The next leader starts with a new watcher and sees the annotation.
+	newPodWatcher(internal).handle(ctx, updated)
+	assert.Len(publisher.published, 1)
+}
+
+func TestPodWatcherFailsAfterRestarts(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive"})
+	internal, _ := setupInternal(t, []runtime.Object{deployment})
+	internal.PodMaxRestarts = 3
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+	watcher := newPodWatcher(internal)
+	ctx := context.Background()
+
+	watcher.handle(ctx, watchedPod(crashingStatus("Error", 2)))
+	watcher.handle(ctx, watchedPod(crashingStatus("Error", 3)))
+	watcher.handle(ctx, watchedPod(crashingStatus("Error", 4)))
+
+	if assert.Len(publisher.published, 2) {
+		assert.Equal("Running", publisher.published[0].state)
+		assert.Equal("Failed", publisher.published[1].state)
+	}
+
+	deployments, err := internal.clientset.AppsV1().Deployments(internal.ViceNamespace).List(ctx, meta_v1.ListOptions{})
+	if assert.NoError(err) {
+		assert.Empty(deployments.Items)
+	}
+}
+
+func TestPodWatcherForget(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	watcher := newPodWatcher(internal)
+	pod := watchedPod(crashingStatus(oomKilledReason, 1))
+
+	assert.True(watcher.shouldReport(pod, classifyPod(pod)))
+	assert.True(watcher.shouldFail("external-id"))
+
+	watcher.forget(pod)
+	assert.Empty(watcher.reported)
+	assert.Empty(watcher.failed)
+}
+
+func TestDeletedPod(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := watchedPod(apiv1.PodStatus{})
+
+	deleted, ok := deletedPod(pod)
+	assert.True(ok)
+	assert.Equal(pod, deleted)
+
+	deleted, ok = deletedPod(cache.DeletedFinalStateUnknown{Key: "vice-apps/pod", Obj: pod})
+	assert.True(ok)
+	assert.Equal(pod, deleted)
+
+	_, ok = deletedPod(cache.DeletedFinalStateUnknown{Key: "vice-apps/pod"})
+	assert.False(ok)
+}
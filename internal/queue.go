@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueuedLaunch is a VICE analysis launch that was deferred because the user
+// had already reached their concurrent job limit when it was submitted.
+type QueuedLaunch struct {
+	ID           string    `json:"id" db:"id"`
+	UserID       string    `json:"user_id" db:"user_id"`
+	ExternalID   string    `json:"external_id" db:"external_id"`
+	Position     int       `json:"position" db:"position"`
+	QueuedOn     time.Time `json:"queued_on" db:"queued_on"`
+	Job          []byte    `json:"-" db:"job"`
+	AnalysisName string    `json:"analysis_name" db:"-"`
+	AppID        string    `json:"app_id" db:"-"`
+	AppName      string    `json:"app_name" db:"-"`
+}
+
+// job returns the job submission stored for the queued launch.
+func (q *QueuedLaunch) job() (*model.Job, error) {
+	job := &model.Job{}
+	if err := json.Unmarshal(q.Job, job); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the job stored for queued launch %s", q.ID)
+	}
+	return job, nil
+}
+
+// populateJobInfo copies the fields that callers care about out of the stored
+// job submission so that they're included in the JSON returned to callers.
+func (q *QueuedLaunch) populateJobInfo() error {
+	job, err := q.job()
+	if err != nil {
+		return err
+	}
+	q.AnalysisName = job.Name
+	q.AppID = job.AppID
+	q.AppName = job.AppName
+	return nil
+}
+
+const enqueueLaunchSQL = `
+	INSERT INTO vice_launch_queue (user_id, external_id, job, position)
+	SELECT $1, $2, $3, COALESCE(MAX(position), 0) + 1
+	  FROM vice_launch_queue
+	 WHERE user_id = $1
+ RETURNING id, user_id, external_id, job, position, queued_on
+`
+
+// enqueueLaunch stores the job at the end of the user's launch queue.
+func (i *Internal) enqueueLaunch(ctx context.Context, job *model.Job) (*QueuedLaunch, error) {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := &QueuedLaunch{}
+	if err = i.db.QueryRowxContext(ctx, enqueueLaunchSQL, job.UserID, job.InvocationID, jobJSON).StructScan(queued); err != nil {
+		return nil, errors.Wrapf(err, "unable to queue the launch of %s", job.InvocationID)
+	}
+
+	if err = queued.populateJobInfo(); err != nil {
+		return nil, err
+	}
+
+	msg := fmt.Sprintf("%s is running the maximum number of concurrent jobs; the launch has been queued", job.Submitter)
+	if err = i.statusPublisher.Queued(ctx, job.InvocationID, msg); err != nil {
+		log.Error(err)
+	}
+
+	return queued, nil
+}
+
+const listQueuedLaunchesSQL = `
+	SELECT id, user_id, external_id, job, position, queued_on
+	  FROM vice_launch_queue
+	 WHERE user_id = $1
+  ORDER BY position
+`
+
+// listQueuedLaunches returns the queued launches for a user in the order in
+// which they'll be started.
+func (i *Internal) listQueuedLaunches(ctx context.Context, userID string) ([]QueuedLaunch, error) {
+	queued := []QueuedLaunch{}
+	if err := i.db.SelectContext(ctx, &queued, listQueuedLaunchesSQL, userID); err != nil {
+		return nil, err
+	}
+
+	for idx := range queued {
+		if err := queued[idx].populateJobInfo(); err != nil {
+			return nil, err
+		}
+	}
+
+	return queued, nil
+}
+
+const cancelQueuedLaunchSQL = `
+	DELETE FROM vice_launch_queue
+	 WHERE id = $1
+	   AND user_id = $2
+ RETURNING external_id
+`
+
+// cancelQueuedLaunch removes a launch from the user's queue and marks the
+// analysis as failed, since it's never going to run.
+func (i *Internal) cancelQueuedLaunch(ctx context.Context, userID, id string) error {
+	var externalID string
+	if err := i.db.QueryRowContext(ctx, cancelQueuedLaunchSQL, id, userID).Scan(&externalID); err != nil {
+		return err
+	}
+
+	if err := i.statusPublisher.Fail(ctx, externalID, "the queued launch was canceled"); err != nil {
+		log.Error(err)
+	}
+
+	return nil
+}
+
+const updateQueuePositionSQL = `
+	UPDATE vice_launch_queue
+	   SET position = $3
+	 WHERE id = $1
+	   AND user_id = $2
+`
+
+// reorderQueuedLaunches sets the order of the user's queued launches to match
+// the order of the IDs passed in. Every queued launch must be listed exactly once.
+func (i *Internal) reorderQueuedLaunches(ctx context.Context, userID string, ids []string) error {
+	tx, err := i.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	existing := []QueuedLaunch{}
+	if err = tx.SelectContext(ctx, &existing, listQueuedLaunchesSQL, userID); err != nil {
+		return err
+	}
+
+	if err = validateQueueOrder(existing, ids); err != nil {
+		return err
+	}
+
+	for idx, id := range ids {
+		if _, err = tx.ExecContext(ctx, updateQueuePositionSQL, id, userID, idx+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// validateQueueOrder makes sure that a new ordering for a queue contains each
+// of the queued launches exactly once.
+func validateQueueOrder(existing []QueuedLaunch, ids []string) error {
+	if len(existing) != len(ids) {
+		return common.BadRequest(fmt.Sprintf("expected %d queued launch IDs, got %d", len(existing), len(ids)))
+	}
+
+	queued := map[string]bool{}
+	for _, q := range existing {
+		queued[q.ID] = true
+	}
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !queued[id] {
+			return common.BadRequest(fmt.Sprintf("%s is not a queued launch", id))
+		}
+		if seen[id] {
+			return common.BadRequest(fmt.Sprintf("%s is listed more than once", id))
+		}
+		seen[id] = true
+	}
+
+	return nil
+}
+
+const nextQueuedLaunchSQL = `
+	SELECT id, user_id, external_id, job, position, queued_on
+	  FROM vice_launch_queue
+	 WHERE user_id = $1
+  ORDER BY position
+	 LIMIT 1
+	   FOR UPDATE SKIP LOCKED
+`
+
+const deleteQueuedLaunchSQL = `
+	DELETE FROM vice_launch_queue WHERE id = $1
+`
+
+// launchNextQueued attempts to start the next queued launch for the user. The
+// returned boolean is true if a queued launch was removed from the queue, in
+// which case it's worth calling this function again. The queue entry is locked
+// while the job is validated so that multiple replicas don't start the same
+// launch.
+func (i *Internal) launchNextQueued(ctx context.Context, userID string) (bool, error) {
+	tx, err := i.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	queued := &QueuedLaunch{}
+	if err = tx.QueryRowxContext(ctx, nextQueuedLaunchSQL, userID).StructScan(queued); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	job, err := queued.job()
+	if err != nil {
+		return false, err
+	}
+
+	_, validationErr := i.validateJob(ctx, job)
+	if isLimitReached(validationErr) {
+		log.Infof("%s is still at a job limit; leaving %s in the queue", job.Submitter, job.InvocationID)
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteQueuedLaunchSQL, queued.ID); err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	// The job can no longer be launched for some other reason, so it's been
+	// dropped from the queue.
+	if validationErr != nil {
+		msg := fmt.Sprintf("unable to launch queued analysis: %s", validationErr.Error())
+		if failErr := i.statusPublisher.Fail(ctx, job.InvocationID, msg); failErr != nil {
+			log.Error(failErr)
+		}
+		return true, errors.Wrapf(validationErr, "dropped queued launch %s", job.InvocationID)
+	}
+
+	log.Infof("launching queued analysis %s for user %s", job.InvocationID, job.Submitter)
+
+	return true, i.launch(ctx, job)
+}
+
+// drainLaunchQueue starts queued launches for the user until either the queue
+// is empty or the user is at their job limit again. It's meant to be run in a
+// goroutine after one of the user's analyses exits.
+func (i *Internal) drainLaunchQueue(ctx context.Context, userID string) {
+	separatedSpanContext := trace.SpanContextFromContext(ctx)
+	outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
+	ctx, span := otel.Tracer(otelName).Start(outerCtx, "drainLaunchQueue")
+	defer span.End()
+
+	for {
+		launched, err := i.launchNextQueued(ctx, userID)
+		if err != nil {
+			log.Error(err)
+		}
+		if !launched {
+			return
+		}
+	}
+}
+
+// QueuedLaunchesHandler lists the launches that are waiting for the user to
+// drop below their concurrent job limit.
+func (i *Internal) QueuedLaunchesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := i.userIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	queued, err := i.listQueuedLaunches(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]QueuedLaunch{
+		"launches": queued,
+	})
+}
+
+// QueueOrder is the request body for reordering a user's queued launches.
+type QueueOrder struct {
+	IDs []string `json:"ids"`
+}
+
+// ReorderQueuedLaunchesHandler changes the order in which the user's queued
+// launches will be started. The request body must list the ID of every queued
+// launch for the user.
+func (i *Internal) ReorderQueuedLaunchesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	order := &QueueOrder{}
+	if err := c.Bind(order); err != nil {
+		return err
+	}
+
+	userID, err := i.userIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.reorderQueuedLaunches(ctx, userID, order.IDs); err != nil {
+		return err
+	}
+
+	queued, err := i.listQueuedLaunches(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]QueuedLaunch{
+		"launches": queued,
+	})
+}
+
+// CancelQueuedLaunchHandler removes a launch from the user's queue.
+func (i *Internal) CancelQueuedLaunchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id := c.Param("queue-id")
+	if id == "" {
+		return common.BadRequest("queue-id parameter is empty")
+	}
+
+	userID, err := i.userIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.cancelQueuedLaunch(ctx, userID, id); err != nil {
+		if err == sql.ErrNoRows {
+			return common.NotFound(fmt.Sprintf("queued launch %s not found", id))
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+// publishedStatus is a status update recorded by recordingPublisher.
+type publishedStatus struct {
+	state string
+	jobID string
+	msg   string
+}
+
+// recordingPublisher is an AnalysisStatusPublisher that records status updates
+// instead of sending them anywhere.
+type recordingPublisher struct {
+	published []publishedStatus
+}
+
+func (r *recordingPublisher) record(state, jobID, msg string) error {
+	r.published = append(r.published, publishedStatus{state: state, jobID: jobID, msg: msg})
+	return nil
+}
+
+func (r *recordingPublisher) Fail(ctx context.Context, jobID, msg string) error {
+	return r.record("Failed", jobID, msg)
+}
+
+func (r *recordingPublisher) Success(ctx context.Context, jobID, msg string) error {
+	return r.record("Completed", jobID, msg)
+}
+
+func (r *recordingPublisher) Running(ctx context.Context, jobID, msg string) error {
+	return r.record("Running", jobID, msg)
+}
+
+func (r *recordingPublisher) Queued(ctx context.Context, jobID, msg string) error {
+	return r.record("Queued", jobID, msg)
+}
+
+// queuedJobJSON returns the JSON that would be stored for a queued job.
+func queuedJobJSON(t *testing.T, externalID string) []byte {
+	job := &model.Job{
+		InvocationID: externalID,
+		Name:         "analysis " + externalID,
+		AppID:        "app-id",
+		AppName:      "app-name",
+	}
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unable to marshal the test job: %s", err)
+	}
+	return jobJSON
+}
+
+func queuedLaunchRows(t *testing.T, mock sqlmock.Sqlmock, ids ...string) *sqlmock.Rows {
+	rows := mock.NewRows([]string{"id", "user_id", "external_id", "job", "position", "queued_on"})
+	for idx, id := range ids {
+		externalID := "external-" + id
+		rows.AddRow(id, "user-id", externalID, queuedJobJSON(t, externalID), idx+1, time.Now())
+	}
+	return rows
+}
+
+func TestValidateQueueOrder(t *testing.T) {
+	existing := []QueuedLaunch{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+
+	tests := []struct {
+		name  string
+		ids   []string
+		valid bool
+	}{
+		{"same order", []string{"a", "b", "c"}, true},
+		{"new order", []string{"c", "a", "b"}, true},
+		{"missing ID", []string{"a", "b"}, false},
+		{"unknown ID", []string{"a", "b", "d"}, false},
+		{"duplicate ID", []string{"a", "a", "b"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateQueueOrder(existing, test.ids)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestListQueuedLaunches(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	mock.ExpectQuery("SELECT id, user_id, external_id, job, position, queued_on FROM vice_launch_queue").
+		WithArgs("user-id").
+		WillReturnRows(queuedLaunchRows(t, mock, "a", "b"))
+
+	queued, err := internal.listQueuedLaunches(context.Background(), "user-id")
+	assert.NoError(err)
+	assert.Len(queued, 2)
+	assert.Equal("a", queued[0].ID)
+	assert.Equal(1, queued[0].Position)
+	assert.Equal("analysis external-a", queued[0].AnalysisName)
+	assert.Equal("app-name", queued[0].AppName)
+	assert.Equal("b", queued[1].ID)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCancelQueuedLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	mock.ExpectQuery("DELETE FROM vice_launch_queue").
+		WithArgs("a", "user-id").
+		WillReturnRows(mock.NewRows([]string{"external_id"}).AddRow("external-a"))
+
+	err := internal.cancelQueuedLaunch(context.Background(), "user-id", "a")
+	assert.NoError(err)
+	assert.Len(publisher.published, 1)
+	assert.Equal("Failed", publisher.published[0].state)
+	assert.Equal("external-a", publisher.published[0].jobID)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCancelQueuedLaunchNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	mock.ExpectQuery("DELETE FROM vice_launch_queue").
+		WithArgs("a", "user-id").
+		WillReturnRows(mock.NewRows([]string{"external_id"}))
+
+	err := internal.cancelQueuedLaunch(context.Background(), "user-id", "a")
+	assert.Equal(sql.ErrNoRows, err)
+	assert.Empty(publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestReorderQueuedLaunches(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, user_id, external_id, job, position, queued_on FROM vice_launch_queue").
+		WithArgs("user-id").
+		WillReturnRows(queuedLaunchRows(t, mock, "a", "b"))
+	mock.ExpectExec("UPDATE vice_launch_queue").
+		WithArgs("b", "user-id", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_launch_queue").
+		WithArgs("a", "user-id", 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := internal.reorderQueuedLaunches(context.Background(), "user-id", []string{"b", "a"})
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestReorderQueuedLaunchesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, user_id, external_id, job, position, queued_on FROM vice_launch_queue").
+		WithArgs("user-id").
+		WillReturnRows(queuedLaunchRows(t, mock, "a", "b"))
+	mock.ExpectRollback()
+
+	err := internal.reorderQueuedLaunches(context.Background(), "user-id", []string{"b"})
+	assert.Error(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestIsLimitReached(t *testing.T) {
+	assert := assert.New(t)
+
+	limit := 2
+	assert.True(isLimitReached(expectedLimitError("ipcdev", 2, 2, nil)))
+	assert.True(isLimitReached(expectedLimitError("ipcdev", 2, 2, &limit)))
+	assert.False(isLimitReached(expectedLimitError("ipcdev", 0, 0, nil)))
+	assert.False(isLimitReached(sql.ErrNoRows))
+	assert.False(isLimitReached(nil))
+}
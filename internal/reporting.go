@@ -9,7 +9,7 @@ import (
 	"strings"
 
 	"github.com/cyverse-de/app-exposer/apps"
-	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/apps/v1"
@@ -552,7 +552,7 @@ func (i *Internal) AdminDescribeAnalysisHandler(c echo.Context) error {
 
 	listing, err := i.doResourceListing(ctx, filter)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return common.Internal(err.Error())
 	}
 	return c.JSON(http.StatusOK, listing)
 
@@ -566,7 +566,7 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 	log.Info("in DescribeAnalysisHandler")
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+		return common.BadRequest("user query parameter must be set")
 	}
 
 	// Since some usernames don't come through the labelling process unscathed, we have to use
@@ -575,7 +575,7 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 	_, err := i.apps.GetUserID(ctx, fixedUser)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", fixedUser))
+			return common.NotFound(fmt.Sprintf("user %s not found", fixedUser))
 		}
 		return err
 	}
@@ -603,18 +603,9 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 		}
 
 		// Make sure the user has permissions to look up info about this analysis.
-		p := &permissions.Permissions{
-			BaseURL: i.PermissionsURL,
-		}
-
-		allowed, err := p.IsAllowed(ctx, user, analysisID)
-		if err != nil {
+		if err = i.checkAnalysisAccess(ctx, user, analysisID, viewAnalysis); err != nil {
 			return err
 		}
-
-		if !allowed {
-			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
-		}
 	}
 
 	return c.JSON(http.StatusOK, listing)
@@ -626,7 +617,7 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	user := c.QueryParam("user")
 	if user == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+		return common.BadRequest("user query parameter must be set")
 	}
 
 	// Since some usernames don't come through the labelling process unscathed, we have to use
@@ -635,9 +626,9 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 	userID, err := i.apps.GetUserID(ctx, user)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", user))
+			return common.NotFound(fmt.Sprintf("user %s not found", user))
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return common.Internal(err.Error())
 	}
 
 	filter := filterMap(c.Request().URL.Query())
@@ -649,7 +640,7 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 
 	listing, err := i.doResourceListing(ctx, filter)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return common.Internal(err.Error())
 	}
 
 	return c.JSON(http.StatusOK, listing)
@@ -663,7 +654,7 @@ func (i *Internal) AdminFilterableResourcesHandler(c echo.Context) error {
 
 	listing, err := i.doResourceListing(ctx, filter)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return common.Internal(err.Error())
 	}
 
 	return c.JSON(http.StatusOK, listing)
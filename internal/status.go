@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,6 +21,7 @@ type AnalysisStatusPublisher interface {
 	Fail(ctx context.Context, jobID, msg string) error
 	Success(ctx context.Context, jobID, msg string) error
 	Running(ctx context.Context, jobID, msg string) error
+	Queued(ctx context.Context, jobID, msg string) error
 }
 
 // JSLPublisher is a concrete implementation of AnalysisStatusPublisher that
@@ -36,11 +39,16 @@ type AnalysisStatus struct {
 }
 
 func (j *JSLPublisher) postStatus(ctx context.Context, jobID, msg string, jobState messaging.JobState) error {
-	status := &AnalysisStatus{
+	return j.sendStatus(ctx, jobID, &AnalysisStatus{
 		Host:    hostname(),
 		State:   jobState,
 		Message: msg,
-	}
+	})
+}
+
+// sendStatus posts a status update to job-status-listener.
+func (j *JSLPublisher) sendStatus(ctx context.Context, jobID string, status *AnalysisStatus) error {
+	jobState := status.State
 
 	u, err := url.Parse(j.statusURL)
 	if err != nil {
@@ -89,14 +97,14 @@ func (j *JSLPublisher) postStatus(ctx context.Context, jobID, msg string, jobSta
 	}
 	defer response.Body.Close()
 	if response.StatusCode < 200 || response.StatusCode > 399 {
-		return errors.Wrapf(
-			err,
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf(
 			"error status code %d returned after posting %s status for job %s to %s: %s",
 			response.StatusCode,
 			jobState,
 			jobID,
 			u.String(),
-			response.Body,
+			body,
 		)
 	}
 	return nil
@@ -124,6 +132,13 @@ func (j *JSLPublisher) Running(ctx context.Context, jobID, msg string) error {
 	return j.postStatus(ctx, jobID, msg, messaging.RunningState)
 }
 
+// Queued sends an analysis queued status update with the provided message. Used
+// when a launch is deferred until the user drops below their job limit.
+func (j *JSLPublisher) Queued(ctx context.Context, jobID, msg string) error {
+	log.Warnf("Sending queued job status update for external-id %s", jobID)
+	return j.postStatus(ctx, jobID, msg, messaging.QueuedState)
+}
+
 func hostname() string {
 	h, err := os.Hostname()
 	if err != nil {
@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	irodsStorageProvider = "irods"
+	nfsStorageProvider   = "nfs"
+	s3StorageProvider    = "s3"
+	pvcStorageProvider   = "pvc"
+)
+
+// StorageProvider makes data available to VICE analyses when mounted storage is
+// enabled with UseCSIDriver. The data is mounted at /data-store in the analysis
+// container and linked into the working directory. None of the methods call the
+// k8s API.
+//
+// Only the iRODS provider saves the analysis outputs to the data store. With
+// the other providers, whatever the analysis writes to the mounted storage
+// stays there and nothing is uploaded when the analysis exits.
+type StorageProvider interface {
+	// Name returns the name used to select the provider in the configuration.
+	Name() string
+
+	// PersistentVolumes returns the PersistentVolumes to create for the
+	// analysis, if any.
+	PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error)
+
+	// PersistentVolumeClaims returns the PersistentVolumeClaims to create for
+	// the analysis, if any.
+	PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error)
+
+	// Volumes returns the volumes to add to the analysis pod.
+	Volumes(job *model.Job) ([]*apiv1.Volume, error)
+
+	// VolumeMounts returns the mounts to add to the analysis container.
+	VolumeMounts(job *model.Job) []*apiv1.VolumeMount
+
+	// WorkingDirCommands returns the shell commands used to set up the working
+	// directory before the analysis starts.
+	WorkingDirCommands(job *model.Job) []string
+
+	// InputManifest lists where each input can be found in the analysis
+	// container. Providers that don't mount inputs return an empty list.
+	InputManifest(job *model.Job) ([]InputManifestEntry, error)
+}
+
+// IsStorageProvider returns true if name refers to one of the available
+// storage providers.
+func IsStorageProvider(name string) bool {
+	switch name {
+	case "", irodsStorageProvider, nfsStorageProvider, s3StorageProvider, pvcStorageProvider:
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidateStorageSettings checks that the settings needed by the selected
+// storage provider are present.
+func ValidateStorageSettings(init *Init) error {
+	switch init.StorageProviderName {
+	case nfsStorageProvider:
+		if init.NFSServer == "" || init.NFSPath == "" {
+			return fmt.Errorf("the NFS server and path must be configured to use NFS storage")
+		}
+	case s3StorageProvider:
+		if init.S3Driver == "" || init.S3Bucket == "" {
+			return fmt.Errorf("the S3 CSI driver and bucket must be configured to use S3 storage")
+		}
+	case pvcStorageProvider:
+		if init.StorageClaimName == "" {
+			return fmt.Errorf("the claim name must be configured to use an existing PersistentVolumeClaim")
+		}
+	}
+	return nil
+}
+
+// newStorageProvider returns the storage provider selected in the Init. The
+// iRODS CSI driver is used if no provider is selected.
+func newStorageProvider(i *Internal) StorageProvider {
+	switch i.StorageProviderName {
+	case nfsStorageProvider:
+		return &nfsStorage{
+			server:   i.NFSServer,
+			path:     i.NFSPath,
+			readOnly: i.NFSReadOnly,
+		}
+	case s3StorageProvider:
+		return &s3Storage{internal: i}
+	case pvcStorageProvider:
+		return &pvcStorage{
+			claimName: i.StorageClaimName,
+			readOnly:  i.StorageClaimReadOnly,
+		}
+	default:
+		return &irodsStorage{internal: i}
+	}
+}
+
+// dataStoreLinkCommand links the mounted data into the working directory.
+func dataStoreLinkCommand() string {
+	return fmt.Sprintf("ln -s \"%s\" \"data\"", csiDriverLocalMountPath)
+}
+
+const (
+	nfsVolumeName = "nfs-data"
+	pvcVolumeName = "pvc-data"
+)
+
+// nfsStorage mounts an NFS export directly in the analysis pod. Nothing needs
+// to be created in the cluster ahead of time.
+type nfsStorage struct {
+	server   string
+	path     string
+	readOnly bool
+}
+
+func (s *nfsStorage) Name() string {
+	return nfsStorageProvider
+}
+
+func (s *nfsStorage) PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	return nil, nil
+}
+
+func (s *nfsStorage) PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	return nil, nil
+}
+
+func (s *nfsStorage) Volumes(job *model.Job) ([]*apiv1.Volume, error) {
+	if s.server == "" || s.path == "" {
+		return nil, fmt.Errorf("the NFS server and path must be configured to use NFS storage")
+	}
+
+	return []*apiv1.Volume{
+		{
+			Name: nfsVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				NFS: &apiv1.NFSVolumeSource{
+					Server:   s.server,
+					Path:     s.path,
+					ReadOnly: s.readOnly,
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *nfsStorage) VolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	return []*apiv1.VolumeMount{
+		{
+			Name:      nfsVolumeName,
+			MountPath: csiDriverLocalMountPath,
+			ReadOnly:  s.readOnly,
+		},
+	}
+}
+
+func (s *nfsStorage) WorkingDirCommands(job *model.Job) []string {
+	return []string{dataStoreLinkCommand()}
+}
+
+func (s *nfsStorage) InputManifest(job *model.Job) ([]InputManifestEntry, error) {
+	return []InputManifestEntry{}, nil
+}
+
+// s3Storage mounts an S3-compatible bucket through a CSI driver. A
+// PersistentVolume and claim are created for each analysis, just as they are
+// for iRODS.
+type s3Storage struct {
+	internal *Internal
+}
+
+func (s *s3Storage) Name() string {
+	return s3StorageProvider
+}
+
+func (s *s3Storage) PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	i := s.internal
+
+	if i.S3Driver == "" || i.S3Bucket == "" {
+		return nil, fmt.Errorf("the S3 CSI driver and bucket must be configured to use S3 storage")
+	}
+
+	labels, err := i.getCSIDataVolumeLabels(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{}
+	for k, v := range i.S3VolumeAttributes {
+		attributes[k] = v
+	}
+
+	source := &apiv1.CSIPersistentVolumeSource{
+		Driver:           i.S3Driver,
+		VolumeHandle:     fmt.Sprintf("%s/%s", i.S3Bucket, i.getCSIDataVolumeHandle(job)),
+		ReadOnly:         i.S3ReadOnly,
+		VolumeAttributes: attributes,
+	}
+	source.VolumeAttributes["bucket"] = i.S3Bucket
+
+	// Credentials for the bucket are kept in a secret used by the driver.
+	if i.S3SecretName != "" {
+		secretRef := &apiv1.SecretReference{
+			Name:      i.S3SecretName,
+			Namespace: i.S3SecretNamespace,
+		}
+		source.NodePublishSecretRef = secretRef
+		source.NodeStageSecretRef = secretRef
+	}
+
+	volmode := apiv1.PersistentVolumeFilesystem
+	return []*apiv1.PersistentVolume{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   i.getCSIDataVolumeName(job),
+				Labels: labels,
+			},
+			Spec: apiv1.PersistentVolumeSpec{
+				Capacity: apiv1.ResourceList{
+					apiv1.ResourceStorage: i.getCSIVolumeCapacity(job),
+				},
+				VolumeMode: &volmode,
+				AccessModes: []apiv1.PersistentVolumeAccessMode{
+					apiv1.ReadWriteMany,
+				},
+				PersistentVolumeReclaimPolicy: apiv1.PersistentVolumeReclaimRetain,
+				StorageClassName:              i.S3StorageClass,
+				PersistentVolumeSource: apiv1.PersistentVolumeSource{
+					CSI: source,
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *s3Storage) PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	return s.internal.csiDataVolumeClaims(ctx, job, s.internal.S3StorageClass)
+}
+
+func (s *s3Storage) Volumes(job *model.Job) ([]*apiv1.Volume, error) {
+	return s.internal.csiDataVolumeSources(job), nil
+}
+
+func (s *s3Storage) VolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	return s.internal.csiDataVolumeMounts(job, s.internal.S3ReadOnly)
+}
+
+func (s *s3Storage) WorkingDirCommands(job *model.Job) []string {
+	return []string{dataStoreLinkCommand()}
+}
+
+func (s *s3Storage) InputManifest(job *model.Job) ([]InputManifestEntry, error) {
+	return []InputManifestEntry{}, nil
+}
+
+// pvcStorage mounts a PersistentVolumeClaim that already exists in the VICE
+// namespace. The claim is shared by every analysis, so it's never deleted.
+type pvcStorage struct {
+	claimName string
+	readOnly  bool
+}
+
+func (s *pvcStorage) Name() string {
+	return pvcStorageProvider
+}
+
+func (s *pvcStorage) PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	return nil, nil
+}
+
+func (s *pvcStorage) PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	return nil, nil
+}
+
+func (s *pvcStorage) Volumes(job *model.Job) ([]*apiv1.Volume, error) {
+	if s.claimName == "" {
+		return nil, fmt.Errorf("the claim name must be configured to use an existing PersistentVolumeClaim")
+	}
+
+	return []*apiv1.Volume{
+		{
+			Name: pvcVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+					ClaimName: s.claimName,
+					ReadOnly:  s.readOnly,
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *pvcStorage) VolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	return []*apiv1.VolumeMount{
+		{
+			Name:      pvcVolumeName,
+			MountPath: csiDriverLocalMountPath,
+			ReadOnly:  s.readOnly,
+		},
+	}
+}
+
+func (s *pvcStorage) WorkingDirCommands(job *model.Job) []string {
+	return []string{dataStoreLinkCommand()}
+}
+
+func (s *pvcStorage) InputManifest(job *model.Job) ([]InputManifestEntry, error) {
+	return []InputManifestEntry{}, nil
+}
+
+// inputManifestContents returns the JSON document listing where each of the
+// job's inputs is mounted.
+func (i *Internal) inputManifestContents(job *model.Job) ([]byte, error) {
+	entries, err := i.storage.InputManifest(job)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(entries, "", "  ")
+}
+
+// getPersistentVolumes returns the PersistentVolumes for the VICE analysis. It does
+// not call the k8s API.
+func (i *Internal) getPersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	if i.UseCSIDriver {
+		return i.storage.PersistentVolumes(ctx, job)
+	}
+
+	return nil, nil
+}
+
+// getPersistentVolumeClaims returns the PersistentVolumes for the VICE analysis. It does
+// not call the k8s API.
+func (i *Internal) getPersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	if i.UseCSIDriver {
+		return i.storage.PersistentVolumeClaims(ctx, job)
+	}
+
+	return nil, nil
+}
+
+// getPersistentVolumeSources returns the volumes for the VICE analysis. It does
+// not call the k8s API.
+func (i *Internal) getPersistentVolumeSources(job *model.Job) ([]*apiv1.Volume, error) {
+	if i.UseCSIDriver {
+		return i.storage.Volumes(job)
+	}
+
+	return nil, nil
+}
+
+// getPersistentVolumeMounts returns the volume mount for the VICE analysis. It does
+// not call the k8s API.
+func (i *Internal) getPersistentVolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	if i.UseCSIDriver {
+		return i.storage.VolumeMounts(job)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeStorage is a StorageProvider that mounts an emptyDir volume so that
+// deployments can be built without any storage configuration.
+type fakeStorage struct {
+	manifest []InputManifestEntry
+}
+
+func (s *fakeStorage) Name() string {
+	return "fake"
+}
+
+func (s *fakeStorage) PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	return []*apiv1.PersistentVolume{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "fake-" + job.InvocationID}},
+	}, nil
+}
+
+func (s *fakeStorage) PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	return []*apiv1.PersistentVolumeClaim{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "fake-" + job.InvocationID}},
+	}, nil
+}
+
+func (s *fakeStorage) Volumes(job *model.Job) ([]*apiv1.Volume, error) {
+	return []*apiv1.Volume{
+		{Name: "fake-data", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+	}, nil
+}
+
+func (s *fakeStorage) VolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	return []*apiv1.VolumeMount{{Name: "fake-data", MountPath: csiDriverLocalMountPath}}
+}
+
+func (s *fakeStorage) WorkingDirCommands(job *model.Job) []string {
+	return []string{"true"}
+}
+
+func (s *fakeStorage) InputManifest(job *model.Job) ([]InputManifestEntry, error) {
+	return s.manifest, nil
+}
+
+func TestNewStorageProvider(t *testing.T) {
+	for _, name := range []string{"", irodsStorageProvider, nfsStorageProvider, s3StorageProvider, pvcStorageProvider} {
+		assert.True(t, IsStorageProvider(name), name)
+
+		internal, _ := setupInternal(t, nil)
+		internal.StorageProviderName = name
+		provider := newStorageProvider(internal)
+
+		expected := name
+		if expected == "" {
+			expected = irodsStorageProvider
+		}
+		assert.Equal(t, expected, provider.Name())
+	}
+
+	assert.False(t, IsStorageProvider("ftp"))
+}
+
+func TestValidateStorageSettings(t *testing.T) {
+	tests := []struct {
+		description string
+		init        Init
+		valid       bool
+	}{
+		{"irods", Init{StorageProviderName: irodsStorageProvider}, true},
+		{"nfs", Init{StorageProviderName: nfsStorageProvider, NFSServer: "nfs.example.org", NFSPath: "/exports/data"}, true},
+		{"nfs without a path", Init{StorageProviderName: nfsStorageProvider, NFSServer: "nfs.example.org"}, false},
+		{"s3", Init{StorageProviderName: s3StorageProvider, S3Driver: "s3.csi.example.org", S3Bucket: "data"}, true},
+		{"s3 without a bucket", Init{StorageProviderName: s3StorageProvider, S3Driver: "s3.csi.example.org"}, false},
+		{"pvc", Init{StorageProviderName: pvcStorageProvider, StorageClaimName: "data"}, true},
+		{"pvc without a claim", Init{StorageProviderName: pvcStorageProvider}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateStorageSettings(&test.init)
+		if test.valid {
+			assert.NoError(t, err, test.description)
+		} else {
+			assert.Error(t, err, test.description)
+		}
+	}
+}
+
+func TestStorageProviderDelegation(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.storage = &fakeStorage{}
+	job := &model.Job{InvocationID: "invocation-id"}
+
+	// Nothing is mounted unless mounted storage is enabled.
+	volumes, err := internal.getPersistentVolumeSources(job)
+	assert.NoError(err)
+	assert.Empty(volumes)
+
+	internal.UseCSIDriver = true
+	volumes, err = internal.getPersistentVolumeSources(job)
+	if assert.NoError(err) && assert.Len(volumes, 1) {
+		assert.Equal("fake-data", volumes[0].Name)
+	}
+
+	mounts := internal.getPersistentVolumeMounts(job)
+	if assert.Len(mounts, 1) {
+		assert.Equal(csiDriverLocalMountPath, mounts[0].MountPath)
+	}
+
+	pvs, err := internal.getPersistentVolumes(context.Background(), job)
+	if assert.NoError(err) && assert.Len(pvs, 1) {
+		assert.Equal("fake-invocation-id", pvs[0].Name)
+	}
+}
+
+func TestNFSStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	storage := &nfsStorage{server: "nfs.example.org", path: "/exports/data", readOnly: true}
+	job := &model.Job{}
+
+	volumes, err := storage.Volumes(job)
+	if assert.NoError(err) && assert.Len(volumes, 1) {
+		assert.Equal("nfs.example.org", volumes[0].NFS.Server)
+		assert.Equal("/exports/data", volumes[0].NFS.Path)
+		assert.True(volumes[0].NFS.ReadOnly)
+	}
+
+	mounts := storage.VolumeMounts(job)
+	if assert.Len(mounts, 1) {
+		assert.Equal(nfsVolumeName, mounts[0].Name)
+		assert.True(mounts[0].ReadOnly)
+	}
+
+	_, err = (&nfsStorage{}).Volumes(job)
+	assert.Error(err, "the server and path are required")
+}
+
+func TestPVCStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	storage := &pvcStorage{claimName: "shared-data"}
+	job := &model.Job{}
+
+	volumes, err := storage.Volumes(job)
+	if assert.NoError(err) && assert.Len(volumes, 1) {
+		assert.Equal("shared-data", volumes[0].PersistentVolumeClaim.ClaimName)
+	}
+
+	// The claim is shared, so it must never be created or deleted per analysis.
+	claims, err := storage.PersistentVolumeClaims(context.Background(), job)
+	assert.NoError(err)
+	assert.Empty(claims)
+
+	_, err = (&pvcStorage{}).Volumes(job)
+	assert.Error(err, "the claim name is required")
+}
+
+func TestS3Storage(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.StorageProviderName = s3StorageProvider
+	internal.S3Driver = "s3.csi.example.org"
+	internal.S3Bucket = "vice-data"
+	internal.S3StorageClass = "s3-sc"
+	internal.S3SecretName = "s3-credentials"
+	internal.S3SecretNamespace = "vice-apps"
+	internal.S3VolumeAttributes = map[string]string{"mounter": "geesefs"}
+	storage := newStorageProvider(internal)
+
+	job := &model.Job{
+		InvocationID: "invocation-id",
+		Name:         "analysis",
+		UserID:       "user-id",
+		Submitter:    "ipcdev",
+		Steps:        []model.Step{{}},
+	}
+
+	// The volume and its claim are both labeled with the user's IP address.
+	for n := 0; n < 2; n++ {
+		mock.ExpectQuery("SELECT l.ip_address").
+			WithArgs("user-id").
+			WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("127.0.0.1"))
+	}
+	pvs, err := storage.PersistentVolumes(context.Background(), job)
+	if !assert.NoError(err) || !assert.Len(pvs, 1) {
+		return
+	}
+
+	csi := pvs[0].Spec.CSI
+	assert.Equal("s3.csi.example.org", csi.Driver)
+	assert.Equal("vice-data", csi.VolumeAttributes["bucket"])
+	assert.Equal("geesefs", csi.VolumeAttributes["mounter"])
+	assert.Equal("s3-credentials", csi.NodePublishSecretRef.Name)
+	assert.Equal("s3-sc", pvs[0].Spec.StorageClassName)
+
+	// The configured attributes must not be modified.
+	assert.NotContains(internal.S3VolumeAttributes, "bucket")
+
+	claims, err := storage.PersistentVolumeClaims(context.Background(), job)
+	if assert.NoError(err) && assert.Len(claims, 1) {
+		assert.Equal("s3-sc", *claims[0].Spec.StorageClassName)
+	}
+}
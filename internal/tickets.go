@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// ticketInputMappings contains the path mappings for the inputs that are
+// accessed with a single iRODS ticket. The iRODS CSI driver only accepts one
+// ticket per volume, so each ticket gets a volume of its own.
+type ticketInputMappings struct {
+	ticket   string
+	mappings []IRODSFSPathMapping
+}
+
+// addTicketInputMapping adds the mapping to the group for the ticket, creating
+// the group if necessary. Groups are kept in the order that the tickets first
+// appear in the job so that volume names are stable.
+func addTicketInputMapping(groups []ticketInputMappings, ticket string, mapping IRODSFSPathMapping) []ticketInputMappings {
+	for n := range groups {
+		if groups[n].ticket == ticket {
+			groups[n].mappings = append(groups[n].mappings, mapping)
+			return groups
+		}
+	}
+	return append(groups, ticketInputMappings{
+		ticket:   ticket,
+		mappings: []IRODSFSPathMapping{mapping},
+	})
+}
+
+// ticketVolumeMountPath returns where the volume for the nth ticket is mounted
+// in the analysis container.
+func ticketVolumeMountPath(n int) string {
+	return path.Join(csiDriverTicketMountPath, strconv.Itoa(n))
+}
+
+func (i *Internal) getCSITicketVolumeHandle(job *model.Job, n int) string {
+	return fmt.Sprintf("%s-%d-handle-%s", csiDriverTicketVolumeNamePrefix, n, job.InvocationID)
+}
+
+func (i *Internal) getCSITicketVolumeName(job *model.Job, n int) string {
+	return fmt.Sprintf("%s-%d-%s", csiDriverTicketVolumeNamePrefix, n, job.InvocationID)
+}
+
+func (i *Internal) getCSITicketVolumeClaimName(job *model.Job, n int) string {
+	return fmt.Sprintf("%s-%d-%s", csiDriverTicketVolumeClaimNamePrefix, n, job.InvocationID)
+}
+
+// getTicketPersistentVolumes returns a PersistentVolume for each of the
+// tickets used by the job's inputs. It does not call the k8s API.
+func (i *Internal) getTicketPersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	_, ticketMappings, err := i.getAllInputPathMappings(job)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []*apiv1.PersistentVolume{}
+	for n, ticketMapping := range ticketMappings {
+		labels, err := i.getCSIVolumeLabels(ctx, job, i.getCSITicketVolumeClaimName(job, n))
+		if err != nil {
+			return nil, err
+		}
+
+		volume, err := i.irodsPersistentVolume(
+			job,
+			i.getCSITicketVolumeName(job, n),
+			i.getCSITicketVolumeHandle(job, n),
+			labels,
+			ticketMapping.mappings,
+			ticketMapping.ticket,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// getTicketPersistentVolumeClaims returns a PersistentVolumeClaim for each of
+// the tickets used by the job's inputs. It does not call the k8s API.
+func (i *Internal) getTicketPersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	claims := []*apiv1.PersistentVolumeClaim{}
+	for n := range ticketsUsedByJob(job) {
+		claim, err := i.csiVolumeClaim(ctx, job, i.getCSITicketVolumeClaimName(job, n), csiDriverStorageClassName)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, nil
+}
+
+// getTicketVolumeSources returns a volume for each of the tickets used by the
+// job's inputs. It does not call the k8s API.
+func (i *Internal) getTicketVolumeSources(job *model.Job) []*apiv1.Volume {
+	volumes := []*apiv1.Volume{}
+	for n := range ticketsUsedByJob(job) {
+		volumes = append(volumes, &apiv1.Volume{
+			Name: i.getCSITicketVolumeClaimName(job, n),
+			VolumeSource: apiv1.VolumeSource{
+				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+					ClaimName: i.getCSITicketVolumeClaimName(job, n),
+					ReadOnly:  true,
+				},
+			},
+		})
+	}
+	return volumes
+}
+
+// getTicketVolumeMounts returns a volume mount for each of the tickets used by
+// the job's inputs. It does not call the k8s API.
+func (i *Internal) getTicketVolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	volumeMounts := []*apiv1.VolumeMount{}
+	for n := range ticketsUsedByJob(job) {
+		volumeMounts = append(volumeMounts, &apiv1.VolumeMount{
+			Name:      i.getCSITicketVolumeClaimName(job, n),
+			MountPath: ticketVolumeMountPath(n),
+			ReadOnly:  true,
+		})
+	}
+	return volumeMounts
+}
+
+// ticketsUsedByJob returns the distinct tickets used by the job's inputs in the
+// order that they first appear.
+func ticketsUsedByJob(job *model.Job) []string {
+	seen := map[string]bool{}
+	tickets := []string{}
+	for _, input := range job.FilterInputsWithTickets() {
+		if input.IRODSPath() == "" || seen[input.Ticket] {
+			continue
+		}
+		seen[input.Ticket] = true
+		tickets = append(tickets, input.Ticket)
+	}
+	return tickets
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+// ticketTestJob creates a job with two inputs shared through the same ticket,
+// one shared through another ticket and one without a ticket.
+func ticketTestJob() *model.Job {
+	return &model.Job{
+		InvocationID: "invocation-id",
+		Name:         "analysis",
+		UserID:       "user-id",
+		Submitter:    "ipcdev",
+		Steps: []model.Step{
+			{
+				Config: model.StepConfig{
+					Inputs: []model.StepInput{
+						{Type: "FileInput", Value: "/iplant/home/ipcdev/data.csv"},
+						{Type: "MultiFileSelector", Value: "/iplant/home/other/data.csv", Ticket: "ticket-1"},
+						{Type: "MultiFileSelector", Value: "/iplant/home/other/more.csv", Ticket: "ticket-1"},
+						{Type: "FolderInput", Value: "/iplant/home/third/results", Multiplicity: "collection", Ticket: "ticket-2"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGetAllInputPathMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	mappings, ticketMappings, err := internal.getAllInputPathMappings(ticketTestJob())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Inputs with tickets aren't mounted using the submitter's identity.
+	if assert.Len(mappings, 1) {
+		assert.Equal("/input/data.csv", mappings[0].MappingPath)
+	}
+
+	// Inputs are grouped by ticket and still get distinct mount paths.
+	if assert.Len(ticketMappings, 2) {
+		assert.Equal("ticket-1", ticketMappings[0].ticket)
+		if assert.Len(ticketMappings[0].mappings, 2) {
+			assert.Equal("/input/2/data.csv", ticketMappings[0].mappings[0].MappingPath)
+			assert.Equal("/input/more.csv", ticketMappings[0].mappings[1].MappingPath)
+		}
+		assert.Equal("ticket-2", ticketMappings[1].ticket)
+		if assert.Len(ticketMappings[1].mappings, 1) {
+			assert.Equal("dir", ticketMappings[1].mappings[0].ResourceType)
+		}
+	}
+}
+
+func TestTicketVolumes(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.UseCSIDriver = true
+	job := ticketTestJob()
+
+	// One volume for the submitter's data and one for each ticket.
+	for n := 0; n < 3; n++ {
+		mock.ExpectQuery("SELECT l.ip_address").
+			WithArgs("user-id").
+			WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("127.0.0.1"))
+	}
+
+	pvs, err := internal.getPersistentVolumes(context.Background(), job)
+	if !assert.NoError(err) || !assert.Len(pvs, 3) {
+		return
+	}
+	assert.NotContains(pvs[0].Spec.CSI.VolumeAttributes, "ticket")
+	assert.Equal("ticket-1", pvs[1].Spec.CSI.VolumeAttributes["ticket"])
+	assert.Equal("ticket-2", pvs[2].Spec.CSI.VolumeAttributes["ticket"])
+	assert.Equal(internal.getCSITicketVolumeClaimName(job, 1), pvs[2].Labels["volume-name"])
+
+	mounts := internal.getPersistentVolumeMounts(job)
+	if assert.Len(mounts, 3) {
+		assert.Equal("/ticket-data/0", mounts[1].MountPath)
+		assert.True(mounts[1].ReadOnly)
+	}
+
+	volumes, err := internal.getPersistentVolumeSources(job)
+	if assert.NoError(err) && assert.Len(volumes, 3) {
+		assert.Equal(internal.getCSITicketVolumeClaimName(job, 0), volumes[1].PersistentVolumeClaim.ClaimName)
+	}
+
+	entries, err := internal.storage.InputManifest(job)
+	if assert.NoError(err) {
+		assert.Contains(entries, InputManifestEntry{
+			IRODSPath: "/iplant/home/other/more.csv",
+			Path:      "/ticket-data/0/input/more.csv",
+		})
+	}
+}
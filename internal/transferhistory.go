@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	transferHistoryKey = "transfers.json"
+
+	// The transfer history isn't labeled with the analysis's external-id, so
+	// that it isn't deleted along with the rest of the analysis's objects and
+	// the final upload can still be looked up once the analysis has exited.
+	transferHistoryAppType             = "transfer-history"
+	transferHistoryExternalIDKey       = "transfers-external-id"
+	transferHistoryUpdatedAtAnnotation = "transfers-updated-at"
+
+	// maxTransferHistory is the number of transfers remembered for each
+	// analysis. The oldest transfers are dropped first.
+	maxTransferHistory = 50
+)
+
+// TransferRecord describes a single download or upload for an analysis, as
+// last reported by the file transfer sidecar.
+type TransferRecord struct {
+	UUID             string     `json:"uuid"`
+	Kind             string     `json:"kind"`
+	Status           string     `json:"status"`
+	StartedAt        time.Time  `json:"started_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	BytesTransferred int64      `json:"bytes_transferred"`
+	TotalBytes       int64      `json:"total_bytes"`
+	FilesTransferred int64      `json:"files_transferred"`
+	TotalFiles       int64      `json:"total_files"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// transferHistoryConfigMapName returns the name of the ConfigMap that keeps
+// track of the transfers for an analysis.
+func transferHistoryConfigMapName(externalID string) string {
+	return fmt.Sprintf("transfers-%s", externalID)
+}
+
+// transferHistoryLabels returns the labels for a new transfer history
+// ConfigMap.
+func transferHistoryLabels(externalID string) map[string]string {
+	return map[string]string{
+		"app-type":                   transferHistoryAppType,
+		transferHistoryExternalIDKey: externalID,
+	}
+}
+
+// parseTransferHistory decodes the transfer history stored in the ConfigMap.
+func parseTransferHistory(cm *apiv1.ConfigMap) ([]TransferRecord, error) {
+	history := []TransferRecord{}
+
+	contents, ok := cm.Data[transferHistoryKey]
+	if !ok || contents == "" {
+		return history, nil
+	}
+
+	if err := json.Unmarshal([]byte(contents), &history); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the transfer history in %s", cm.Name)
+	}
+
+	return history, nil
+}
+
+// updateTransferRecord merges the latest details from the sidecar into the
+// record for the transfer, adding the record if it's new.
+func updateTransferRecord(history []TransferRecord, kind string, xfer *transferResponse, now time.Time) []TransferRecord {
+	n := -1
+	for idx := range history {
+		if history[idx].UUID == xfer.UUID {
+			n = idx
+			break
+		}
+	}
+
+	if n < 0 {
+		history = append(history, TransferRecord{
+			UUID:      xfer.UUID,
+			Kind:      kind,
+			StartedAt: now,
+		})
+		n = len(history) - 1
+	}
+
+	record := &history[n]
+	record.Status = xfer.Status
+	record.UpdatedAt = now
+	record.BytesTransferred = xfer.BytesTransferred
+	record.TotalBytes = xfer.TotalBytes
+	record.FilesTransferred = xfer.FilesTransferred
+	record.TotalFiles = xfer.TotalFiles
+	record.Error = xfer.Error
+
+	if isFinished(xfer.Status) && record.CompletedAt == nil {
+		completedAt := now
+		record.CompletedAt = &completedAt
+	}
+
+	if len(history) > maxTransferHistory {
+		history = history[len(history)-maxTransferHistory:]
+	}
+
+	return history
+}
+
+// recordTransfer stores the latest details about a transfer in the analysis's
+// transfer history. Updates are retried if another transfer updated the
+// history at the same time.
+func (i *Internal) recordTransfer(ctx context.Context, externalID, kind string, xfer *transferResponse) error {
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	name := transferHistoryConfigMapName(externalID)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cmclient.Get(ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			history, err := json.Marshal(updateTransferRecord(nil, kind, xfer, time.Now()))
+			if err != nil {
+				return err
+			}
+
+			_, err = cmclient.Create(ctx, &apiv1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: transferHistoryLabels(externalID),
+					Annotations: map[string]string{
+						transferHistoryUpdatedAtAnnotation: time.Now().Format(time.RFC3339),
+					},
+				},
+				Data: map[string]string{
+					transferHistoryKey: string(history),
+				},
+			}, metav1.CreateOptions{})
+
+			// Another transfer created the history first, so try again.
+			if k8serrors.IsAlreadyExists(err) {
+				return k8serrors.NewConflict(apiv1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		history, err := parseTransferHistory(cm)
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(updateTransferRecord(history, kind, xfer, time.Now()))
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[transferHistoryKey] = string(encoded)
+
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[transferHistoryUpdatedAtAnnotation] = time.Now().Format(time.RFC3339)
+
+		_, err = cmclient.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// getTransferHistory returns the transfers for the analysis, oldest first.
+func (i *Internal) getTransferHistory(ctx context.Context, externalID string) ([]TransferRecord, error) {
+	cm, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Get(ctx, transferHistoryConfigMapName(externalID), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return []TransferRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTransferHistory(cm)
+}
+
+// CleanUpTransferHistory deletes the transfer histories of analyses that are
+// no longer running and haven't had a transfer within the retention period.
+func (i *Internal) CleanUpTransferHistory(ctx context.Context) []error {
+	errs := []error{}
+
+	set := labels.Set(map[string]string{"app-type": transferHistoryAppType})
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	cmlist, err := cmclient.List(ctx, metav1.ListOptions{LabelSelector: set.AsSelector().String()})
+	if err != nil {
+		return append(errs, err)
+	}
+
+	for _, cm := range cmlist.Items {
+		updatedAt, err := time.Parse(time.RFC3339, cm.Annotations[transferHistoryUpdatedAtAnnotation])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to determine when transfer history %s was last updated", cm.Name))
+			continue
+		}
+
+		if time.Since(updatedAt) < i.TransferHistoryRetention {
+			continue
+		}
+
+		// Long running analyses keep their history.
+		externalID := cm.Labels[transferHistoryExternalIDKey]
+		deployments, err := i.deploymentList(ctx, i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(deployments.Items) > 0 {
+			continue
+		}
+
+		log.Infof("deleting transfer history %s, which was last updated at %s", cm.Name, updatedAt)
+		if err = cmclient.Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// transfersResponse returns the transfer history for the analysis, or a
+// single transfer if transferID isn't empty.
+func (i *Internal) transfersResponse(c echo.Context, externalID, transferID string) error {
+	history, err := i.getTransferHistory(c.Request().Context(), externalID)
+	if err != nil {
+		return err
+	}
+
+	if transferID == "" {
+		return c.JSON(http.StatusOK, map[string][]TransferRecord{
+			"transfers": history,
+		})
+	}
+
+	for _, record := range history {
+		if record.UUID == transferID {
+			return c.JSON(http.StatusOK, record)
+		}
+	}
+
+	return common.NotFound(fmt.Sprintf("transfer %s not found", transferID))
+}
+
+// TransfersHandler lists the file transfers for the analysis. The user query
+// parameter is required and must refer to the user who launched the analysis.
+// The transfer-id path parameter, if present, limits the response to a single
+// transfer.
+func (i *Internal) TransfersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	user := c.QueryParam("user")
+
+	if user == "" {
+		return common.Forbidden("user not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return common.NotFound(fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.transfersResponse(c, externalIDs[0], c.Param("transfer-id"))
+}
+
+// AdminTransfersHandler is the same as TransfersHandler but doesn't require
+// any user information in the request.
+func (i *Internal) AdminTransfersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	externalID, err := i.getExternalIDByAnalysisID(ctx, c.Param("analysis-id"))
+	if err != nil {
+		return common.BadRequest(err.Error())
+	}
+
+	return i.transfersResponse(c, externalID, c.Param("transfer-id"))
+}
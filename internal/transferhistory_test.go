@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestUpdateTransferRecord(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Date(2022, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	history := updateTransferRecord(nil, uploadKind, &transferResponse{UUID: "a", Status: RequestedStatus}, start)
+	if !assert.Len(history, 1) {
+		return
+	}
+	assert.Equal(uploadKind, history[0].Kind)
+	assert.Equal(start, history[0].StartedAt)
+	assert.Nil(history[0].CompletedAt)
+
+	later := start.Add(time.Minute)
+	history = updateTransferRecord(history, uploadKind, &transferResponse{
+		UUID:             "a",
+		Status:           CompletedStatus,
+		BytesTransferred: 2048,
+		TotalBytes:       2048,
+		FilesTransferred: 2,
+		TotalFiles:       2,
+	}, later)
+	if !assert.Len(history, 1) {
+		return
+	}
+	assert.Equal(start, history[0].StartedAt)
+	assert.Equal(later, history[0].UpdatedAt)
+	assert.Equal(int64(2048), history[0].BytesTransferred)
+	if assert.NotNil(history[0].CompletedAt) {
+		assert.Equal(later, *history[0].CompletedAt)
+	}
+
+	// Only the most recent transfers are kept.
+	for n := 0; n < maxTransferHistory; n++ {
+		history = updateTransferRecord(history, downloadKind, &transferResponse{UUID: fmt.Sprintf("transfer-%d", n), Status: DownloadingStatus}, later)
+	}
+	assert.Len(history, maxTransferHistory)
+	assert.NotEqual("a", history[0].UUID)
+}
+
+func TestRecordTransfer(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive", "user-id": "user-id"})
+	internal, _ := setupInternal(t, []runtime.Object{deployment})
+	ctx := context.Background()
+
+	// Nothing has been transferred yet.
+	history, err := internal.getTransferHistory(ctx, "external-id")
+	if assert.NoError(err) {
+		assert.Empty(history)
+	}
+
+	assert.NoError(internal.recordTransfer(ctx, "external-id", downloadKind, &transferResponse{UUID: "download", Status: CompletedStatus}))
+	assert.NoError(internal.recordTransfer(ctx, "external-id", uploadKind, &transferResponse{UUID: "upload", Status: UploadingStatus}))
+	assert.NoError(internal.recordTransfer(ctx, "external-id", uploadKind, &transferResponse{UUID: "upload", Status: FailedStatus, Error: "quota exceeded"}))
+
+	history, err = internal.getTransferHistory(ctx, "external-id")
+	if !assert.NoError(err) || !assert.Len(history, 2) {
+		return
+	}
+	assert.Equal("download", history[0].UUID)
+	assert.Equal(CompletedStatus, history[0].Status)
+	assert.Equal("upload", history[1].UUID)
+	assert.Equal(FailedStatus, history[1].Status)
+	assert.Equal("quota exceeded", history[1].Error)
+
+	// The history outlives the analysis, so it isn't selected by its external-id.
+	cm, err := internal.clientset.CoreV1().ConfigMaps(internal.ViceNamespace).Get(ctx, transferHistoryConfigMapName("external-id"), metav1.GetOptions{})
+	if assert.NoError(err) {
+		assert.Equal(transferHistoryAppType, cm.Labels["app-type"])
+		assert.Equal("external-id", cm.Labels[transferHistoryExternalIDKey])
+		assert.NotContains(cm.Labels, "external-id")
+		assert.NotEmpty(cm.Annotations[transferHistoryUpdatedAtAnnotation])
+	}
+}
+
+// transferHistoryConfigMap returns a transfer history for the analysis that
+// was last updated at the time.
+func transferHistoryConfigMap(externalID string, updatedAt time.Time) *apiv1.ConfigMap {
+	return &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      transferHistoryConfigMapName(externalID),
+			Namespace: "vice-apps",
+			Labels:    transferHistoryLabels(externalID),
+			Annotations: map[string]string{
+				transferHistoryUpdatedAtAnnotation: updatedAt.Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+func TestCleanUpTransferHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	stale := time.Now().Add(-48 * time.Hour)
+	running := labeledViceDeployment(1, "running", map[string]string{"app-type": "interactive"})
+
+	internal, _ := setupInternal(t, []runtime.Object{
+		transferHistoryConfigMap("exited", stale),
+		transferHistoryConfigMap("running", stale),
+		transferHistoryConfigMap("recent", time.Now()),
+		running,
+	})
+	internal.TransferHistoryRetention = 24 * time.Hour
+	ctx := context.Background()
+
+	assert.Empty(internal.CleanUpTransferHistory(ctx))
+
+	cms, err := internal.clientset.CoreV1().ConfigMaps(internal.ViceNamespace).List(ctx, metav1.ListOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	remaining := []string{}
+	for _, cm := range cms.Items {
+		remaining = append(remaining, cm.Name)
+	}
+	assert.ElementsMatch([]string{transferHistoryConfigMapName("running"), transferHistoryConfigMapName("recent")}, remaining)
+}
@@ -0,0 +1,464 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultTransferPollInterval = 5 * time.Second
+	defaultTransferMaxBackoff   = 2 * time.Minute
+	defaultTransferMaxErrors    = 10
+
+	// cancelRequestTimeout limits how long we wait for the sidecar when
+	// asking it to abort a transfer that has timed out.
+	cancelRequestTimeout = 30 * time.Second
+)
+
+var (
+	// errTransferTimedOut is returned when a transfer takes longer than the
+	// configured timeouts allow.
+	errTransferTimedOut = errors.New("the transfer timed out")
+
+	// errTransferCanceled is returned when a transfer is canceled before it
+	// finishes.
+	errTransferCanceled = errors.New("the transfer was canceled")
+)
+
+// transferSidecar is the part of the file transfer sidecar API used to follow
+// a transfer after it has been requested.
+type transferSidecar interface {
+	Details(ctx context.Context, uuid string) (*transferResponse, error)
+	Cancel(ctx context.Context, uuid string) error
+}
+
+// serviceSidecar reaches the file transfer sidecar through the analysis's
+// service.
+type serviceSidecar struct {
+	svc     apiv1.Service
+	reqpath string
+}
+
+func (s *serviceSidecar) Details(ctx context.Context, uuid string) (*transferResponse, error) {
+	return getTransferDetails(ctx, uuid, s.svc, path.Join(s.reqpath, uuid))
+}
+
+// Cancel asks the sidecar to abort the transfer by deleting it.
+func (s *serviceSidecar) Cancel(ctx context.Context, uuid string) error {
+	svcurl := url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s.%s:%d", s.svc.Name, s.svc.Namespace, fileTransfersPort),
+		Path:   path.Join(s.reqpath, uuid),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, svcurl.String(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "error on DELETE %s", svcurl.String())
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error on DELETE %s", svcurl.String())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return fmt.Errorf("cancel request to %s returned %d", svcurl.String(), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// activeTransfers keeps track of the transfers being polled by this instance
+// so that they can be stopped when they're canceled.
+type activeTransfers struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newActiveTransfers() *activeTransfers {
+	return &activeTransfers{cancels: make(map[string]context.CancelFunc)}
+}
+
+func (a *activeTransfers) add(uuid string, cancel context.CancelFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cancels[uuid] = cancel
+}
+
+func (a *activeTransfers) remove(uuid string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.cancels, uuid)
+}
+
+// stop cancels polling for the transfer. It returns false if the transfer
+// isn't being polled by this instance.
+func (a *activeTransfers) stop(uuid string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cancel, ok := a.cancels[uuid]
+	if ok {
+		cancel()
+		delete(a.cancels, uuid)
+	}
+	return ok
+}
+
+// transferPollInterval returns how long to wait between status checks.
+func (i *Internal) transferPollInterval() time.Duration {
+	if i.TransferPollInterval > 0 {
+		return i.TransferPollInterval
+	}
+	return defaultTransferPollInterval
+}
+
+// transferMaxBackoff returns the longest time to wait between status checks
+// after the sidecar can't be reached.
+func (i *Internal) transferMaxBackoff() time.Duration {
+	if i.TransferMaxBackoff > 0 {
+		return i.TransferMaxBackoff
+	}
+	return defaultTransferMaxBackoff
+}
+
+// transferMaxErrors returns the number of consecutive failed status checks
+// allowed before giving up on a transfer.
+func (i *Internal) transferMaxErrors() int {
+	if i.TransferMaxPollErrors > 0 {
+		return i.TransferMaxPollErrors
+	}
+	return defaultTransferMaxErrors
+}
+
+// nextBackoff doubles the wait between status checks, up to the limit.
+func nextBackoff(current, limit time.Duration) time.Duration {
+	next := current * 2
+	if next > limit {
+		return limit
+	}
+	return next
+}
+
+// publishTransferStatus sends a status update for the analysis, logging
+// failures.
+func (i *Internal) publishTransferStatus(ctx context.Context, externalID, msg string) {
+	if err := i.statusPublisher.Running(ctx, externalID, msg); err != nil {
+		log.Error(err)
+	}
+}
+
+// abandonTransfer asks the sidecar to stop a transfer that timed out and
+// records why it stopped. The context passed in is usually done
+// already, so the requests use a context of their own.
+func (i *Internal) abandonTransfer(externalID, kind string, sidecar transferSidecar, xfer *transferResponse, status string, reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelRequestTimeout)
+	defer cancel()
+
+	if err := sidecar.Cancel(ctx, xfer.UUID); err != nil {
+		log.Error(errors.Wrapf(err, "unable to cancel transfer %s for %s", xfer.UUID, externalID))
+	}
+
+	abandoned := *xfer
+	abandoned.Status = status
+	abandoned.Error = reason.Error()
+	i.saveTransferRecord(ctx, externalID, kind, &abandoned)
+}
+
+// pollTransfer follows a transfer until it finishes, fails or runs out of
+// time. The overall timeout comes from the context; the per-status timeouts
+// are checked here. Errors checking the status are retried with exponential
+// backoff.
+func (i *Internal) pollTransfer(ctx context.Context, externalID, kind string, sidecar transferSidecar, xfer *transferResponse) error {
+	var (
+		sentUploadStatus   = false
+		sentDownloadStatus = false
+		pollErrors         = 0
+		wait               = i.transferPollInterval()
+		statusSince        = time.Now()
+		lastStatus         = xfer.Status
+		lastError          = xfer.Error
+	)
+
+	for {
+		switch xfer.Status {
+		case FailedStatus:
+			// The analysis is still running and the transfer can be retried,
+			// so this isn't a terminal status for the analysis. The exit
+			// paths publish that.
+			msg := fmt.Sprintf("%s failed for job %s", kind, externalID)
+			if xfer.Error != "" {
+				msg = fmt.Sprintf("%s: %s", msg, xfer.Error)
+			}
+			i.publishTransferStatus(ctx, externalID, msg)
+			return errors.New(msg)
+
+		case CanceledStatus:
+			msg := fmt.Sprintf("%s was canceled for job %s", kind, externalID)
+			i.publishTransferStatus(ctx, externalID, msg)
+			return errTransferCanceled
+
+		case CompletedStatus:
+			msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
+			log.Info(msg)
+			i.publishTransferStatus(ctx, externalID, msg)
+			return nil
+
+		case RequestedStatus:
+			i.publishTransferStatus(ctx, externalID, fmt.Sprintf("%s requested for job %s", kind, externalID))
+
+		case UploadingStatus:
+			if !sentUploadStatus {
+				msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
+				log.Info(msg)
+				i.publishTransferStatus(ctx, externalID, msg)
+				sentUploadStatus = true
+			}
+
+		case DownloadingStatus:
+			if !sentDownloadStatus {
+				msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
+				log.Info(msg)
+				i.publishTransferStatus(ctx, externalID, msg)
+				sentDownloadStatus = true
+			}
+
+		default:
+			return fmt.Errorf("unknown status for transfer %s: %s", xfer.UUID, xfer.Status)
+		}
+
+		if limit := i.TransferStatusTimeouts[xfer.Status]; limit > 0 && time.Since(statusSince) > limit {
+			err := errors.Wrapf(errTransferTimedOut, "%s was %s for more than %s", kind, xfer.Status, limit)
+			i.publishTransferStatus(ctx, externalID, fmt.Sprintf("%s timed out for job %s", kind, externalID))
+			i.abandonTransfer(externalID, kind, sidecar, xfer, FailedStatus, err)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err := errors.Wrapf(errTransferTimedOut, "%s did not finish in time", kind)
+				i.publishTransferStatus(context.Background(), externalID, fmt.Sprintf("%s timed out for job %s", kind, externalID))
+				i.abandonTransfer(externalID, kind, sidecar, xfer, FailedStatus, err)
+				return err
+			}
+			// The sidecar has already been asked to stop the transfer.
+			canceled := *xfer
+			canceled.Status = CanceledStatus
+			canceled.Error = errTransferCanceled.Error()
+			i.saveTransferRecord(context.Background(), externalID, kind, &canceled)
+			i.publishTransferStatus(context.Background(), externalID, fmt.Sprintf("%s was canceled for job %s", kind, externalID))
+			return errTransferCanceled
+		case <-time.After(wait):
+		}
+
+		details, err := sidecar.Details(ctx, xfer.UUID)
+		if err != nil || details == nil {
+			if err == nil {
+				err = fmt.Errorf("no details returned for transfer %s", xfer.UUID)
+			}
+
+			pollErrors++
+			if pollErrors >= i.transferMaxErrors() {
+				return errors.Wrapf(err, "giving up on transfer %s after %d errors", xfer.UUID, pollErrors)
+			}
+
+			log.Error(errors.Wrapf(err, "error getting details for transfer %s, retrying", xfer.UUID))
+			wait = nextBackoff(wait, i.transferMaxBackoff())
+			continue
+		}
+
+		pollErrors = 0
+		wait = i.transferPollInterval()
+		xfer = details
+
+		// The history is only rewritten when the status or error changes,
+		// rather than on every poll.
+		changed := xfer.Status != lastStatus || xfer.Error != lastError
+		if xfer.Status != lastStatus {
+			lastStatus = xfer.Status
+			statusSince = time.Now()
+		}
+
+		if changed {
+			lastError = xfer.Error
+			i.saveTransferRecord(ctx, externalID, kind, xfer)
+		}
+	}
+}
+
+// transferContext returns the context used for a transfer, which expires
+// after the overall transfer timeout if one is configured.
+func (i *Internal) transferContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if i.TransferTimeout > 0 {
+		return context.WithTimeout(ctx, i.TransferTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// transferBasePath returns the sidecar path used for transfers of the kind.
+func transferBasePath(kind string) (string, error) {
+	switch kind {
+	case downloadKind:
+		return downloadBasePath, nil
+	case uploadKind:
+		return uploadBasePath, nil
+	default:
+		return "", fmt.Errorf("unknown transfer kind %s", kind)
+	}
+}
+
+// cancelTransfer asks the sidecar to abort the transfer and stops polling for
+// it if this instance was following it.
+func (i *Internal) cancelTransfer(ctx context.Context, externalID, transferID string) (*TransferRecord, error) {
+	history, err := i.getTransferHistory(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	var record *TransferRecord
+	for n := range history {
+		if history[n].UUID == transferID {
+			record = &history[n]
+			break
+		}
+	}
+
+	if record == nil {
+		return nil, common.NotFound(fmt.Sprintf("transfer %s not found", transferID))
+	}
+
+	if isFinished(record.Status) {
+		return nil, common.Conflict(fmt.Sprintf("transfer %s is already %s", transferID, record.Status))
+	}
+
+	reqpath, err := transferBasePath(record.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	set := labels.Set(map[string]string{"external-id": externalID})
+	svclist, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only one of the services ran the transfer, but we don't know which.
+	var cancelErr error
+	canceled := false
+	for _, svc := range svclist.Items {
+		sidecar := &serviceSidecar{svc: svc, reqpath: reqpath}
+		if err = sidecar.Cancel(ctx, transferID); err != nil {
+			cancelErr = err
+			continue
+		}
+		canceled = true
+	}
+
+	if !canceled {
+		if cancelErr == nil {
+			cancelErr = fmt.Errorf("no services with a label of 'external-id=%s' were found", externalID)
+		}
+		return nil, cancelErr
+	}
+
+	// The polling goroutine records the cancellation itself if it's running
+	// here. Otherwise it'll see the new status from the sidecar.
+	if !i.transfers.stop(transferID) {
+		i.saveTransferRecord(ctx, externalID, record.Kind, &transferResponse{
+			UUID:   transferID,
+			Status: CanceledStatus,
+			Error:  errTransferCanceled.Error(),
+		})
+	}
+
+	record.Status = CanceledStatus
+	return record, nil
+}
+
+// CancelTransferHandler asks the file transfer sidecar to abort a download or
+// upload. The user query parameter is required and the user needs write access
+// to the analysis.
+func (i *Internal) CancelTransferHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	user := c.QueryParam("user")
+
+	if user == "" {
+		return common.Forbidden("user not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return common.NotFound(fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	if err = i.checkAnalysisAccess(ctx, user, analysisID, cancelTransfers); err != nil {
+		return err
+	}
+
+	record, err := i.cancelTransfer(ctx, externalIDs[0], c.Param("transfer-id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
+
+// AdminCancelTransferHandler is the same as CancelTransferHandler but doesn't
+// require any user information in the request.
+func (i *Internal) AdminCancelTransferHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	externalID, err := i.getExternalIDByAnalysisID(ctx, c.Param("analysis-id"))
+	if err != nil {
+		return common.BadRequest(err.Error())
+	}
+
+	record, err := i.cancelTransfer(ctx, externalID, c.Param("transfer-id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
+
+// ParseTransferStatusTimeouts converts the per-status transfer timeouts from
+// the configuration into durations. Only the statuses of running transfers may
+// have timeouts.
+func ParseTransferStatusTimeouts(config map[string]string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for status, value := range config {
+		switch status {
+		case RequestedStatus, DownloadingStatus, UploadingStatus:
+		default:
+			return nil, fmt.Errorf("transfers can't time out in the %s status", status)
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timeout for the %s status", status)
+		}
+		timeouts[status] = timeout
+	}
+	return timeouts, nil
+}
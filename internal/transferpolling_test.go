@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeSidecar returns canned responses to status checks. Once the responses
+// run out, the last one is repeated.
+type fakeSidecar struct {
+	mu        sync.Mutex
+	responses []*transferResponse
+	errs      []error
+	checks    int
+	canceled  []string
+}
+
+func (f *fakeSidecar) Details(ctx context.Context, uuid string) (*transferResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.checks
+	f.checks++
+
+	if n < len(f.errs) && f.errs[n] != nil {
+		return nil, f.errs[n]
+	}
+	if n >= len(f.responses) {
+		n = len(f.responses) - 1
+	}
+	return f.responses[n], nil
+}
+
+func (f *fakeSidecar) Cancel(ctx context.Context, uuid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.canceled = append(f.canceled, uuid)
+	return nil
+}
+
+// setupPollingInternal returns an *Internal that polls for transfer status
+// quickly.
+func setupPollingInternal(t *testing.T) (*Internal, *recordingPublisher) {
+	internal, _ := setupInternal(t, nil)
+	internal.TransferPollInterval = time.Millisecond
+	internal.TransferMaxBackoff = 4 * time.Millisecond
+	internal.TransferMaxPollErrors = 3
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+	return internal, publisher
+}
+
+func lastTransferRecord(t *testing.T, internal *Internal) TransferRecord {
+	history, err := internal.getTransferHistory(context.Background(), "external-id")
+	if err != nil || len(history) == 0 {
+		t.Fatalf("no transfer history found: %v", err)
+	}
+	return history[len(history)-1]
+}
+
+func TestPollTransferCompletes(t *testing.T) {
+	assert := assert.New(t)
+	internal, publisher := setupPollingInternal(t)
+
+	sidecar := &fakeSidecar{
+		responses: []*transferResponse{
+			{UUID: "xfer", Status: UploadingStatus, BytesTransferred: 10},
+			{UUID: "xfer", Status: CompletedStatus, BytesTransferred: 20},
+		},
+	}
+
+	err := internal.pollTransfer(context.Background(), "external-id", uploadKind, sidecar, &transferResponse{UUID: "xfer", Status: RequestedStatus})
+	assert.NoError(err)
+	assert.Empty(sidecar.canceled)
+
+	record := lastTransferRecord(t, internal)
+	assert.Equal(CompletedStatus, record.Status)
+	assert.Equal(int64(20), record.BytesTransferred)
+
+	if assert.NotEmpty(publisher.published) {
+		assert.Equal("upload succeeded for job external-id", publisher.published[len(publisher.published)-1].msg)
+	}
+}
+
+func TestPollTransferOnlySavesChanges(t *testing.T) {
+	internal, _ := setupPollingInternal(t)
+
+	sidecar := &fakeSidecar{
+		responses: []*transferResponse{
+			{UUID: "xfer", Status: UploadingStatus, BytesTransferred: 10},
+			{UUID: "xfer", Status: UploadingStatus, BytesTransferred: 20},
+			{UUID: "xfer", Status: UploadingStatus, BytesTransferred: 30},
+			{UUID: "xfer", Status: CompletedStatus, BytesTransferred: 40},
+		},
+	}
+
+	err := internal.pollTransfer(context.Background(), "external-id", uploadKind, sidecar, &transferResponse{UUID: "xfer", Status: RequestedStatus})
+	assert.NoError(t, err)
+
+	// The record is written once when the upload starts and once when it
+	// completes.
+	writes := 0
+	for _, action := range internal.clientset.(*fake.Clientset).Actions() {
+		if action.GetResource().Resource == "configmaps" && (action.GetVerb() == "create" || action.GetVerb() == "update") {
+			writes++
+		}
+	}
+	assert.Equal(t, 2, writes)
+	assert.Equal(t, int64(40), lastTransferRecord(t, internal).BytesTransferred)
+}
+
+func TestPollTransferRetriesErrors(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupPollingInternal(t)
+
+	unreachable := errors.New("connection refused")
+	sidecar := &fakeSidecar{
+		errs: []error{unreachable, unreachable, nil},
+		responses: []*transferResponse{
+			nil, nil,
+			{UUID: "xfer", Status: CompletedStatus},
+		},
+	}
+
+	err := internal.pollTransfer(context.Background(), "external-id", downloadKind, sidecar, &transferResponse{UUID: "xfer", Status: DownloadingStatus})
+	assert.NoError(err)
+	assert.Equal(3, sidecar.checks)
+
+	// Too many errors in a row gives up on the transfer.
+	sidecar = &fakeSidecar{
+		errs:      []error{unreachable, unreachable, unreachable},
+		responses: []*transferResponse{nil},
+	}
+	err = internal.pollTransfer(context.Background(), "external-id", downloadKind, sidecar, &transferResponse{UUID: "xfer", Status: DownloadingStatus})
+	assert.ErrorIs(err, unreachable)
+	assert.Equal(3, sidecar.checks)
+}
+
+func TestNextBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, nextBackoff(time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextBackoff(40*time.Second, time.Minute))
+}
+
+func TestPollTransferTimesOut(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupPollingInternal(t)
+
+	sidecar := &fakeSidecar{
+		responses: []*transferResponse{{UUID: "xfer", Status: UploadingStatus}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := internal.pollTransfer(ctx, "external-id", uploadKind, sidecar, &transferResponse{UUID: "xfer", Status: UploadingStatus})
+	assert.ErrorIs(err, errTransferTimedOut)
+	assert.Equal([]string{"xfer"}, sidecar.canceled)
+
+	record := lastTransferRecord(t, internal)
+	assert.Equal(FailedStatus, record.Status)
+	assert.NotEmpty(record.Error)
+}
+
+func TestPollTransferStatusTimeout(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupPollingInternal(t)
+	internal.TransferStatusTimeouts = map[string]time.Duration{RequestedStatus: 10 * time.Millisecond}
+
+	sidecar := &fakeSidecar{
+		responses: []*transferResponse{{UUID: "xfer", Status: RequestedStatus}},
+	}
+
+	err := internal.pollTransfer(context.Background(), "external-id", uploadKind, sidecar, &transferResponse{UUID: "xfer", Status: RequestedStatus})
+	assert.ErrorIs(err, errTransferTimedOut)
+	assert.Equal([]string{"xfer"}, sidecar.canceled)
+}
+
+func TestPollTransferCanceled(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupPollingInternal(t)
+
+	sidecar := &fakeSidecar{
+		responses: []*transferResponse{{UUID: "xfer", Status: UploadingStatus}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	internal.transfers.add("xfer", cancel)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		internal.transfers.stop("xfer")
+	}()
+
+	err := internal.pollTransfer(ctx, "external-id", uploadKind, sidecar, &transferResponse{UUID: "xfer", Status: UploadingStatus})
+	assert.ErrorIs(err, errTransferCanceled)
+
+	// The sidecar is asked to cancel by whoever stopped the polling.
+	assert.Empty(sidecar.canceled)
+	assert.Equal(CanceledStatus, lastTransferRecord(t, internal).Status)
+	assert.False(internal.transfers.stop("xfer"))
+}
+
+func TestParseTransferStatusTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts, err := ParseTransferStatusTimeouts(map[string]string{"requested": "15m", "uploading": "6h"})
+	if assert.NoError(err) {
+		assert.Equal(map[string]time.Duration{
+			RequestedStatus: 15 * time.Minute,
+			UploadingStatus: 6 * time.Hour,
+		}, timeouts)
+	}
+
+	_, err = ParseTransferStatusTimeouts(map[string]string{"completed": "1h"})
+	assert.Error(err)
+
+	_, err = ParseTransferStatusTimeouts(map[string]string{"requested": "soon"})
+	assert.Error(err)
+}
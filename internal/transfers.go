@@ -1,9 +1,11 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -37,12 +39,23 @@ const (
 
 	//CompletedStatus means that the transfer request succeeded
 	CompletedStatus = "completed"
+
+	// CanceledStatus means that the transfer was aborted before it finished
+	CanceledStatus = "canceled"
 )
 
+// transferResponse is the status of a transfer as reported by the file transfer
+// sidecar. The progress fields are left at zero by sidecars that don't report
+// them.
 type transferResponse struct {
-	UUID   string `json:"uuid"`
-	Status string `json:"status"`
-	Kind   string `json:"kind"`
+	UUID             string `json:"uuid"`
+	Status           string `json:"status"`
+	Kind             string `json:"kind"`
+	BytesTransferred int64  `json:"bytes_transferred"`
+	TotalBytes       int64  `json:"total_bytes"`
+	FilesTransferred int64  `json:"files_transferred"`
+	TotalFiles       int64  `json:"total_files"`
+	Error            string `json:"error"`
 }
 
 // fileTransferCommand returns a []string containing the command to fire up the vice-file-transfers service.
@@ -96,7 +109,31 @@ func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount
 	return retval
 }
 
-func requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string) (*transferResponse, error) {
+// sidecarUnreachableError is returned when there's no file transfer sidecar to
+// send a transfer request to, so no transfer ran. This happens when the
+// analysis's pod never started or is already gone.
+type sidecarUnreachableError struct {
+	err error
+}
+
+func (e sidecarUnreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e sidecarUnreachableError) Unwrap() error {
+	return e.err
+}
+
+// isSidecarUnreachable returns true if err means that no transfer ran because
+// there wasn't a sidecar to run it.
+func isSidecarUnreachable(err error) bool {
+	var unreachable sidecarUnreachableError
+	return errors.As(err, &unreachable)
+}
+
+// requestTransfer asks the file transfer sidecar to start a transfer. The
+// request body is only sent if it's not nil.
+func requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string, body *transferRequest) (*transferResponse, error) {
 	var (
 		bodybytes []byte
 		bodyerr   error
@@ -111,14 +148,26 @@ func requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string) (*t
 	svcurl.Host = fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort)
 	svcurl.Path = reqpath
 
-	req, reqerr := http.NewRequestWithContext(ctx, http.MethodPost, svcurl.String(), nil)
+	var reqbody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error encoding the request body for %s", svcurl.String())
+		}
+		reqbody = bytes.NewReader(encoded)
+	}
+
+	req, reqerr := http.NewRequestWithContext(ctx, http.MethodPost, svcurl.String(), reqbody)
 	if reqerr != nil {
 		return nil, errors.Wrapf(reqerr, "error POSTing to %s", svcurl.String())
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, posterr := httpClient.Do(req)
 	if posterr != nil {
-		return nil, errors.Wrapf(posterr, "error POSTing to %s", svcurl.String())
+		return nil, sidecarUnreachableError{errors.Wrapf(posterr, "error POSTing to %s", svcurl.String())}
 	}
 	if resp == nil {
 		return nil, fmt.Errorf("response from %s was nil", svcurl.String())
@@ -187,21 +236,31 @@ func getTransferDetails(ctx context.Context, id string, svc apiv1.Service, reqpa
 	return xferresp, nil
 }
 
+// saveTransferRecord adds the transfer details to the analysis's transfer
+// history. Failures are logged, since they shouldn't interrupt the transfer.
+func (i *Internal) saveTransferRecord(ctx context.Context, externalID, kind string, xfer *transferResponse) {
+	if err := i.recordTransfer(ctx, externalID, kind, xfer); err != nil {
+		log.Error(errors.Wrapf(err, "unable to record transfer %s for %s", xfer.UUID, externalID))
+	}
+}
+
 func isFinished(status string) bool {
 	switch status {
 	case FailedStatus:
 		return true
 	case CompletedStatus:
 		return true
+	case CanceledStatus:
+		return true
 	default:
 		return false
 	}
 }
 
 // doFileTransfer handles requests to initial file transfers for a VICE
-// analysis. We only need the ID of the job, nothing is required in the
-// body of the request.
-func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind string, async bool) error {
+// analysis. The request is passed along to the file transfer sidecar and may
+// be nil, in which case everything is transferred.
+func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind string, request *transferRequest, async bool) error {
 	ctx, span := otel.Tracer(otelName).Start(ctx, "doFileTransfer")
 	defer span.End()
 
@@ -238,7 +297,7 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 	}
 
 	if len(svclist.Items) < 1 {
-		return fmt.Errorf("no services with a label of 'external-id=%s' were found", externalID)
+		return sidecarUnreachableError{fmt.Errorf("no services with a label of 'external-id=%s' were found", externalID)}
 	}
 
 	// It's technically possibly for multiple services to provide file transfer services,
@@ -264,101 +323,34 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 
 			log.Infof("%s transfer for %s", kind, externalID)
 
-			transferObj, xfererr := requestTransfer(ctx, svc, reqpath)
+			ctx, cancel := i.transferContext(ctx)
+			defer cancel()
+
+			requestedAt := time.Now()
+			transferObj, xfererr := requestTransfer(ctx, svc, reqpath, request)
 			if xfererr != nil {
 				log.Error(xfererr)
 				err = xfererr
 				return
 			}
 
-			currentStatus := transferObj.Status
-
-			var (
-				sentUploadStatus   = false
-				sentDownloadStatus = false
-			)
-
-			for !isFinished(currentStatus) {
-				// Set it again here to catch the new values set farther down.
-				currentStatus = transferObj.Status
-
-				switch currentStatus {
-				case FailedStatus:
-					msg := fmt.Sprintf("%s failed for job %s", kind, externalID)
-
-					err = errors.New(msg)
+			i.saveTransferRecord(ctx, externalID, kind, transferObj)
 
-					log.Error(err)
+			// Allow the transfer to be canceled while we're waiting for it.
+			i.transfers.add(transferObj.UUID, cancel)
+			defer i.transfers.remove(transferObj.UUID)
 
-					if failerr := i.statusPublisher.Running(ctx, externalID, msg); failerr != nil {
-						log.Error(failerr)
-					}
-
-					return
-				case CompletedStatus:
-					msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
-
-					log.Info(msg)
-
-					if successerr := i.statusPublisher.Running(ctx, externalID, msg); successerr != nil {
-						log.Error(successerr)
-					}
-
-					return
-				case RequestedStatus:
-					msg := fmt.Sprintf("%s requested for job %s", kind, externalID)
-
-					if requestederr := i.statusPublisher.Running(ctx, externalID, msg); requestederr != nil {
-						log.Error(err)
-					}
-
-				case UploadingStatus:
-					if !sentUploadStatus {
-						msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
-
-						log.Info(msg)
-
-						if uploadingerr := i.statusPublisher.Running(ctx, externalID, msg); uploadingerr != nil {
-							log.Error(err)
-						}
-
-						sentUploadStatus = true
-					}
-				case DownloadingStatus:
-					if !sentDownloadStatus {
-						msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
-
-						log.Info(msg)
-
-						if downloadingerr := i.statusPublisher.Running(ctx, externalID, msg); downloadingerr != nil {
-							log.Error(err)
-						}
-
-						sentDownloadStatus = true
-					}
-				default:
-					err = fmt.Errorf("unknown status from %s: %s", svc.Spec.ClusterIP, transferObj.Status)
-
-					log.Error(err)
-
-					return // return and not break because we want to fail out
-				}
-
-				fullreqpath := path.Join(reqpath, transferObj.UUID)
-
-				transferObj, xfererr = getTransferDetails(ctx, transferObj.UUID, svc, fullreqpath)
-				if xfererr != nil {
-					log.Error(errors.Wrapf(xfererr, "error getting transfer details for transferObj %s", fullreqpath))
-					err = xfererr
-					return
-				}
+			sidecar := &serviceSidecar{svc: svc, reqpath: reqpath}
+			if pollerr := i.pollTransfer(ctx, externalID, kind, sidecar, transferObj); pollerr != nil {
+				log.Error(pollerr)
+				err = pollerr
+				return
+			}
 
-				if transferObj == nil {
-					log.Error("transferObj is nil")
-					return
+			if kind == uploadKind && !request.selectsFiles() {
+				if recorderr := i.recordUpload(ctx, externalID, requestedAt); recorderr != nil {
+					log.Error(errors.Wrapf(recorderr, "unable to record the upload time for %s", externalID))
 				}
-
-				time.Sleep(5 * time.Second)
 			}
 		}(ctx, svc)
 	}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// lastUploadAnnotation records when the last successful upload of all of an
+// analysis's outputs was requested. Incremental uploads only include files
+// changed since then. Uploads limited to selected files don't update it, since
+// the files they left out still need to be uploaded.
+const lastUploadAnnotation = "last-upload-at"
+
+// UploadRequest is the optional request body for triggering output uploads.
+// Include and Exclude are glob patterns matched against paths relative to the
+// working directory. Paths lists specific files or directories to upload
+// instead of the whole working directory. The excludes file is honored either
+// way.
+type UploadRequest struct {
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	Paths       []string `json:"paths"`
+	Incremental bool     `json:"incremental"`
+}
+
+// transferRequest is the body of a transfer request sent to the file transfer
+// sidecar.
+type transferRequest struct {
+	Include      []string `json:"include,omitempty"`
+	Exclude      []string `json:"exclude,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	ChangedSince string   `json:"changed_since,omitempty"`
+}
+
+// selectsFiles returns true if the request limits the transfer to some of the
+// files. A nil request transfers everything.
+func (r *transferRequest) selectsFiles() bool {
+	return r != nil && (len(r.Include) > 0 || len(r.Exclude) > 0 || len(r.Paths) > 0)
+}
+
+// validate returns an error if any of the patterns or paths can't be used.
+func (u *UploadRequest) validate() error {
+	for _, pattern := range append(append([]string{}, u.Include...), u.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s", pattern)
+		}
+	}
+
+	for _, p := range u.Paths {
+		if p == "" || path.IsAbs(p) {
+			return fmt.Errorf("paths must be relative to the working directory: %s", p)
+		}
+		if cleaned := path.Clean(p); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("paths must be inside of the working directory: %s", p)
+		}
+	}
+
+	return nil
+}
+
+// bindUploadRequest reads the upload request from the body of the request. The
+// body is optional; without it the whole working directory is uploaded.
+func bindUploadRequest(c echo.Context) (*UploadRequest, error) {
+	body := &UploadRequest{}
+
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(body); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+
+	if err := body.validate(); err != nil {
+		return nil, common.BadRequest(err.Error())
+	}
+
+	return body, nil
+}
+
+// getLastUploadTime returns the time that the last successful upload for the
+// analysis was requested. The second return value is false if nothing has been
+// uploaded successfully yet.
+func (i *Internal) getLastUploadTime(ctx context.Context, externalID string) (time.Time, bool, error) {
+	deployments, err := i.deploymentList(ctx, i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	for _, deployment := range deployments.Items {
+		if value, ok := deployment.Annotations[lastUploadAnnotation]; ok {
+			lastUpload, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return time.Time{}, false, errors.Wrapf(err, "unable to parse the %s annotation on %s", lastUploadAnnotation, deployment.Name)
+			}
+			return lastUpload, true, nil
+		}
+	}
+
+	return time.Time{}, false, nil
+}
+
+// recordUpload stores the time that a successful upload was requested in the
+// analysis's deployment.
+func (i *Internal) recordUpload(ctx context.Context, externalID string, requestedAt time.Time) error {
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+	set := labels.Set(map[string]string{"external-id": externalID})
+	deployments, err := depclient.List(ctx, metav1.ListOptions{LabelSelector: set.AsSelector().String()})
+	if err != nil {
+		return err
+	}
+
+	for _, deployment := range deployments.Items {
+		deployment := deployment
+		if deployment.Annotations == nil {
+			deployment.Annotations = map[string]string{}
+		}
+		deployment.Annotations[lastUploadAnnotation] = requestedAt.UTC().Format(time.RFC3339)
+		if _, err = depclient.Update(ctx, &deployment, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uploadTransferRequest converts an upload request into the request sent to the
+// file transfer sidecar. Incremental uploads fall back to uploading everything
+// if nothing has been uploaded successfully yet.
+func (i *Internal) uploadTransferRequest(ctx context.Context, externalID string, upload *UploadRequest) (*transferRequest, error) {
+	request := &transferRequest{
+		Include: upload.Include,
+		Exclude: upload.Exclude,
+		Paths:   upload.Paths,
+	}
+
+	if upload.Incremental {
+		lastUpload, ok, err := i.getLastUploadTime(ctx, externalID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			request.ChangedSince = lastUpload.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return request, nil
+}
+
+// triggerUploads starts an upload for the analysis using the request body.
+func (i *Internal) triggerUploads(c echo.Context, externalID string) error {
+	ctx := c.Request().Context()
+
+	upload, err := bindUploadRequest(c)
+	if err != nil {
+		return err
+	}
+
+	request, err := i.uploadTransferRequest(ctx, externalID, upload)
+	if err != nil {
+		return err
+	}
+
+	return i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, request, true)
+}
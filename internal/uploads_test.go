@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestUploadRequestValidate(t *testing.T) {
+	tests := []struct {
+		description string
+		request     UploadRequest
+		valid       bool
+	}{
+		{"empty request", UploadRequest{}, true},
+		{"globs and paths", UploadRequest{Include: []string{"*.csv"}, Exclude: []string{"tmp/*"}, Paths: []string{"results/"}}, true},
+		{"invalid glob", UploadRequest{Include: []string{"[a-"}}, false},
+		{"absolute path", UploadRequest{Paths: []string{"/etc/passwd"}}, false},
+		{"path outside of the working directory", UploadRequest{Paths: []string{"results/../../secrets"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.request.validate()
+		if test.valid {
+			assert.NoError(t, err, test.description)
+		} else {
+			assert.Error(t, err, test.description)
+		}
+	}
+}
+
+func TestBindUploadRequest(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+
+	// The body is optional.
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	upload, err := bindUploadRequest(e.NewContext(req, httptest.NewRecorder()))
+	if assert.NoError(err) {
+		assert.Equal(&UploadRequest{}, upload)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"include": ["*.csv"], "incremental": true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	upload, err = bindUploadRequest(e.NewContext(req, httptest.NewRecorder()))
+	if assert.NoError(err) {
+		assert.Equal([]string{"*.csv"}, upload.Include)
+		assert.True(upload.Incremental)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"paths": ["/etc"]}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	_, err = bindUploadRequest(e.NewContext(req, httptest.NewRecorder()))
+	if assert.Error(err) {
+		errResp, ok := err.(common.ErrorResponse)
+		if assert.True(ok) {
+			assert.Equal(http.StatusBadRequest, errResp.StatusCode())
+		}
+	}
+}
+
+func TestTransferRequestSelectsFiles(t *testing.T) {
+	var request *transferRequest
+	assert.False(t, request.selectsFiles())
+	assert.False(t, (&transferRequest{ChangedSince: "2022-05-04T12:30:00Z"}).selectsFiles())
+	assert.True(t, (&transferRequest{Include: []string{"*.csv"}}).selectsFiles())
+	assert.True(t, (&transferRequest{Exclude: []string{"*.tmp"}}).selectsFiles())
+	assert.True(t, (&transferRequest{Paths: []string{"results"}}).selectsFiles())
+}
+
+func TestIncrementalUploads(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive"})
+	internal, _ := setupInternal(t, []runtime.Object{deployment})
+	ctx := context.Background()
+	upload := &UploadRequest{Include: []string{"*.csv"}, Incremental: true}
+
+	// Nothing has been uploaded yet, so everything is uploaded.
+	request, err := internal.uploadTransferRequest(ctx, "external-id", upload)
+	if assert.NoError(err) {
+		assert.Equal([]string{"*.csv"}, request.Include)
+		assert.Empty(request.ChangedSince)
+	}
+
+	uploadedAt := time.Date(2022, 5, 4, 12, 30, 0, 0, time.UTC)
+	if !assert.NoError(internal.recordUpload(ctx, "external-id", uploadedAt)) {
+		return
+	}
+
+	request, err = internal.uploadTransferRequest(ctx, "external-id", upload)
+	if assert.NoError(err) {
+		assert.Equal("2022-05-04T12:30:00Z", request.ChangedSince)
+	}
+
+	// Full uploads ignore the time of the last upload.
+	upload.Incremental = false
+	request, err = internal.uploadTransferRequest(ctx, "external-id", upload)
+	if assert.NoError(err) {
+		assert.Empty(request.ChangedSince)
+	}
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/header"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// usageReportedAtAnnotation records the last time that usage was reported
+	// to QMS for a VICE deployment.
+	usageReportedAtAnnotation = "usage-reported-at"
+
+	cpuHoursResource    = "cpu.hours"
+	memoryHoursResource = "mem.gib.hours"
+	gpuHoursResource    = "gpu.hours"
+
+	usageStarted = "started"
+	usageRunning = "running"
+	usageStopped = "stopped"
+)
+
+// UsageEvent is published to QMS to record the resources consumed by a VICE
+// analysis. The field names match the ones QMS expects for usage updates.
+type UsageEvent struct {
+	Username     string  `json:"username"`
+	ResourceName string  `json:"resource_name"`
+	UsageValue   float64 `json:"usage_value"`
+	UpdateType   string  `json:"update_type"`
+	ExternalID   string  `json:"external_id"`
+	Event        string  `json:"event"`
+}
+
+// reservedResources contains the resources reserved for the analysis container
+// of a VICE deployment.
+type reservedResources struct {
+	cpuCores  float64
+	memoryGiB float64
+	gpus      float64
+}
+
+// getReservedResources returns the resource limits of the analysis container in
+// the deployment.
+func getReservedResources(deployment *appsv1.Deployment) reservedResources {
+	var reserved reservedResources
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		limits := container.Resources.Limits
+		if cpu, ok := limits[apiv1.ResourceCPU]; ok {
+			reserved.cpuCores = float64(cpu.MilliValue()) / 1000
+		}
+		if mem, ok := limits[apiv1.ResourceMemory]; ok {
+			reserved.memoryGiB = float64(mem.Value()) / (1024 * 1024 * 1024)
+		}
+		if gpu, ok := limits[apiv1.ResourceName("nvidia.com/gpu")]; ok {
+			reserved.gpus = float64(gpu.Value())
+		}
+	}
+	return reserved
+}
+
+// usageEvents builds the events reporting the usage of the reserved resources
+// over the elapsed time. Resources that weren't reserved aren't reported.
+func usageEvents(username, externalID, event string, reserved reservedResources, elapsed time.Duration) []UsageEvent {
+	hours := elapsed.Hours()
+	amounts := []struct {
+		resource string
+		reserved float64
+	}{
+		{cpuHoursResource, reserved.cpuCores},
+		{memoryHoursResource, reserved.memoryGiB},
+		{gpuHoursResource, reserved.gpus},
+	}
+
+	events := []UsageEvent{}
+	for _, amount := range amounts {
+		if amount.reserved <= 0 {
+			continue
+		}
+		events = append(events, UsageEvent{
+			Username:     username,
+			ResourceName: amount.resource,
+			UsageValue:   amount.reserved * hours,
+			UpdateType:   "ADD",
+			ExternalID:   externalID,
+			Event:        event,
+		})
+	}
+	return events
+}
+
+// message returns the event as a protocol buffer message that can be sent
+// through the encoded NATS connection. There isn't a message type for usage
+// updates in the qms package, so a Struct with the same fields as the JSON
+// encoding of the event is used. The header carries the trace context.
+func (e *UsageEvent) message(hdr *header.Header) (*structpb.Struct, error) {
+	fields := map[string]interface{}{}
+
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+
+	encoded, err = protojson.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+	hdrFields := map[string]interface{}{}
+	if err = json.Unmarshal(encoded, &hdrFields); err != nil {
+		return nil, err
+	}
+	fields["header"] = hdrFields
+
+	return structpb.NewStruct(fields)
+}
+
+// publishUsage sends usage events to QMS.
+func (i *Internal) publishUsage(ctx context.Context, events []UsageEvent) error {
+	if i.NATSEncodedConn == nil {
+		return errors.New("no NATS connection is available for publishing usage events")
+	}
+
+	for _, event := range events {
+		hdr := gotelnats.NewHeader()
+		carrier := gotelnats.PBTextMapCarrier{Header: hdr}
+		_, span := gotelnats.InjectSpan(ctx, &carrier, i.UsageSubject, gotelnats.Send)
+
+		msg, err := event.message(hdr)
+		if err == nil {
+			err = i.NATSEncodedConn.Publish(i.UsageSubject, msg)
+		}
+		span.End()
+		if err != nil {
+			return errors.Wrapf(err, "unable to publish %s usage for %s", event.ResourceName, event.ExternalID)
+		}
+	}
+
+	return nil
+}
+
+// deploymentUsername returns the username of the user who launched the
+// analysis in the deployment.
+func (i *Internal) deploymentUsername(ctx context.Context, deployment *appsv1.Deployment) (string, error) {
+	userID, ok := deployment.Labels["user-id"]
+	if !ok {
+		return "", errors.Errorf("deployment %s does not have a user-id label", deployment.Name)
+	}
+	return i.apps.GetUsername(ctx, userID)
+}
+
+// usageSinceLastReport returns the time elapsed since usage was last reported
+// for the deployment.
+func usageSinceLastReport(deployment *appsv1.Deployment, now time.Time) (time.Duration, error) {
+	reportedAt, ok := deployment.Annotations[usageReportedAtAnnotation]
+	if !ok {
+		return 0, errors.Errorf("deployment %s does not have the %s annotation", deployment.Name, usageReportedAtAnnotation)
+	}
+	last, err := time.Parse(time.RFC3339, reportedAt)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to parse the %s annotation on %s", usageReportedAtAnnotation, deployment.Name)
+	}
+	return now.Sub(last), nil
+}
+
+// setUsageReportedAt records the time that usage was last reported in the
+// deployment's annotations.
+func setUsageReportedAt(deployment *appsv1.Deployment, t time.Time) {
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	deployment.Annotations[usageReportedAtAnnotation] = t.UTC().Format(time.RFC3339)
+}
+
+// usageReportedAtPatch returns a merge patch that sets the time that usage was
+// last reported on the deployment. The patch includes the deployment's
+// resource version, so it fails if the deployment has changed since it was
+// read.
+func usageReportedAtPatch(deployment *appsv1.Deployment, t time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": deployment.ResourceVersion,
+			"annotations": map[string]string{
+				usageReportedAtAnnotation: t.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+}
+
+// reportUsageStarted tells QMS that an analysis has started. No usage has been
+// accrued yet, so the events have a usage value of zero.
+func (i *Internal) reportUsageStarted(ctx context.Context, username string, deployment *appsv1.Deployment) {
+	if !i.ReportUsage {
+		return
+	}
+
+	externalID := deployment.Labels["external-id"]
+	events := usageEvents(i.fixUsername(username), externalID, usageStarted, getReservedResources(deployment), 0)
+	if err := i.publishUsage(ctx, events); err != nil {
+		log.Error(err)
+	}
+}
+
+// reportUsageStopped reports the usage accrued by an analysis since the last
+// report. It's called just before the deployment is deleted.
+func (i *Internal) reportUsageStopped(ctx context.Context, deployment *appsv1.Deployment) {
+	if !i.ReportUsage {
+		return
+	}
+
+	elapsed, err := usageSinceLastReport(deployment, time.Now())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	username, err := i.deploymentUsername(ctx, deployment)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "unable to look up the user for %s", deployment.Name))
+		return
+	}
+
+	externalID := deployment.Labels["external-id"]
+	events := usageEvents(username, externalID, usageStopped, getReservedResources(deployment), elapsed)
+	if err = i.publishUsage(ctx, events); err != nil {
+		log.Error(err)
+	}
+}
+
+// ReportRunningUsage reports the usage accrued since the last report for every
+// running VICE analysis. The annotation recording the time of the last report
+// is patched before the usage is published, so a conflicting change from
+// elsewhere causes the report to be skipped rather than counted twice.
+func (i *Internal) ReportRunningUsage(ctx context.Context) []error {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "ReportRunningUsage")
+	defer span.End()
+
+	errs := []error{}
+
+	deployments, err := i.deploymentList(ctx, i.ViceNamespace, map[string]string{}, []string{})
+	if err != nil {
+		return append(errs, err)
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	for _, deployment := range deployments.Items {
+		deployment := deployment
+		now := time.Now()
+
+		// Deployments created before usage reporting was enabled start
+		// accruing usage now.
+		elapsed, err := usageSinceLastReport(&deployment, now)
+		if err != nil {
+			elapsed = 0
+		}
+
+		patch, err := usageReportedAtPatch(&deployment, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err = depclient.Patch(ctx, deployment.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to record the usage report time for %s", deployment.Name))
+			continue
+		}
+
+		if elapsed <= 0 {
+			continue
+		}
+
+		username, err := i.deploymentUsername(ctx, &deployment)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to look up the user for %s", deployment.Name))
+			continue
+		}
+
+		externalID := deployment.Labels["external-id"]
+		events := usageEvents(username, externalID, usageRunning, getReservedResources(&deployment), elapsed)
+		if err = i.publishUsage(ctx, events); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
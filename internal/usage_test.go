@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/header"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// usageDeployment creates a fake VICE deployment with the given resource limits
+// on the analysis container.
+func usageDeployment(limits apiv1.ResourceList) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "analysis",
+			Labels: map[string]string{"external-id": "external-id"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{Name: viceProxyContainerName},
+						{
+							Name:      analysisContainerName,
+							Resources: apiv1.ResourceRequirements{Limits: limits},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGetReservedResources(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := usageDeployment(apiv1.ResourceList{
+		apiv1.ResourceCPU:                    resource.MustParse("1500m"),
+		apiv1.ResourceMemory:                 resource.MustParse("4Gi"),
+		apiv1.ResourceName("nvidia.com/gpu"): resource.MustParse("1"),
+	})
+
+	reserved := getReservedResources(deployment)
+	assert.Equal(1.5, reserved.cpuCores)
+	assert.Equal(4.0, reserved.memoryGiB)
+	assert.Equal(1.0, reserved.gpus)
+}
+
+func TestUsageEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	reserved := reservedResources{cpuCores: 2, memoryGiB: 8}
+	events := usageEvents("ipcdev@example.org", "external-id", usageRunning, reserved, 30*time.Minute)
+
+	// GPUs weren't reserved, so GPU usage isn't reported.
+	assert.Len(events, 2)
+	assert.Equal(cpuHoursResource, events[0].ResourceName)
+	assert.Equal(1.0, events[0].UsageValue)
+	assert.Equal(memoryHoursResource, events[1].ResourceName)
+	assert.Equal(4.0, events[1].UsageValue)
+	for _, event := range events {
+		assert.Equal("ipcdev@example.org", event.Username)
+		assert.Equal("external-id", event.ExternalID)
+		assert.Equal(usageRunning, event.Event)
+		assert.Equal("ADD", event.UpdateType)
+	}
+}
+
+func TestUsageSinceLastReport(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := usageDeployment(apiv1.ResourceList{})
+	now := time.Now()
+
+	_, err := usageSinceLastReport(deployment, now)
+	assert.Error(err, "deployments without the annotation should be rejected")
+
+	// The annotation only has a resolution of one second.
+	setUsageReportedAt(deployment, now.Add(-time.Hour))
+	elapsed, err := usageSinceLastReport(deployment, now)
+	assert.NoError(err)
+	assert.Equal(time.Hour, elapsed.Truncate(time.Second))
+}
+
+func TestUsageEventMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	event := UsageEvent{
+		Username:     "ipcdev@example.org",
+		ResourceName: cpuHoursResource,
+		UsageValue:   1.5,
+		UpdateType:   "ADD",
+		ExternalID:   "external-id",
+		Event:        usageRunning,
+	}
+	hdr := gotelnats.NewHeader()
+	hdr.Map["traceparent"] = &header.Header_Value{Value: []string{"trace"}}
+
+	msg, err := event.message(hdr)
+	if !assert.NoError(err) {
+		return
+	}
+
+	fields := msg.AsMap()
+	assert.Equal("ipcdev@example.org", fields["username"])
+	assert.Equal(cpuHoursResource, fields["resource_name"])
+	assert.Equal(1.5, fields["usage_value"])
+	assert.Equal("external-id", fields["external_id"])
+	assert.Equal(map[string]interface{}{
+		"map": map[string]interface{}{
+			"traceparent": map[string]interface{}{"value": []interface{}{"trace"}},
+		},
+	}, fields["header"])
+}
+
+func TestReportRunningUsageRecordsTime(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive"})
+	internal, _ := setupInternal(t, []runtime.Object{deployment})
+	ctx := context.Background()
+
+	// Deployments that haven't been reported on before start accruing usage
+	// now, so there's nothing to publish yet.
+	assert.Empty(internal.ReportRunningUsage(ctx))
+
+	updated, err := internal.clientset.AppsV1().Deployments(internal.ViceNamespace).Get(ctx, deployment.Name, meta_v1.GetOptions{})
+	if assert.NoError(err) {
+		_, err = usageSinceLastReport(updated, time.Now())
+		assert.NoError(err)
+		assert.Equal(deployment.Spec, updated.Spec)
+	}
+}
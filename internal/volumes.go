@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/cyverse-de/model/v6"
@@ -27,6 +29,126 @@ type IRODSFSPathMapping struct {
 	IgnoreNotExistError bool   `yaml:"ignore_not_exist_error" json:"ignore_not_exist_error"`
 }
 
+// DataMapping is a configured iRODS collection or data object that gets mounted
+// into VICE analyses through the CSI driver, in addition to the inputs, output
+// directory, home directory and shared collection. If AppIDs is empty then the
+// mapping is used for every app; otherwise it's only used for the listed apps.
+type DataMapping struct {
+	IRODSPath           string   `koanf:"irods_path" json:"irods_path"`
+	MountPath           string   `koanf:"mount_path" json:"mount_path"`
+	ResourceType        string   `koanf:"resource_type" json:"resource_type"`
+	ReadOnly            bool     `koanf:"read_only" json:"read_only"`
+	IgnoreNotExistError bool     `koanf:"ignore_not_exist_error" json:"ignore_not_exist_error"`
+	AppIDs              []string `koanf:"app_ids" json:"app_ids"`
+}
+
+// appliesTo returns true if the mapping should be mounted for the job.
+func (d *DataMapping) appliesTo(job *model.Job) bool {
+	if len(d.AppIDs) == 0 {
+		return true
+	}
+	for _, appID := range d.AppIDs {
+		if appID == job.AppID {
+			return true
+		}
+	}
+	return false
+}
+
+// pathMapping converts the configured mapping into the format used by the CSI
+// driver. The mount path defaults to the iRODS path, as it does for the home
+// and shared collections.
+func (d *DataMapping) pathMapping() IRODSFSPathMapping {
+	mountPath := d.MountPath
+	if mountPath == "" {
+		mountPath = d.IRODSPath
+	}
+
+	resourceType := d.ResourceType
+	if resourceType == "" {
+		resourceType = "dir"
+	}
+
+	return IRODSFSPathMapping{
+		IRODSPath:           d.IRODSPath,
+		MappingPath:         mountPath,
+		ResourceType:        resourceType,
+		ReadOnly:            d.ReadOnly,
+		CreateDir:           false,
+		IgnoreNotExistError: d.IgnoreNotExistError,
+	}
+}
+
+// ValidateDataMappings checks the configured data mappings for problems that
+// would keep the CSI driver from mounting them. Conflicts with the mappings
+// generated for each analysis are caught when the analysis is launched.
+func ValidateDataMappings(dataMappings []DataMapping) error {
+	pathMappings := []IRODSFSPathMapping{}
+	for _, dataMapping := range dataMappings {
+		if dataMapping.IRODSPath == "" {
+			return fmt.Errorf("a data mapping is missing its iRODS path")
+		}
+		pathMapping := dataMapping.pathMapping()
+		if !filepath.IsAbs(pathMapping.MappingPath) {
+			return fmt.Errorf("the mount path %s for %s is not absolute", pathMapping.MappingPath, pathMapping.IRODSPath)
+		}
+		if pathMapping.ResourceType != "file" && pathMapping.ResourceType != "dir" {
+			return fmt.Errorf("unknown resource type %s for %s", pathMapping.ResourceType, pathMapping.IRODSPath)
+		}
+		pathMappings = append(pathMappings, pathMapping)
+	}
+	return checkPathMappingConflicts(pathMappings)
+}
+
+// checkPathMappingConflicts returns an error if more than one mapping would be
+// mounted at the same path.
+func checkPathMappingConflicts(mappings []IRODSFSPathMapping) error {
+	// key = mount path, val = irods path
+	mappingMap := map[string]string{}
+	for _, mapping := range mappings {
+		mountPath := filepath.Clean(mapping.MappingPath)
+		if existingIRODSPath, ok := mappingMap[mountPath]; ok {
+			return fmt.Errorf("tried to mount %s at %s already used by - %s", mapping.IRODSPath, mountPath, existingIRODSPath)
+		}
+		mappingMap[mountPath] = mapping.IRODSPath
+	}
+	return nil
+}
+
+// ParseCapacityBound parses one of the configured bounds on the capacity of CSI
+// volumes. Bounds that aren't set are returned as nil.
+func ParseCapacityBound(bound string) (*resourcev1.Quantity, error) {
+	if bound == "" {
+		return nil, nil
+	}
+	value, err := resourcev1.ParseQuantity(bound)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// getCSIVolumeCapacity returns the capacity of the CSI data volume and its
+// claim. It's based on the minimum disk space required by the job, limited to
+// the configured bounds.
+func (i *Internal) getCSIVolumeCapacity(job *model.Job) resourcev1.Quantity {
+	capacity := defaultStorageCapacity
+
+	if disk := job.DiskRequest(); disk > 0 {
+		capacity = *resourcev1.NewQuantity(disk, resourcev1.BinarySI)
+	}
+
+	if i.CSIVolumeMinCapacity != nil && capacity.Cmp(*i.CSIVolumeMinCapacity) < 0 {
+		capacity = *i.CSIVolumeMinCapacity
+	}
+
+	if i.CSIVolumeMaxCapacity != nil && capacity.Cmp(*i.CSIVolumeMaxCapacity) > 0 {
+		capacity = *i.CSIVolumeMaxCapacity
+	}
+
+	return capacity
+}
+
 func (i *Internal) getZoneMountPath() string {
 	return fmt.Sprintf("%s/%s", csiDriverLocalMountPath, i.IRODSZone)
 }
@@ -43,11 +165,92 @@ func (i *Internal) getCSIDataVolumeClaimName(job *model.Job) string {
 	return fmt.Sprintf("%s-%s", csiDriverDataVolumeClaimNamePrefix, job.InvocationID)
 }
 
+const (
+	// inputCollisionSubdir mounts inputs with the same name in numbered
+	// subdirectories, e.g. /input/2/data.csv.
+	inputCollisionSubdir = "subdir"
+
+	// inputCollisionSuffix adds a number to the names of inputs with the same
+	// name, e.g. /input/data_2.csv.
+	inputCollisionSuffix = "suffix"
+)
+
+// inputMountPaths keeps track of the paths that are already in use in the
+// input directory.
+type inputMountPaths struct {
+	// key = mount path, val = irods path
+	files map[string]string
+
+	// directories created to hold inputs with colliding names.
+	dirs map[string]bool
+}
+
+func newInputMountPaths() *inputMountPaths {
+	return &inputMountPaths{
+		files: map[string]string{},
+		dirs:  map[string]bool{},
+	}
+}
+
+// available returns true if nothing is mounted at the path or at its parent
+// directory.
+func (m *inputMountPaths) available(mountPath string) bool {
+	if _, ok := m.files[mountPath]; ok {
+		return false
+	}
+	if m.dirs[mountPath] {
+		return false
+	}
+	if _, ok := m.files[path.Dir(mountPath)]; ok {
+		return false
+	}
+	return true
+}
+
+// add records the mount path of an input.
+func (m *inputMountPaths) add(mountPath, irodsPath string) {
+	m.files[mountPath] = irodsPath
+	if dir := path.Dir(mountPath); dir != csiDriverInputVolumeMountPath {
+		m.dirs[dir] = true
+	}
+}
+
+// inputMountPath returns the path where the input will be mounted. Inputs are
+// mounted at /input/<basename> unless another input is already mounted there,
+// in which case the collision strategy determines where it goes instead.
+func (i *Internal) inputMountPath(irodsPath string, used *inputMountPaths) string {
+	base := filepath.Base(irodsPath)
+	mountPath := path.Join(csiDriverInputVolumeMountPath, base)
+
+	for n := 2; !used.available(mountPath); n++ {
+		switch i.InputCollisionStrategy {
+		case inputCollisionSuffix:
+			ext := filepath.Ext(base)
+			name := fmt.Sprintf("%s_%d%s", strings.TrimSuffix(base, ext), n, ext)
+			mountPath = path.Join(csiDriverInputVolumeMountPath, name)
+		default:
+			mountPath = path.Join(csiDriverInputVolumeMountPath, strconv.Itoa(n), base)
+		}
+	}
+
+	used.add(mountPath, irodsPath)
+	return mountPath
+}
+
+// getInputPathMappings returns the path mappings for the inputs that don't have
+// tickets, which are mounted using the submitter's identity.
 func (i *Internal) getInputPathMappings(job *model.Job) ([]IRODSFSPathMapping, error) {
+	mappings, _, err := i.getAllInputPathMappings(job)
+	return mappings, err
+}
+
+// getAllInputPathMappings returns the path mappings for all of the job's
+// inputs. Inputs with tickets are grouped by ticket since each ticket needs a
+// volume of its own. All of the inputs are given distinct mount paths.
+func (i *Internal) getAllInputPathMappings(job *model.Job) ([]IRODSFSPathMapping, []ticketInputMappings, error) {
 	mappings := []IRODSFSPathMapping{}
-	// mark if the mapping path is already occupied
-	// key = mount path, val = irods path
-	mappingMap := map[string]string{}
+	ticketMappings := []ticketInputMappings{}
+	used := newInputMountPaths()
 
 	// Mount the input and output files.
 	for _, step := range job.Steps {
@@ -63,31 +266,34 @@ func (i *Internal) getInputPathMappings(job *model.Job) ([]IRODSFSPathMapping, e
 					resourceType = "dir"
 				} else {
 					// unknown
-					return nil, fmt.Errorf("unknown step input type - %s", stepInput.Type)
+					return nil, nil, fmt.Errorf("unknown step input type - %s", stepInput.Type)
 				}
 
-				mountPath := fmt.Sprintf("%s/%s", csiDriverInputVolumeMountPath, filepath.Base(irodsPath))
-				// check if mountPath is already used by other input
-				if existingIRODSPath, ok := mappingMap[mountPath]; ok {
-					// exists - error
-					return nil, fmt.Errorf("tried to mount an input file %s at %s already used by - %s", irodsPath, mountPath, existingIRODSPath)
-				}
-				mappingMap[mountPath] = irodsPath
-
 				mapping := IRODSFSPathMapping{
 					IRODSPath:           irodsPath,
-					MappingPath:         mountPath,
+					MappingPath:         i.inputMountPath(irodsPath, used),
 					ResourceType:        resourceType,
 					ReadOnly:            true,
 					CreateDir:           false,
 					IgnoreNotExistError: true,
 				}
 
-				mappings = append(mappings, mapping)
+				if stepInput.Ticket != "" {
+					ticketMappings = addTicketInputMapping(ticketMappings, stepInput.Ticket, mapping)
+				} else {
+					mappings = append(mappings, mapping)
+				}
 			}
 		}
 	}
-	return mappings, nil
+	return mappings, ticketMappings, nil
+}
+
+// InputManifestEntry records where an input from iRODS can be found inside of
+// the analysis container.
+type InputManifestEntry struct {
+	IRODSPath string `json:"irods_path"`
+	Path      string `json:"path"`
 }
 
 func (i *Internal) getOutputPathMapping(job *model.Job) IRODSFSPathMapping {
@@ -128,174 +334,314 @@ func (i *Internal) getSharedPathMapping(job *model.Job) IRODSFSPathMapping {
 	}
 }
 
+// getConfiguredPathMappings returns the configured data mappings that apply to
+// the job.
+func (i *Internal) getConfiguredPathMappings(job *model.Job) []IRODSFSPathMapping {
+	mappings := []IRODSFSPathMapping{}
+	for _, dataMapping := range i.DataMappings {
+		if dataMapping.appliesTo(job) {
+			mappings = append(mappings, dataMapping.pathMapping())
+		}
+	}
+	return mappings
+}
+
+// getDataPathMappings returns all of the path mappings for the job's data
+// volume.
+func (i *Internal) getDataPathMappings(job *model.Job) ([]IRODSFSPathMapping, error) {
+	dataPathMappings := []IRODSFSPathMapping{}
+
+	// input output path
+	inputPathMappings, err := i.getInputPathMappings(job)
+	if err != nil {
+		return nil, err
+	}
+	dataPathMappings = append(dataPathMappings, inputPathMappings...)
+
+	outputPathMapping := i.getOutputPathMapping(job)
+	dataPathMappings = append(dataPathMappings, outputPathMapping)
+
+	// home path
+	if job.UserHome != "" {
+		homePathMapping := i.getHomePathMapping(job)
+		dataPathMappings = append(dataPathMappings, homePathMapping)
+	}
+
+	// shared path
+	if i.MountSharedCollection {
+		sharedPathMapping := i.getSharedPathMapping(job)
+		dataPathMappings = append(dataPathMappings, sharedPathMapping)
+	}
+
+	// configured paths
+	dataPathMappings = append(dataPathMappings, i.getConfiguredPathMappings(job)...)
+
+	if err = checkPathMappingConflicts(dataPathMappings); err != nil {
+		return nil, err
+	}
+
+	return dataPathMappings, nil
+}
+
 func (i *Internal) getCSIDataVolumeLabels(ctx context.Context, job *model.Job) (map[string]string, error) {
+	return i.getCSIVolumeLabels(ctx, job, i.getCSIDataVolumeClaimName(job))
+}
+
+// getCSIVolumeLabels returns the labels for a PersistentVolume. The claim
+// selects the volume using the volume-name label.
+func (i *Internal) getCSIVolumeLabels(ctx context.Context, job *model.Job, claimName string) (map[string]string, error) {
 	labels, err := i.labelsFromJob(ctx, job)
 	if err != nil {
 		return nil, err
 	}
 
-	labels["volume-name"] = i.getCSIDataVolumeClaimName(job)
+	labels["volume-name"] = claimName
 	return labels, nil
 }
 
-// getPersistentVolumes returns the PersistentVolumes for the VICE analysis. It does
-// not call the k8s API.
-func (i *Internal) getPersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
-	if i.UseCSIDriver {
-		dataPathMappings := []IRODSFSPathMapping{}
+// irodsStorage mounts data from iRODS using the iRODS CSI driver. Inputs, the
+// output directory, the user's home directory, the shared collection and any
+// configured data mappings are all mounted through a single volume.
+type irodsStorage struct {
+	internal *Internal
+}
 
-		// input output path
-		inputPathMappings, err := i.getInputPathMappings(job)
-		if err != nil {
-			return nil, err
-		}
-		dataPathMappings = append(dataPathMappings, inputPathMappings...)
+func (s *irodsStorage) Name() string {
+	return irodsStorageProvider
+}
 
-		outputPathMapping := i.getOutputPathMapping(job)
-		dataPathMappings = append(dataPathMappings, outputPathMapping)
+// PersistentVolumes returns the PersistentVolumes for the VICE analysis. It
+// does not call the k8s API.
+func (s *irodsStorage) PersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+	i := s.internal
 
-		// home path
-		if job.UserHome != "" {
-			homePathMapping := i.getHomePathMapping(job)
-			dataPathMappings = append(dataPathMappings, homePathMapping)
-		}
+	dataPathMappings, err := i.getDataPathMappings(job)
+	if err != nil {
+		return nil, err
+	}
 
-		// shared path
-		sharedPathMapping := i.getSharedPathMapping(job)
-		dataPathMappings = append(dataPathMappings, sharedPathMapping)
+	dataVolumeLabels, err := i.getCSIDataVolumeLabels(ctx, job)
+	if err != nil {
+		return nil, err
+	}
 
-		// convert path mappings into json
-		dataPathMappingsJSONBytes, err := json.Marshal(dataPathMappings)
-		if err != nil {
-			return nil, err
-		}
+	dataVolume, err := i.irodsPersistentVolume(
+		job,
+		i.getCSIDataVolumeName(job),
+		i.getCSIDataVolumeHandle(job),
+		dataVolumeLabels,
+		dataPathMappings,
+		"",
+	)
+	if err != nil {
+		return nil, err
+	}
 
-		volmode := apiv1.PersistentVolumeFilesystem
-		persistentVolumes := []*apiv1.PersistentVolume{}
+	ticketVolumes, err := i.getTicketPersistentVolumes(ctx, job)
+	if err != nil {
+		return nil, err
+	}
 
-		dataVolumeLabels, err := i.getCSIDataVolumeLabels(ctx, job)
-		if err != nil {
-			return nil, err
-		}
+	return append([]*apiv1.PersistentVolume{dataVolume}, ticketVolumes...), nil
+}
+
+// irodsPersistentVolume returns a PersistentVolume that mounts the path
+// mappings with the iRODS CSI driver. The data is accessed as the submitter
+// unless a ticket is provided.
+func (i *Internal) irodsPersistentVolume(
+	job *model.Job,
+	name, handle string,
+	labels map[string]string,
+	pathMappings []IRODSFSPathMapping,
+	ticket string,
+) (*apiv1.PersistentVolume, error) {
+	// convert path mappings into json
+	pathMappingsJSONBytes, err := json.Marshal(pathMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeAttributes := map[string]string{
+		"client":              "irodsfuse",
+		"path_mapping_json":   string(pathMappingsJSONBytes),
+		"no_permission_check": "true",
+		// use proxy access
+		"clientUser": job.Submitter,
+		"uid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
+		"gid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
+	}
+	if ticket != "" {
+		volumeAttributes["ticket"] = ticket
+	}
 
-		dataVolume := &apiv1.PersistentVolume{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:   i.getCSIDataVolumeName(job),
-				Labels: dataVolumeLabels,
+	volmode := apiv1.PersistentVolumeFilesystem
+
+	return &apiv1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: apiv1.PersistentVolumeSpec{
+			Capacity: apiv1.ResourceList{
+				apiv1.ResourceStorage: i.getCSIVolumeCapacity(job),
 			},
-			Spec: apiv1.PersistentVolumeSpec{
-				Capacity: apiv1.ResourceList{
-					apiv1.ResourceStorage: defaultStorageCapacity,
-				},
-				VolumeMode: &volmode,
-				AccessModes: []apiv1.PersistentVolumeAccessMode{
-					apiv1.ReadWriteMany,
-				},
-				PersistentVolumeReclaimPolicy: apiv1.PersistentVolumeReclaimRetain,
-				StorageClassName:              csiDriverStorageClassName,
-				PersistentVolumeSource: apiv1.PersistentVolumeSource{
-					CSI: &apiv1.CSIPersistentVolumeSource{
-						Driver:       csiDriverName,
-						VolumeHandle: i.getCSIDataVolumeHandle(job),
-						VolumeAttributes: map[string]string{
-							"client":              "irodsfuse",
-							"path_mapping_json":   string(dataPathMappingsJSONBytes),
-							"no_permission_check": "true",
-							// use proxy access
-							"clientUser": job.Submitter,
-							"uid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
-							"gid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
-						},
-					},
+			VolumeMode: &volmode,
+			AccessModes: []apiv1.PersistentVolumeAccessMode{
+				apiv1.ReadWriteMany,
+			},
+			PersistentVolumeReclaimPolicy: apiv1.PersistentVolumeReclaimRetain,
+			StorageClassName:              csiDriverStorageClassName,
+			PersistentVolumeSource: apiv1.PersistentVolumeSource{
+				CSI: &apiv1.CSIPersistentVolumeSource{
+					Driver:           csiDriverName,
+					VolumeHandle:     handle,
+					VolumeAttributes: volumeAttributes,
 				},
 			},
-		}
+		},
+	}, nil
+}
+
+// PersistentVolumeClaims returns the PersistentVolumeClaims for the VICE
+// analysis. It does not call the k8s API.
+func (s *irodsStorage) PersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
+	claims, err := s.internal.csiDataVolumeClaims(ctx, job, csiDriverStorageClassName)
+	if err != nil {
+		return nil, err
+	}
 
-		persistentVolumes = append(persistentVolumes, dataVolume)
-		return persistentVolumes, nil
+	ticketClaims, err := s.internal.getTicketPersistentVolumeClaims(ctx, job)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	return append(claims, ticketClaims...), nil
 }
 
-// getPersistentVolumeClaims returns the PersistentVolumes for the VICE analysis. It does
-// not call the k8s API.
-func (i *Internal) getPersistentVolumeClaims(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolumeClaim, error) {
-	if i.UseCSIDriver {
-		labels, err := i.labelsFromJob(ctx, job)
-		if err != nil {
-			return nil, err
-		}
+// Volumes returns the volumes for the VICE analysis. It does not call the k8s
+// API.
+func (s *irodsStorage) Volumes(job *model.Job) ([]*apiv1.Volume, error) {
+	return append(s.internal.csiDataVolumeSources(job), s.internal.getTicketVolumeSources(job)...), nil
+}
 
-		storageclassname := csiDriverStorageClassName
-		volumeClaims := []*apiv1.PersistentVolumeClaim{}
+// VolumeMounts returns the volume mounts for the VICE analysis. It does not
+// call the k8s API.
+func (s *irodsStorage) VolumeMounts(job *model.Job) []*apiv1.VolumeMount {
+	return append(s.internal.csiDataVolumeMounts(job, false), s.internal.getTicketVolumeMounts(job)...)
+}
 
-		dataVolumeClaim := &apiv1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:   i.getCSIDataVolumeClaimName(job),
-				Labels: labels,
-			},
-			Spec: apiv1.PersistentVolumeClaimSpec{
-				AccessModes: []apiv1.PersistentVolumeAccessMode{
-					apiv1.ReadWriteMany,
-				},
-				StorageClassName: &storageclassname,
-				Selector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"volume-name": i.getCSIDataVolumeClaimName(job),
-					},
-				},
-				Resources: apiv1.ResourceRequirements{
-					Requests: apiv1.ResourceList{
-						apiv1.ResourceStorage: defaultStorageCapacity,
-					},
-				},
-			},
-		}
+// WorkingDirCommands links the data store and the home collections into the
+// working directory.
+func (s *irodsStorage) WorkingDirCommands(job *model.Job) []string {
+	commands := []string{
+		fmt.Sprintf("ln -s \"%s\" \"data\"", csiDriverLocalMountPath),
+		fmt.Sprintf("ln -s \"%s/home\" .", s.internal.getZoneMountPath()),
+	}
+	if len(ticketsUsedByJob(job)) > 0 {
+		commands = append(commands, fmt.Sprintf("ln -s \"%s\" \"ticket-data\"", csiDriverTicketMountPath))
+	}
+	return commands
+}
+
+// InputManifest lists where each of the job's inputs is mounted. Users need it
+// to find inputs that were moved to avoid name collisions.
+func (s *irodsStorage) InputManifest(job *model.Job) ([]InputManifestEntry, error) {
+	mappings, ticketMappings, err := s.internal.getAllInputPathMappings(job)
+	if err != nil {
+		return nil, err
+	}
 
-		volumeClaims = append(volumeClaims, dataVolumeClaim)
-		return volumeClaims, nil
+	entries := []InputManifestEntry{}
+	for _, mapping := range mappings {
+		entries = append(entries, InputManifestEntry{
+			IRODSPath: mapping.IRODSPath,
+			Path:      path.Join(csiDriverLocalMountPath, mapping.MappingPath),
+		})
 	}
 
-	return nil, nil
+	for n, ticketMapping := range ticketMappings {
+		for _, mapping := range ticketMapping.mappings {
+			entries = append(entries, InputManifestEntry{
+				IRODSPath: mapping.IRODSPath,
+				Path:      path.Join(ticketVolumeMountPath(n), mapping.MappingPath),
+			})
+		}
+	}
+
+	return entries, nil
 }
 
-// getPersistentVolumeSources returns the volumes for the VICE analysis. It does
-// not call the k8s API.
-func (i *Internal) getPersistentVolumeSources(job *model.Job) ([]*apiv1.Volume, error) {
-	if i.UseCSIDriver {
-		volumes := []*apiv1.Volume{}
+// csiDataVolumeClaims returns the claim for the data volume created for the
+// analysis.
+func (i *Internal) csiDataVolumeClaims(ctx context.Context, job *model.Job, storageClassName string) ([]*apiv1.PersistentVolumeClaim, error) {
+	dataVolumeClaim, err := i.csiVolumeClaim(ctx, job, i.getCSIDataVolumeClaimName(job), storageClassName)
+	if err != nil {
+		return nil, err
+	}
+	return []*apiv1.PersistentVolumeClaim{dataVolumeClaim}, nil
+}
+
+// csiVolumeClaim returns a claim for one of the volumes created for the
+// analysis. The claim is bound to the volume using the volume-name label.
+func (i *Internal) csiVolumeClaim(ctx context.Context, job *model.Job, claimName, storageClassName string) (*apiv1.PersistentVolumeClaim, error) {
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
 
-		dataVolume := &apiv1.Volume{
-			Name: i.getCSIDataVolumeClaimName(job),
-			VolumeSource: apiv1.VolumeSource{
-				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
-					ClaimName: i.getCSIDataVolumeClaimName(job),
+	return &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   claimName,
+			Labels: labels,
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{
+				apiv1.ReadWriteMany,
+			},
+			StorageClassName: &storageClassName,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"volume-name": claimName,
 				},
 			},
-		}
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: i.getCSIVolumeCapacity(job),
+				},
+			},
+		},
+	}, nil
+}
 
-		volumes = append(volumes, dataVolume)
-		return volumes, nil
+// csiDataVolumeSources returns the volume referring to the claim for the data
+// volume created for the analysis.
+func (i *Internal) csiDataVolumeSources(job *model.Job) []*apiv1.Volume {
+	volumes := []*apiv1.Volume{}
+
+	dataVolume := &apiv1.Volume{
+		Name: i.getCSIDataVolumeClaimName(job),
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: i.getCSIDataVolumeClaimName(job),
+			},
+		},
 	}
 
-	return nil, nil
+	volumes = append(volumes, dataVolume)
+	return volumes
 }
 
-// getPersistentVolumeMounts returns the volume mount for the VICE analysis. It does
-// not call the k8s API.
-func (i *Internal) getPersistentVolumeMounts(job *model.Job) []*apiv1.VolumeMount {
-	if i.UseCSIDriver {
-		volumeMounts := []*apiv1.VolumeMount{}
+// csiDataVolumeMounts returns the mount for the data volume created for the
+// analysis.
+func (i *Internal) csiDataVolumeMounts(job *model.Job, readOnly bool) []*apiv1.VolumeMount {
+	volumeMounts := []*apiv1.VolumeMount{}
 
-		dataVolumeMount := &apiv1.VolumeMount{
-			Name:      i.getCSIDataVolumeClaimName(job),
-			MountPath: csiDriverLocalMountPath,
-		}
-
-		volumeMounts = append(volumeMounts, dataVolumeMount)
-		return volumeMounts
+	dataVolumeMount := &apiv1.VolumeMount{
+		Name:      i.getCSIDataVolumeClaimName(job),
+		MountPath: csiDriverLocalMountPath,
+		ReadOnly:  readOnly,
 	}
 
-	return nil
+	volumeMounts = append(volumeMounts, dataVolumeMount)
+	return volumeMounts
 }
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// csiTestJob creates a job with a home directory for testing the CSI driver
+// path mappings.
+func csiTestJob(appID string) *model.Job {
+	return &model.Job{
+		AppID:     appID,
+		Submitter: "ipcdev",
+		UserHome:  "/iplant/home/ipcdev",
+	}
+}
+
+func TestValidateDataMappings(t *testing.T) {
+	tests := []struct {
+		description  string
+		dataMappings []DataMapping
+		valid        bool
+	}{
+		{
+			description:  "no mappings",
+			dataMappings: []DataMapping{},
+			valid:        true,
+		},
+		{
+			description: "default mount path",
+			dataMappings: []DataMapping{
+				{IRODSPath: "/iplant/home/shared/commons_repo", ReadOnly: true},
+			},
+			valid: true,
+		},
+		{
+			description: "missing iRODS path",
+			dataMappings: []DataMapping{
+				{MountPath: "/community"},
+			},
+			valid: false,
+		},
+		{
+			description: "relative mount path",
+			dataMappings: []DataMapping{
+				{IRODSPath: "/iplant/home/shared/commons_repo", MountPath: "community"},
+			},
+			valid: false,
+		},
+		{
+			description: "unknown resource type",
+			dataMappings: []DataMapping{
+				{IRODSPath: "/iplant/home/shared/commons_repo", ResourceType: "link"},
+			},
+			valid: false,
+		},
+		{
+			description: "duplicate mount paths",
+			dataMappings: []DataMapping{
+				{IRODSPath: "/iplant/home/shared/commons_repo", MountPath: "/community"},
+				{IRODSPath: "/iplant/home/shared/projects", MountPath: "/community/"},
+			},
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		err := ValidateDataMappings(test.dataMappings)
+		if test.valid {
+			assert.NoError(t, err, test.description)
+		} else {
+			assert.Error(t, err, test.description)
+		}
+	}
+}
+
+func TestGetDataPathMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.IRODSZone = "iplant"
+	internal.MountSharedCollection = true
+	internal.DataMappings = []DataMapping{
+		{IRODSPath: "/iplant/home/shared/commons_repo", MountPath: "/community", ReadOnly: true},
+		{IRODSPath: "/iplant/home/shared/reference", ReadOnly: true, AppIDs: []string{"app-1"}},
+	}
+
+	mountPaths := func(mappings []IRODSFSPathMapping) []string {
+		paths := []string{}
+		for _, mapping := range mappings {
+			paths = append(paths, mapping.MappingPath)
+		}
+		return paths
+	}
+
+	mappings, err := internal.getDataPathMappings(csiTestJob("app-1"))
+	if assert.NoError(err) {
+		assert.ElementsMatch([]string{
+			csiDriverOutputVolumeMountPath,
+			"/iplant/home/ipcdev",
+			"/iplant/home/shared",
+			"/community",
+			"/iplant/home/shared/reference",
+		}, mountPaths(mappings))
+	}
+
+	// The reference data is only mounted for the first app.
+	mappings, err = internal.getDataPathMappings(csiTestJob("app-2"))
+	if assert.NoError(err) {
+		assert.NotContains(mountPaths(mappings), "/iplant/home/shared/reference")
+	}
+
+	// The shared collection can be left out.
+	internal.MountSharedCollection = false
+	mappings, err = internal.getDataPathMappings(csiTestJob("app-2"))
+	if assert.NoError(err) {
+		assert.NotContains(mountPaths(mappings), "/iplant/home/shared")
+	}
+
+	// Configured mappings can't be mounted over the generated ones.
+	internal.DataMappings = []DataMapping{
+		{IRODSPath: "/iplant/home/shared/other", MountPath: "/iplant/home/ipcdev"},
+	}
+	_, err = internal.getDataPathMappings(csiTestJob("app-2"))
+	assert.Error(err)
+}
+
+// inputTestJob creates a job with a multi-file selector containing the given
+// files.
+func inputTestJob(paths ...string) *model.Job {
+	inputs := []model.StepInput{}
+	for _, p := range paths {
+		inputs = append(inputs, model.StepInput{
+			Type:         "MultiFileSelector",
+			Multiplicity: "many",
+			Value:        p,
+		})
+	}
+	return &model.Job{
+		InvocationID: "invocation-id",
+		Steps: []model.Step{
+			{Config: model.StepConfig{Inputs: inputs}},
+		},
+	}
+}
+
+func TestGetInputPathMappingsCollisions(t *testing.T) {
+	job := inputTestJob(
+		"/iplant/home/ipcdev/a/data.csv",
+		"/iplant/home/ipcdev/b/data.csv",
+		"/iplant/home/ipcdev/c/data.csv",
+		"/iplant/home/ipcdev/other.txt",
+	)
+
+	tests := []struct {
+		strategy string
+		expected []string
+	}{
+		{
+			strategy: inputCollisionSubdir,
+			expected: []string{"/input/data.csv", "/input/2/data.csv", "/input/3/data.csv", "/input/other.txt"},
+		},
+		{
+			strategy: inputCollisionSuffix,
+			expected: []string{"/input/data.csv", "/input/data_2.csv", "/input/data_3.csv", "/input/other.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		internal, _ := setupInternal(t, nil)
+		internal.InputCollisionStrategy = test.strategy
+
+		mappings, err := internal.getInputPathMappings(job)
+		if !assert.NoError(t, err, test.strategy) {
+			continue
+		}
+
+		actual := []string{}
+		for _, mapping := range mappings {
+			actual = append(actual, mapping.MappingPath)
+		}
+		assert.Equal(t, test.expected, actual, test.strategy)
+	}
+}
+
+func TestGetInputPathMappingsNumericNames(t *testing.T) {
+	assert := assert.New(t)
+
+	// An input named 2 can't be mounted where the subdirectory for colliding
+	// inputs goes, and vice versa.
+	internal, _ := setupInternal(t, nil)
+	job := inputTestJob(
+		"/iplant/home/ipcdev/3",
+		"/iplant/home/ipcdev/a/data.csv",
+		"/iplant/home/ipcdev/b/data.csv",
+		"/iplant/home/ipcdev/c/data.csv",
+		"/iplant/home/ipcdev/d/2",
+	)
+
+	mappings, err := internal.getInputPathMappings(job)
+	if !assert.NoError(err) {
+		return
+	}
+
+	actual := []string{}
+	for _, mapping := range mappings {
+		actual = append(actual, mapping.MappingPath)
+	}
+	assert.Equal([]string{
+		"/input/3",
+		"/input/data.csv",
+		"/input/2/data.csv",
+		"/input/4/data.csv",
+		"/input/2/2",
+	}, actual)
+}
+
+func TestInputManifestContents(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := inputTestJob("/iplant/home/ipcdev/a/data.csv", "/iplant/home/ipcdev/b/data.csv")
+
+	contents, err := internal.inputManifestContents(job)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var entries []InputManifestEntry
+	if !assert.NoError(json.Unmarshal(contents, &entries)) {
+		return
+	}
+	assert.Equal([]InputManifestEntry{
+		{IRODSPath: "/iplant/home/ipcdev/a/data.csv", Path: "/data-store/input/data.csv"},
+		{IRODSPath: "/iplant/home/ipcdev/b/data.csv", Path: "/data-store/input/2/data.csv"},
+	}, entries)
+}
+
+// diskSpaceTestJob creates a job requiring the given amount of disk space.
+func diskSpaceTestJob(minDiskSpace int64) *model.Job {
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.MinDiskSpace = minDiskSpace
+	return job
+}
+
+func TestGetCSIVolumeCapacity(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+	minCapacity := resourcev1.MustParse("1Gi")
+	maxCapacity := resourcev1.MustParse("100Gi")
+	internal.CSIVolumeMinCapacity = &minCapacity
+	internal.CSIVolumeMaxCapacity = &maxCapacity
+
+	tests := []struct {
+		description  string
+		minDiskSpace int64
+		expected     string
+	}{
+		{"no requirement", 0, "5Gi"},
+		{"within bounds", 20 * 1024 * 1024 * 1024, "20Gi"},
+		{"below the minimum", 1024, "1Gi"},
+		{"above the maximum", 500 * 1024 * 1024 * 1024, "100Gi"},
+	}
+
+	for _, test := range tests {
+		capacity := internal.getCSIVolumeCapacity(diskSpaceTestJob(test.minDiskSpace))
+		assert.Equal(t, test.expected, capacity.String(), test.description)
+	}
+
+	// Bounds that aren't set aren't applied.
+	internal.CSIVolumeMaxCapacity = nil
+	capacity := internal.getCSIVolumeCapacity(diskSpaceTestJob(500 * 1024 * 1024 * 1024))
+	assert.Equal(t, "500Gi", capacity.String())
+}
+
+func TestParseCapacityBound(t *testing.T) {
+	bound, err := ParseCapacityBound("")
+	assert.NoError(t, err)
+	assert.Nil(t, bound)
+
+	bound, err = ParseCapacityBound("5Gi")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "5Gi", bound.String())
+	}
+
+	_, err = ParseCapacityBound("lots")
+	assert.Error(t, err)
+}
+
+func TestWorkingDirEmptyDir(t *testing.T) {
+	emptyDir := workingDirEmptyDir(diskSpaceTestJob(0))
+	assert.Equal(t, "16Gi", emptyDir.SizeLimit.String())
+
+	emptyDir = workingDirEmptyDir(diskSpaceTestJob(2 * 1024 * 1024 * 1024))
+	assert.Equal(t, int64(2*1024*1024*1024), emptyDir.SizeLimit.Value())
+}
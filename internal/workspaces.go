@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	workspaceVolumeName = "workspace"
+
+	// workspaceDirName is the name of the directory in the working directory
+	// where the workspace is mounted. It's excluded from output uploads.
+	workspaceDirName = "workspace"
+
+	// workspaceLastUsedAnnotation records the last time that an analysis using
+	// the workspace was launched or exited.
+	workspaceLastUsedAnnotation = "workspace-last-used"
+
+	workspaceAppType = "workspace"
+)
+
+// WorkspaceInfo describes a user's persistent workspace.
+type WorkspaceInfo struct {
+	Name          string `json:"name"`
+	UserID        string `json:"user_id"`
+	StorageClass  string `json:"storage_class"`
+	RequestedSize string `json:"requested_size"`
+	Capacity      string `json:"capacity"`
+	Phase         string `json:"phase"`
+	LastUsed      string `json:"last_used"`
+}
+
+// workspaceClaimName returns the name of the PersistentVolumeClaim for a user's
+// workspace.
+func workspaceClaimName(userID string) string {
+	return fmt.Sprintf("workspace-%s", userID)
+}
+
+// workspaceMountPath returns the path where the workspace is mounted in the
+// analysis container.
+func workspaceMountPath(job *model.Job) string {
+	return path.Join(workingDirMountPath(job), workspaceDirName)
+}
+
+// workspaceInfo converts a PersistentVolumeClaim into a *WorkspaceInfo.
+func workspaceInfo(pvc *apiv1.PersistentVolumeClaim) *WorkspaceInfo {
+	info := &WorkspaceInfo{
+		Name:     pvc.Name,
+		UserID:   pvc.Labels["user-id"],
+		Phase:    string(pvc.Status.Phase),
+		LastUsed: pvc.Annotations[workspaceLastUsedAnnotation],
+	}
+	if pvc.Spec.StorageClassName != nil {
+		info.StorageClass = *pvc.Spec.StorageClassName
+	}
+	if requested, ok := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]; ok {
+		info.RequestedSize = requested.String()
+	}
+	if capacity, ok := pvc.Status.Capacity[apiv1.ResourceStorage]; ok {
+		info.Capacity = capacity.String()
+	}
+	return info
+}
+
+// workspaceClaim returns the PersistentVolumeClaim for a new workspace. It
+// doesn't have an external-id label, so it's left alone when analyses exit.
+func (i *Internal) workspaceClaim(job *model.Job) (*apiv1.PersistentVolumeClaim, error) {
+	size, err := resourcev1.ParseQuantity(i.WorkspaceSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the workspace size %s", i.WorkspaceSize)
+	}
+
+	pvc := &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: workspaceClaimName(job.UserID),
+			Labels: map[string]string{
+				"app-type": workspaceAppType,
+				"user-id":  job.UserID,
+				"username": labelValueString(job.Submitter),
+			},
+			Annotations: map[string]string{
+				workspaceLastUsedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{
+				apiv1.PersistentVolumeAccessMode(i.WorkspaceAccessMode),
+			},
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+
+	if i.WorkspaceStorageClass != "" {
+		pvc.Spec.StorageClassName = &i.WorkspaceStorageClass
+	}
+
+	return pvc, nil
+}
+
+// touchWorkspace records that the user's workspace was just used so that it
+// isn't cleaned up.
+func (i *Internal) touchWorkspace(ctx context.Context, userID string) error {
+	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+
+	pvc, err := pvcclient.Get(ctx, workspaceClaimName(userID), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	pvc.Annotations[workspaceLastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = pvcclient.Update(ctx, pvc, metav1.UpdateOptions{})
+	return err
+}
+
+// UpsertWorkspace creates the user's workspace if it doesn't exist yet and
+// records that it's being used otherwise.
+func (i *Internal) UpsertWorkspace(ctx context.Context, job *model.Job) error {
+	err := i.touchWorkspace(ctx, job.UserID)
+	if err == nil || !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	pvc, err := i.workspaceClaim(job)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("creating workspace %s for %s", pvc.Name, job.Submitter)
+	_, err = i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Create(ctx, pvc, metav1.CreateOptions{})
+	return err
+}
+
+// workspaceVolume returns the Volume for the user's workspace.
+func workspaceVolume(job *model.Job) apiv1.Volume {
+	return apiv1.Volume{
+		Name: workspaceVolumeName,
+		VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: workspaceClaimName(job.UserID),
+			},
+		},
+	}
+}
+
+// workspaceVolumeMount returns the VolumeMount for the user's workspace.
+func workspaceVolumeMount(job *model.Job) apiv1.VolumeMount {
+	return apiv1.VolumeMount{
+		Name:      workspaceVolumeName,
+		MountPath: workspaceMountPath(job),
+		ReadOnly:  false,
+	}
+}
+
+// userHasRunningAnalyses returns true if any VICE deployments belonging to the
+// user still exist.
+func (i *Internal) userHasRunningAnalyses(ctx context.Context, userID string) (bool, error) {
+	deployments, err := i.deploymentList(ctx, i.ViceNamespace, map[string]string{"user-id": userID}, []string{})
+	if err != nil {
+		return false, err
+	}
+	return len(deployments.Items) > 0, nil
+}
+
+// CleanUpWorkspaces deletes the workspaces of users who haven't launched or
+// exited a VICE analysis within the configured inactivity period.
+func (i *Internal) CleanUpWorkspaces(ctx context.Context) []error {
+	errs := []error{}
+
+	set := labels.Set(map[string]string{"app-type": workspaceAppType})
+	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+	pvclist, err := pvcclient.List(ctx, metav1.ListOptions{LabelSelector: set.AsSelector().String()})
+	if err != nil {
+		return append(errs, err)
+	}
+
+	for _, pvc := range pvclist.Items {
+		lastUsed, err := time.Parse(time.RFC3339, pvc.Annotations[workspaceLastUsedAnnotation])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to determine when workspace %s was last used", pvc.Name))
+			continue
+		}
+
+		if time.Since(lastUsed) < i.WorkspaceInactivityLimit {
+			continue
+		}
+
+		// The workspace may be mounted by an analysis that's been running for
+		// longer than the inactivity limit.
+		inUse, err := i.userHasRunningAnalyses(ctx, pvc.Labels["user-id"])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+
+		log.Infof("deleting workspace %s, which was last used at %s", pvc.Name, lastUsed)
+		if err = pvcclient.Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// getWorkspaceForRequest returns the workspace belonging to the user named in
+// the request.
+func (i *Internal) getWorkspaceForRequest(c echo.Context) (*apiv1.PersistentVolumeClaim, error) {
+	if !i.WorkspacesEnabled {
+		return nil, common.NotFound("persistent workspaces are not enabled")
+	}
+
+	userID, err := i.userIDFromRequest(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := c.Request().Context()
+	pvc, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Get(ctx, workspaceClaimName(userID), metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, common.NotFound("the user does not have a workspace")
+		}
+		return nil, err
+	}
+
+	return pvc, nil
+}
+
+// GetWorkspaceHandler returns information about the user's persistent workspace.
+func (i *Internal) GetWorkspaceHandler(c echo.Context) error {
+	pvc, err := i.getWorkspaceForRequest(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, workspaceInfo(pvc))
+}
+
+// WorkspaceSize is the request body for resizing a workspace.
+type WorkspaceSize struct {
+	Size string `json:"size"`
+}
+
+// ResizeWorkspaceHandler increases the size of the user's workspace. Volumes
+// can't be shrunk, and the storage class has to allow volume expansion.
+func (i *Internal) ResizeWorkspaceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	body := &WorkspaceSize{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	size, err := resourcev1.ParseQuantity(body.Size)
+	if err != nil {
+		return common.BadRequest(fmt.Sprintf("invalid size %s: %s", body.Size, err))
+	}
+
+	if i.WorkspaceMaxSize != "" {
+		maxSize, err := resourcev1.ParseQuantity(i.WorkspaceMaxSize)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse the maximum workspace size %s", i.WorkspaceMaxSize)
+		}
+		if size.Cmp(maxSize) > 0 {
+			return common.BadRequest(fmt.Sprintf("workspaces may not be larger than %s", maxSize.String()))
+		}
+	}
+
+	pvc, err := i.getWorkspaceForRequest(c)
+	if err != nil {
+		return err
+	}
+
+	current := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]
+	if size.Cmp(current) < 0 {
+		return common.BadRequest(fmt.Sprintf("workspaces can't be shrunk below %s", current.String()))
+	}
+
+	pvc.Spec.Resources.Requests[apiv1.ResourceStorage] = size
+	pvc, err = i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Update(ctx, pvc, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, workspaceInfo(pvc))
+}
+
+// DeleteWorkspaceHandler deletes the user's workspace and everything in it. The
+// workspace can't be deleted while any of the user's analyses are running.
+func (i *Internal) DeleteWorkspaceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	pvc, err := i.getWorkspaceForRequest(c)
+	if err != nil {
+		return err
+	}
+
+	inUse, err := i.userHasRunningAnalyses(ctx, pvc.Labels["user-id"])
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return common.Conflict("the workspace can't be deleted while analyses are running")
+	}
+
+	if err = i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
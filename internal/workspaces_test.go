@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// setupWorkspaceInternal sets up an instance of Internal with workspaces
+// enabled.
+func setupWorkspaceInternal(t *testing.T, objs []runtime.Object) *Internal {
+	internal, _ := setupInternal(t, objs)
+	internal.WorkspacesEnabled = true
+	internal.WorkspaceStorageClass = "workspaces"
+	internal.WorkspaceSize = "10Gi"
+	internal.WorkspaceMaxSize = "100Gi"
+	internal.WorkspaceAccessMode = "ReadWriteMany"
+	internal.WorkspaceInactivityLimit = 24 * time.Hour
+	return internal
+}
+
+// workspacePVC creates a fake workspace that was last used at the given time.
+func workspacePVC(userID string, lastUsed time.Time) *apiv1.PersistentVolumeClaim {
+	return &apiv1.PersistentVolumeClaim{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace: "vice-apps",
+			Name:      workspaceClaimName(userID),
+			Labels: map[string]string{
+				"app-type": workspaceAppType,
+				"user-id":  userID,
+			},
+			Annotations: map[string]string{
+				workspaceLastUsedAnnotation: lastUsed.UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: resource.MustParse("10Gi"),
+				},
+			},
+		},
+	}
+}
+
+func TestWorkspaceClaim(t *testing.T) {
+	assert := assert.New(t)
+	internal := setupWorkspaceInternal(t, []runtime.Object{})
+
+	job := &model.Job{UserID: "user-id", Submitter: "ipcdev"}
+	pvc, err := internal.workspaceClaim(job)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("workspace-user-id", pvc.Name)
+	assert.Equal("user-id", pvc.Labels["user-id"])
+	assert.NotContains(pvc.Labels, "external-id", "workspaces must not be deleted when an analysis exits")
+	assert.Equal("workspaces", *pvc.Spec.StorageClassName)
+	assert.Equal([]apiv1.PersistentVolumeAccessMode{apiv1.ReadWriteMany}, pvc.Spec.AccessModes)
+	size := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]
+	assert.Equal("10Gi", size.String())
+}
+
+func TestUpsertWorkspace(t *testing.T) {
+	assert := assert.New(t)
+	internal := setupWorkspaceInternal(t, []runtime.Object{})
+	ctx := context.Background()
+	pvcclient := internal.clientset.CoreV1().PersistentVolumeClaims(internal.ViceNamespace)
+
+	job := &model.Job{UserID: "user-id", Submitter: "ipcdev"}
+	if !assert.NoError(internal.UpsertWorkspace(ctx, job)) {
+		return
+	}
+
+	pvc, err := pvcclient.Get(ctx, workspaceClaimName(job.UserID), meta_v1.GetOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Launching again should only update the last-used time.
+	pvc.Annotations[workspaceLastUsedAnnotation] = "2000-01-01T00:00:00Z"
+	_, err = pvcclient.Update(ctx, pvc, meta_v1.UpdateOptions{})
+	assert.NoError(err)
+	assert.NoError(internal.UpsertWorkspace(ctx, job))
+
+	pvc, err = pvcclient.Get(ctx, workspaceClaimName(job.UserID), meta_v1.GetOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NotEqual("2000-01-01T00:00:00Z", pvc.Annotations[workspaceLastUsedAnnotation])
+}
+
+func TestCleanUpWorkspaces(t *testing.T) {
+	assert := assert.New(t)
+
+	stale := time.Now().Add(-48 * time.Hour)
+	running := labeledViceDeployment(1, "external-id", map[string]string{"app-type": "interactive", "user-id": "busy"})
+
+	internal := setupWorkspaceInternal(t, []runtime.Object{
+		workspacePVC("inactive", stale),
+		workspacePVC("busy", stale),
+		workspacePVC("recent", time.Now()),
+		running,
+	})
+	ctx := context.Background()
+
+	errs := internal.CleanUpWorkspaces(ctx)
+	assert.Empty(errs)
+
+	pvcs, err := internal.clientset.CoreV1().PersistentVolumeClaims(internal.ViceNamespace).List(ctx, meta_v1.ListOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	remaining := []string{}
+	for _, pvc := range pvcs.Items {
+		remaining = append(remaining, pvc.Name)
+	}
+	assert.ElementsMatch([]string{"workspace-busy", "workspace-recent"}, remaining)
+}
@@ -0,0 +1,180 @@
+// Package leader makes sure that background work is only done by one replica
+// of app-exposer at a time. The replicas elect a leader using a Lease in the
+// cluster and only the leader runs the registered workers. HTTP handlers are
+// not affected and run on every replica.
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var log = common.Log.WithFields(logrus.Fields{"package": "leader"})
+
+// Worker is a function that runs in the background on the leader. The context
+// is canceled when the replica stops being the leader, and the function should
+// return promptly when that happens.
+type Worker func(ctx context.Context)
+
+// Init contains the settings for creating an *Elector.
+type Init struct {
+	ClientSet     kubernetes.Interface
+	Namespace     string
+	LeaseName     string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	// Disabled makes the replica act as the leader without taking part in an
+	// election. Only useful when a single replica is running.
+	Disabled bool
+}
+
+// Elector takes part in leader elections and runs the registered workers while
+// the replica is the leader.
+type Elector struct {
+	Init
+
+	mu       sync.RWMutex
+	workers  map[string]Worker
+	leader   string
+	isLeader bool
+}
+
+// New returns a newly created *Elector.
+func New(init *Init) *Elector {
+	return &Elector{
+		Init:    *init,
+		workers: make(map[string]Worker),
+	}
+}
+
+// AddWorker registers a worker to run on the leader. Workers must be added
+// before Run is called.
+func (e *Elector) AddWorker(name string, worker Worker) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.workers[name] = worker
+}
+
+// Leader returns the identity of the current leader, which is empty if no
+// leader has been observed yet.
+func (e *Elector) Leader() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// IsLeader returns true if this replica is the current leader.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.isLeader
+}
+
+func (e *Elector) setLeader(identity string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = identity
+	e.isLeader = identity == e.Identity
+}
+
+// runWorkers starts all of the registered workers in separate goroutines.
+func (e *Elector) runWorkers(ctx context.Context) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for name, worker := range e.workers {
+		log.Infof("starting the %s worker", name)
+		go func(name string, worker Worker) {
+			worker(ctx)
+			log.Infof("the %s worker has stopped", name)
+		}(name, worker)
+	}
+}
+
+// Run takes part in leader elections until the context is canceled. The
+// workers are started whenever this replica becomes the leader and their
+// context is canceled when it loses the lease.
+func (e *Elector) Run(ctx context.Context) {
+	if e.Disabled {
+		log.Warn("leader election is disabled; running all background workers on this replica")
+		e.setLeader(e.Identity)
+		e.runWorkers(ctx)
+		<-ctx.Done()
+		return
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.LeaseName,
+			Namespace: e.Namespace,
+		},
+		Client: e.ClientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.Identity,
+		},
+	}
+
+	config := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            e.LeaseName,
+		ReleaseOnCancel: true,
+		LeaseDuration:   e.LeaseDuration,
+		RenewDeadline:   e.RenewDeadline,
+		RetryPeriod:     e.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("%s is now the leader", e.Identity)
+				e.runWorkers(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s is no longer the leader", e.Identity)
+				e.setLeader("")
+			},
+			OnNewLeader: func(identity string) {
+				log.Infof("%s is the leader", identity)
+				e.setLeader(identity)
+			},
+		},
+	}
+
+	// RunOrDie returns when the lease is lost, so keep trying to reacquire it
+	// until we're told to stop.
+	for {
+		leaderelection.RunOrDie(ctx, config)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// Periodic returns a Worker that calls fn at the given interval until its
+// context is canceled.
+func Periodic(interval time.Duration, fn func(ctx context.Context)) Worker {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package leader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestElector(disabled bool) *Elector {
+	return New(&Init{
+		ClientSet:     fake.NewSimpleClientset(),
+		Namespace:     "testing",
+		LeaseName:     "app-exposer-leader",
+		Identity:      "replica-1",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+		Disabled:      disabled,
+	})
+}
+
+func runElector(t *testing.T, e *Elector) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	started := make(chan struct{})
+	e.AddWorker("test", func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+	})
+
+	go e.Run(ctx)
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker was never started")
+	}
+}
+
+func TestElectorRunsWorkers(t *testing.T) {
+	e := newTestElector(false)
+	runElector(t, e)
+
+	assert.Eventually(t, e.IsLeader, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "replica-1", e.Leader())
+}
+
+func TestElectionDisabled(t *testing.T) {
+	e := newTestElector(true)
+	runElector(t, e)
+
+	assert.True(t, e.IsLeader())
+	assert.Equal(t, "replica-1", e.Leader())
+}
+
+func TestPeriodic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := make(chan struct{}, 2)
+	go Periodic(10*time.Millisecond, func(ctx context.Context) {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+	})(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the periodic function was not called")
+		}
+	}
+}
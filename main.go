@@ -225,7 +225,10 @@ func main() {
 		NATSTLSCA:                     *caCert,
 		NATSCredsFilePath:             *credsPath,
 	}
+	exposerInit.NATSEncodedConn = NewNATSEncodedConn(exposerInit)
 
+	// Apps.Run isn't a singleton background worker. It services requests sent
+	// by the handlers on this replica, so it has to run on every replica.
 	a := apps.NewApps(db, *userSuffix)
 	go a.Run()
 	defer a.Finish()
@@ -234,6 +237,10 @@ func main() {
 		a,
 		c,
 	)
+
+	// Background workers only run on the replica elected as the leader.
+	go app.elector.Run(tracerCtx)
+
 	log.Printf("listening on port %d", *listenPort)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.router))
 }
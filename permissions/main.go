@@ -3,19 +3,98 @@ package permissions
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 var httpClient = http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
-// Permissions performs operations related to checking permissions.
+// The permission levels the permissions service grants, from least to most
+// access.
+const (
+	ReadLevel  = "read"
+	WriteLevel = "write"
+	OwnLevel   = "own"
+)
+
+var levelRanks = map[string]int{
+	ReadLevel:  1,
+	WriteLevel: 2,
+	OwnLevel:   3,
+}
+
+// HasLevel returns true if level grants at least the access that required
+// does. Unrecognized levels, including the empty level, grant nothing.
+func HasLevel(level, required string) bool {
+	have, ok := levelRanks[level]
+	if !ok {
+		return false
+	}
+	want, ok := levelRanks[required]
+	return ok && have >= want
+}
+
+// maxLevel returns whichever of the two levels grants more access.
+func maxLevel(a, b string) string {
+	if levelRanks[b] > levelRanks[a] {
+		return b
+	}
+	return a
+}
+
+const (
+	userSubjectType      = "user"
+	analysisResourceType = "analysis"
+)
+
+// Permissions performs operations related to checking permissions. Levels
+// looked up for analyses are cached for CacheTTL; a zero CacheTTL disables
+// the cache.
 type Permissions struct {
-	BaseURL string
+	BaseURL  string
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[cacheKey]cachedLevel
+	now   func() time.Time
+}
+
+type cacheKey struct {
+	user     string
+	resource string
+}
+
+type cachedLevel struct {
+	level     string
+	fetchedAt time.Time
+}
+
+// New returns a *Permissions that talks to the permissions service at
+// baseURL and caches the levels it looks up for cacheTTL.
+func New(baseURL string, cacheTTL time.Duration) *Permissions {
+	return &Permissions{
+		BaseURL:  baseURL,
+		CacheTTL: cacheTTL,
+	}
+}
+
+// StatusError is returned when the permissions service responds with a
+// status code outside of the 2xx range.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("permissions service returned status %d: %s", e.StatusCode, e.Body)
 }
 
 // Resource is an item that can have permissions attached to it in the
@@ -59,7 +138,19 @@ type Lookup struct {
 	ResourceType string
 }
 
-// GetPermissions returns subjects information about a subject.
+// Level returns the highest permission level in the list, or an empty string
+// if the list doesn't grant any access.
+func (l *PermissionList) Level() string {
+	var level string
+	for _, perm := range l.Permissions {
+		level = maxLevel(level, perm.Level)
+	}
+	return level
+}
+
+// GetPermissions returns the permissions a subject has on a resource. If the
+// lookup doesn't name a resource then all of the subject's permissions on
+// resources of the lookup's resource type are returned.
 func (p *Permissions) GetPermissions(ctx context.Context, lookup *Lookup) (*PermissionList, error) {
 	requrl, err := url.Parse(p.BaseURL)
 	if err != nil {
@@ -83,7 +174,13 @@ func (p *Permissions) GetPermissions(ctx context.Context, lookup *Lookup) (*Perm
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(b)),
+		}
+	}
 
 	retval := &PermissionList{}
 	if err = json.Unmarshal(b, retval); err != nil {
@@ -97,23 +194,152 @@ func (p *Permissions) GetPermissions(ctx context.Context, lookup *Lookup) (*Perm
 // and false if they're not. An error might be returned as well. Access should
 // be denied if an error is returned, even if the boolean return value is true.
 func (p *Permissions) IsAllowed(ctx context.Context, user, resource string) (bool, error) {
+	return p.IsAllowedLevel(ctx, user, resource, ReadLevel)
+}
+
+// IsAllowedLevel returns true if the user has at least the required
+// permission level on the analysis.
+func (p *Permissions) IsAllowedLevel(ctx context.Context, user, resource, required string) (bool, error) {
+	level, err := p.GetLevel(ctx, user, resource)
+	if err != nil {
+		return false, err
+	}
+	return HasLevel(level, required), nil
+}
+
+// AllowedResources returns the subset of the analyses that the user has at
+// least the required permission level on.
+func (p *Permissions) AllowedResources(ctx context.Context, user string, resources []string, required string) (map[string]bool, error) {
+	levels, err := p.GetLevels(ctx, user, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool)
+	for resource, level := range levels {
+		if HasLevel(level, required) {
+			allowed[resource] = true
+		}
+	}
+	return allowed, nil
+}
+
+// GetLevel returns the user's permission level on the analysis, or an empty
+// string if they don't have access to it.
+func (p *Permissions) GetLevel(ctx context.Context, user, resource string) (string, error) {
+	levels, err := p.GetLevels(ctx, user, []string{resource})
+	if err != nil {
+		return "", err
+	}
+	return levels[resource], nil
+}
+
+// GetLevels returns the user's permission level on each of the analyses,
+// keyed by analysis ID. Analyses the user can't access map to an empty
+// string. Levels that aren't cached are looked up in a single request: a
+// single analysis is looked up directly while several are looked up by
+// listing all of the user's analysis permissions.
+func (p *Permissions) GetLevels(ctx context.Context, user string, resources []string) (map[string]string, error) {
+	levels := make(map[string]string, len(resources))
+
+	var missing []string
+	for _, resource := range resources {
+		if level, ok := p.cached(user, resource); ok {
+			levels[resource] = level
+		} else if _, seen := levels[resource]; !seen {
+			levels[resource] = ""
+			missing = append(missing, resource)
+		}
+	}
+
+	if len(missing) == 0 {
+		return levels, nil
+	}
+
 	lookup := &Lookup{
 		Subject:      user,
-		SubjectType:  "user",
-		Resource:     resource,
-		ResourceType: "analysis",
+		SubjectType:  userSubjectType,
+		ResourceType: analysisResourceType,
+	}
+	if len(missing) == 1 {
+		lookup.Resource = missing[0]
 	}
 
 	l, err := p.GetPermissions(ctx, lookup)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if len(l.Permissions) > 0 {
-		if l.Permissions[0].Level != "" {
-			return true, nil
+	found := make(map[string]string)
+	for _, perm := range l.Permissions {
+		name := perm.Resource.Name
+		if lookup.Resource != "" {
+			name = lookup.Resource
 		}
+		found[name] = maxLevel(found[name], perm.Level)
+	}
+
+	for _, resource := range missing {
+		levels[resource] = found[resource]
+		p.store(user, resource, found[resource])
+	}
+
+	return levels, nil
+}
+
+func (p *Permissions) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// cached returns the cached level for the user and analysis if it hasn't
+// expired.
+func (p *Permissions) cached(user, resource string) (string, bool) {
+	if p.CacheTTL <= 0 {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := cacheKey{user: user, resource: resource}
+	entry, ok := p.cache[key]
+	if !ok {
+		return "", false
+	}
+	if p.timeNow().Sub(entry.fetchedAt) >= p.CacheTTL {
+		delete(p.cache, key)
+		return "", false
+	}
+	return entry.level, true
+}
+
+// store caches the level for the user and analysis, clearing out any expired
+// entries once the cache has grown large enough to be worth sweeping.
+func (p *Permissions) store(user, resource, level string) {
+	if p.CacheTTL <= 0 {
+		return
 	}
 
-	return false, nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.timeNow()
+	if p.cache == nil {
+		p.cache = make(map[cacheKey]cachedLevel)
+	}
+	if len(p.cache) >= cacheSweepSize {
+		for key, entry := range p.cache {
+			if now.Sub(entry.fetchedAt) >= p.CacheTTL {
+				delete(p.cache, key)
+			}
+		}
+	}
+	p.cache[cacheKey{user: user, resource: resource}] = cachedLevel{level: level, fetchedAt: now}
 }
+
+// cacheSweepSize is the number of cached levels at which expired entries
+// start getting swept out of the cache.
+const cacheSweepSize = 1024
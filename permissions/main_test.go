@@ -0,0 +1,194 @@
+package permissions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func permissionsServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func writePermissions(t *testing.T, w http.ResponseWriter, perms ...Permission) {
+	t.Helper()
+	if err := json.NewEncoder(w).Encode(&PermissionList{Permissions: perms}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func analysisPermission(id, level string) Permission {
+	return Permission{
+		Level:    level,
+		Resource: Resource{Name: id, Type: "analysis"},
+	}
+}
+
+func TestHasLevel(t *testing.T) {
+	tests := []struct {
+		level, required string
+		want            bool
+	}{
+		{ReadLevel, ReadLevel, true},
+		{ReadLevel, WriteLevel, false},
+		{WriteLevel, ReadLevel, true},
+		{WriteLevel, OwnLevel, false},
+		{OwnLevel, WriteLevel, true},
+		{"", ReadLevel, false},
+		{"bogus", ReadLevel, false},
+		{OwnLevel, "bogus", false},
+	}
+
+	for _, tt := range tests {
+		if got := HasLevel(tt.level, tt.required); got != tt.want {
+			t.Errorf("HasLevel(%q, %q) = %t, want %t", tt.level, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestIsAllowedLevelUsesHighestLevel(t *testing.T) {
+	srv, _ := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/permissions/subjects/user/test-user/analysis/a1" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		writePermissions(t, w, analysisPermission("a1", ReadLevel), analysisPermission("a1", OwnLevel))
+	})
+	p := New(srv.URL, 0)
+
+	allowed, err := p.IsAllowedLevel(context.Background(), "test-user", "a1", OwnLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Error("expected own access to be allowed")
+	}
+}
+
+func TestIsAllowedNoPermissions(t *testing.T) {
+	srv, _ := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writePermissions(t, w)
+	})
+	p := New(srv.URL, 0)
+
+	allowed, err := p.IsAllowed(context.Background(), "test-user", "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Error("expected access to be denied")
+	}
+}
+
+func TestGetPermissionsNon2xx(t *testing.T) {
+	srv, _ := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		writePermissions(t, w, analysisPermission("a1", OwnLevel))
+	})
+	p := New(srv.URL, 0)
+
+	allowed, err := p.IsAllowed(context.Background(), "test-user", "a1")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a *StatusError, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status code was %d", statusErr.StatusCode)
+	}
+	if allowed {
+		t.Error("expected access to be denied")
+	}
+}
+
+func TestGetLevelsBulk(t *testing.T) {
+	srv, calls := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/permissions/subjects/user/test-user/analysis" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		writePermissions(t, w,
+			analysisPermission("a1", ReadLevel),
+			analysisPermission("a2", WriteLevel),
+			analysisPermission("a4", OwnLevel),
+		)
+	})
+	p := New(srv.URL, 0)
+
+	allowed, err := p.AllowedResources(context.Background(), "test-user", []string{"a1", "a2", "a3"}, WriteLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 1 || !allowed["a2"] {
+		t.Errorf("unexpected allowed resources %v", allowed)
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 request, got %d", *calls)
+	}
+}
+
+func TestGetLevelsCache(t *testing.T) {
+	srv, calls := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writePermissions(t, w, analysisPermission("a1", ReadLevel))
+	})
+	now := time.Now()
+	p := New(srv.URL, time.Minute)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.IsAllowed(ctx, "test-user", "a1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 request while cached, got %d", *calls)
+	}
+
+	// Another user's lookup for the same analysis isn't served from the cache.
+	if _, err := p.IsAllowed(ctx, "other-user", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Errorf("expected 2 requests, got %d", *calls)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := p.IsAllowed(ctx, "test-user", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected the expired entry to be looked up again, got %d requests", *calls)
+	}
+}
+
+func TestGetLevelsCachesOnlyLookedUpResources(t *testing.T) {
+	srv, calls := permissionsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writePermissions(t, w, analysisPermission("a1", ReadLevel), analysisPermission("a2", ReadLevel))
+	})
+	p := New(srv.URL, time.Minute)
+	ctx := context.Background()
+
+	if _, err := p.GetLevels(ctx, "test-user", []string{"a1", "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	levels, err := p.GetLevels(ctx, "test-user", []string{"a2", "a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 request, got %d", *calls)
+	}
+	if levels["a1"] != ReadLevel || levels["a2"] != ReadLevel {
+		t.Errorf("unexpected levels %v", levels)
+	}
+}
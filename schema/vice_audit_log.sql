@@ -0,0 +1,27 @@
+-- Administrative and destructive requests made to app-exposer. Required when
+-- audit.enabled is true.
+CREATE TABLE IF NOT EXISTS vice_audit_log (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    actor text NOT NULL,
+    action text NOT NULL,
+    -- Not every request refers to an analysis, and the ones that do may name
+    -- an analysis that doesn't exist.
+    analysis_id text,
+    resource text NOT NULL DEFAULT '',
+    params jsonb NOT NULL DEFAULT '{}',
+    outcome text NOT NULL,
+    status integer NOT NULL,
+    error text NOT NULL DEFAULT '',
+    remote_addr text NOT NULL DEFAULT '',
+    created_on timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_audit_log_created_on_index
+    ON vice_audit_log (created_on);
+
+CREATE INDEX IF NOT EXISTS vice_audit_log_actor_index
+    ON vice_audit_log (actor, created_on);
+
+CREATE INDEX IF NOT EXISTS vice_audit_log_analysis_id_index
+    ON vice_audit_log (analysis_id, created_on)
+    WHERE analysis_id IS NOT NULL;
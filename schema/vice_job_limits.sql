@@ -0,0 +1,22 @@
+-- Concurrent job limits that are checked alongside the per-user limits in
+-- job_limits. Required when vice.limits.extended is true.
+
+-- Limits granted to the members of a group. Users in more than one of these
+-- groups get the highest limit.
+CREATE TABLE IF NOT EXISTS group_job_limits (
+    group_name text NOT NULL PRIMARY KEY,
+    concurrent_jobs integer NOT NULL CHECK (concurrent_jobs >= 0)
+);
+
+-- The number of copies of an app that may run at the same time across all
+-- users. App IDs are text because they aren't all UUIDs.
+CREATE TABLE IF NOT EXISTS app_job_limits (
+    app_id text NOT NULL PRIMARY KEY,
+    concurrent_jobs integer NOT NULL CHECK (concurrent_jobs >= 0)
+);
+
+-- The number of analyses that may run at the same time in a node pool.
+CREATE TABLE IF NOT EXISTS node_pool_job_limits (
+    node_pool text NOT NULL PRIMARY KEY,
+    concurrent_jobs integer NOT NULL CHECK (concurrent_jobs >= 0)
+);
@@ -0,0 +1,16 @@
+-- VICE launches that are waiting for the user to drop below their concurrent
+-- job limit. Required when vice.queue.enabled is true.
+CREATE TABLE IF NOT EXISTS vice_launch_queue (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    user_id uuid NOT NULL,
+    external_id text NOT NULL UNIQUE,
+    -- The JSON encoded job submission.
+    job bytea NOT NULL,
+    position integer NOT NULL,
+    queued_on timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Positions aren't unique, since reordering a queue updates them one at a
+-- time.
+CREATE INDEX IF NOT EXISTS vice_launch_queue_user_id_index
+    ON vice_launch_queue (user_id, position);
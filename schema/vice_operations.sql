@@ -0,0 +1,20 @@
+-- Long-running requests, such as save-and-exit, that can be resumed by another
+-- replica. Required when vice.operations.enabled is true.
+CREATE TABLE IF NOT EXISTS vice_operations (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    kind text NOT NULL,
+    external_id text NOT NULL,
+    state text NOT NULL,
+    error text,
+    created_on timestamp with time zone NOT NULL DEFAULT now(),
+    updated_on timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Only one operation of each kind may be underway for an analysis at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS vice_operations_active_index
+    ON vice_operations (kind, external_id)
+    WHERE state NOT IN ('done', 'failed');
+
+CREATE INDEX IF NOT EXISTS vice_operations_updated_on_index
+    ON vice_operations (updated_on)
+    WHERE state NOT IN ('done', 'failed');
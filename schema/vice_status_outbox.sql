@@ -0,0 +1,17 @@
+-- Analysis status updates waiting to be delivered to job-status-listener.
+-- Required when vice.job-status.outbox.enabled is true. Updates are delivered
+-- in id order for each job, so id has to increase with each insert.
+CREATE TABLE IF NOT EXISTS vice_status_outbox (
+    id bigserial NOT NULL PRIMARY KEY,
+    job_id text NOT NULL,
+    host text NOT NULL,
+    state text NOT NULL,
+    message text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt timestamp with time zone NOT NULL DEFAULT now(),
+    last_error text,
+    created_on timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_status_outbox_job_id_index
+    ON vice_status_outbox (job_id, id);